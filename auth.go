@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	passwordHashScheme     = "pbkdf2-sha256"
+	passwordHashIterations = 100000
+	passwordHashKeyLen     = 32
+	passwordSaltLen        = 16
+
+	userPassAuth       = 0x02
+	noAcceptableMethod = 0xFF
+	userPassVersion    = 0x01
+	userPassSuccess    = 0x00
+	userPassFailure    = 0x01
+)
+
+// UserConfig describes a proxy user in the YAML configuration file.
+type UserConfig struct {
+	Username     string `yaml:"username"`
+	PasswordHash string `yaml:"password_hash"`
+	// DigestHA1 and DigestHA1SHA256 hold hex H(username:realm:password) and
+	// enable HTTP Digest authentication with MD5 and SHA-256 respectively.
+	DigestHA1       string `yaml:"digest_ha1"`
+	DigestHA1SHA256 string `yaml:"digest_ha1_sha256"`
+	// Bandwidth replaces the per_user bandwidth limit for this user.
+	Bandwidth BandwidthLimit `yaml:"bandwidth,omitempty"`
+	// Quota replaces the per_user transfer quota for this user.
+	Quota QuotaLimit `yaml:"quota,omitempty"`
+	// Egress replaces the top-level egress setting for this user.
+	Egress EgressConfig `yaml:"egress,omitempty"`
+}
+
+// passwordHash is a parsed "pbkdf2-sha256$iterations$salt$key" string.
+type passwordHash struct {
+	iterations int
+	salt       []byte
+	key        []byte
+}
+
+// unknownUserHash is checked for usernames that don't exist, so that failing
+// for an unknown user costs as much as a wrong password and doesn't reveal
+// which usernames are configured.
+var unknownUserHash = passwordHash{
+	iterations: passwordHashIterations,
+	salt:       make([]byte, passwordSaltLen),
+	key:        make([]byte, passwordHashKeyLen),
+}
+
+// userStore validates credentials against the users defined in the config.
+type userStore struct {
+	users map[string]passwordHash
+	// digest maps username to algorithm name to stored HA1.
+	digest map[string]map[string]string
+	// verified caches a digest of the last password that matched for each user,
+	// so that clients opening many tunnels don't pay the PBKDF2 cost every time.
+	verified map[string][sha256.Size]byte
+	mutex    sync.Mutex
+}
+
+// hashPassword derives a storable hash for password using a random salt.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("could not generate salt: %v", err)
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordHashIterations, passwordHashKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, passwordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// parsePasswordHash parses a hash produced by hashPassword.
+func parsePasswordHash(encoded string) (passwordHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {
+		return passwordHash{}, fmt.Errorf("unsupported password hash format, expected %s$iterations$salt$key", passwordHashScheme)
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return passwordHash{}, fmt.Errorf("invalid iteration count '%s'", parts[1])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return passwordHash{}, fmt.Errorf("invalid salt: %v", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return passwordHash{}, fmt.Errorf("invalid key")
+	}
+	return passwordHash{iterations: iterations, salt: salt, key: key}, nil
+}
+
+// matches reports whether password derives to the stored key.
+func (h passwordHash) matches(password string) bool {
+	key, err := pbkdf2.Key(sha256.New, password, h.salt, h.iterations, len(h.key))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// newUserStore builds a user store from the configured users.
+func newUserStore(users []UserConfig) (*userStore, error) {
+	store := &userStore{
+		users:    make(map[string]passwordHash),
+		digest:   make(map[string]map[string]string),
+		verified: make(map[string][sha256.Size]byte),
+	}
+	for _, user := range users {
+		if user.Username == "" {
+			return nil, fmt.Errorf("user entry with empty username")
+		}
+		if _, exists := store.users[user.Username]; exists {
+			return nil, fmt.Errorf("duplicate user '%s'", user.Username)
+		}
+		hash, err := parsePasswordHash(user.PasswordHash)
+		if err != nil {
+			return nil, fmt.Errorf("user '%s': %v", user.Username, err)
+		}
+		store.users[user.Username] = hash
+
+		for _, entry := range []struct {
+			algorithm string
+			ha1       string
+			size      int
+		}{{"MD5", user.DigestHA1, md5.Size}, {"SHA-256", user.DigestHA1SHA256, sha256.Size}} {
+			if entry.ha1 == "" {
+				continue
+			}
+			if raw, err := hex.DecodeString(entry.ha1); err != nil || len(raw) != entry.size {
+				return nil, fmt.Errorf("user '%s': invalid %s digest HA1", user.Username, entry.algorithm)
+			}
+			if store.digest[user.Username] == nil {
+				store.digest[user.Username] = make(map[string]string)
+			}
+			store.digest[user.Username][entry.algorithm] = strings.ToLower(entry.ha1)
+		}
+	}
+	return store, nil
+}
+
+// digestHA1 returns the stored HA1 of username for the Digest algorithm, if any.
+func (s *userStore) digestHA1(username, algorithm string) string {
+	return s.digest[username][strings.ToUpper(algorithm)]
+}
+
+// hasDigest reports whether any user can authenticate with the Digest algorithm.
+func (s *userStore) hasDigest(algorithm string) bool {
+	for _, ha1s := range s.digest {
+		if ha1s[algorithm] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// empty reports whether no users are configured.
+func (s *userStore) empty() bool {
+	return len(s.users) == 0
+}
+
+// authenticate checks a username/password pair against the store.
+func (s *userStore) authenticate(username, password string) bool {
+	hash, exists := s.users[username]
+	if !exists {
+		unknownUserHash.matches(password)
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(password))
+	s.mutex.Lock()
+	cached, ok := s.verified[username]
+	s.mutex.Unlock()
+	if ok && subtle.ConstantTimeCompare(cached[:], digest[:]) == 1 {
+		return true
+	}
+
+	if !hash.matches(password) {
+		return false
+	}
+	s.mutex.Lock()
+	s.verified[username] = digest
+	s.mutex.Unlock()
+	return true
+}
+
+// accessPolicy bundles what handlers need to decide whether a client may use the proxy.
+type accessPolicy struct {
+	clients     *clientFilter
+	users       *userStore
+	requireAuth bool
+	// certUser is the user identified by a verified TLS client certificate on
+	// the connection the policy was scoped to with withCertUser.
+	certUser string
+}
+
+// newAccessPolicy builds the runtime access policy from a parsed config.
+func newAccessPolicy(config *Config) (*accessPolicy, error) {
+	users, err := newUserStore(config.Users)
+	if err != nil {
+		return nil, err
+	}
+	if config.RequireAuth && users.empty() {
+		return nil, fmt.Errorf("require_auth is set but no users are configured")
+	}
+	clients, err := newClientFilter(config.AllowedIPs, config.DeniedIPs)
+	if err != nil {
+		return nil, err
+	}
+	return &accessPolicy{
+		clients:     clients,
+		users:       users,
+		requireAuth: config.RequireAuth,
+	}, nil
+}
+
+// newListenerAccessPolicy builds the access policy of one listener. Settings
+// the listener leaves unset are inherited from the top level of the config.
+func newListenerAccessPolicy(config *Config, listener ListenerConfig) (*accessPolicy, error) {
+	scoped := *config
+	if listener.AllowedIPs != nil {
+		scoped.AllowedIPs = listener.AllowedIPs
+	}
+	if listener.DeniedIPs != nil {
+		scoped.DeniedIPs = listener.DeniedIPs
+	}
+	if listener.RequireAuth != nil {
+		scoped.RequireAuth = *listener.RequireAuth
+	}
+	if listener.Users != nil {
+		users := make(map[string]UserConfig)
+		for _, user := range config.Users {
+			users[user.Username] = user
+		}
+		scoped.Users = nil
+		for _, username := range listener.Users {
+			user, exists := users[username]
+			if !exists {
+				return nil, fmt.Errorf("unknown user '%s'", username)
+			}
+			scoped.Users = append(scoped.Users, user)
+		}
+	}
+	return newAccessPolicy(&scoped)
+}
+
+// withCertUser returns a copy of the policy for a connection whose client
+// certificate identifies username, which then needs no other credentials.
+// Names that are not configured users are ignored.
+func (p *accessPolicy) withCertUser(username string) *accessPolicy {
+	if _, exists := p.users.users[username]; !exists {
+		return p
+	}
+	scoped := *p
+	scoped.certUser = username
+	return &scoped
+}
+
+// allowsAnonymous reports whether clientIP may use the proxy without credentials.
+func (p *accessPolicy) allowsAnonymous(clientIP string) bool {
+	return p.clients.isAllowed(clientIP) && !p.requireAuth
+}
+
+// mayConnect reports whether clientIP may reach a protocol handler at all,
+// either anonymously or by authenticating. Denied clients are always refused.
+func (p *accessPolicy) mayConnect(clientIP string) bool {
+	if p.clients.isDenied(clientIP) {
+		return false
+	}
+	return p.allowsAnonymous(clientIP) || !p.users.empty()
+}
+
+// selectSocks5Method picks the authentication method to use from the client's offer.
+// A client certificate already identifies the tunnel owner; otherwise
+// username/password is preferred when available so the owner is known.
+func (p *accessPolicy) selectSocks5Method(clientIP string, methods []byte) byte {
+	offered := make(map[byte]bool)
+	for _, method := range methods {
+		offered[method] = true
+	}
+	if offered[noAuth] && p.certUser != "" {
+		return noAuth
+	}
+	if offered[userPassAuth] && !p.users.empty() {
+		return userPassAuth
+	}
+	if offered[noAuth] && p.allowsAnonymous(clientIP) {
+		return noAuth
+	}
+	return noAcceptableMethod
+}
+
+// socks5UserPassAuth runs the RFC 1929 username/password sub-negotiation and
+// returns the authenticated username.
+func socks5UserPassAuth(clientConn net.Conn, reader *bufio.Reader, users *userStore) (string, error) {
+	version, err := reader.ReadByte()
+	if err != nil {
+		return "", fmt.Errorf("failed to read auth version: %v", err)
+	}
+	if version != userPassVersion {
+		clientConn.Write([]byte{userPassVersion, userPassFailure})
+		return "", fmt.Errorf("unsupported auth version: %d", version)
+	}
+
+	username, err := readLengthPrefixed(reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to read username: %v", err)
+	}
+	password, err := readLengthPrefixed(reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %v", err)
+	}
+
+	if !users.authenticate(username, password) {
+		clientConn.Write([]byte{userPassVersion, userPassFailure})
+		return "", fmt.Errorf("invalid credentials for user '%s'", username)
+	}
+	clientConn.Write([]byte{userPassVersion, userPassSuccess})
+	return username, nil
+}
+
+// readLengthPrefixed reads a single-byte length followed by that many bytes.
+func readLengthPrefixed(reader *bufio.Reader) (string, error) {
+	length, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+// TestPasswordHashRoundTrip tests that generated hashes verify the original password only
+func TestPasswordHashRoundTrip(t *testing.T) {
+	encoded, err := hashPassword("secret")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	store, err := newUserStore([]UserConfig{{Username: "alice", PasswordHash: encoded}})
+	if err != nil {
+		t.Fatalf("Failed to build user store: %v", err)
+	}
+
+	if !store.authenticate("alice", "secret") {
+		t.Error("Expected correct password to authenticate")
+	}
+	if !store.authenticate("alice", "secret") {
+		t.Error("Expected cached password to authenticate")
+	}
+	if store.authenticate("alice", "wrong") {
+		t.Error("Expected wrong password to be rejected")
+	}
+	if store.authenticate("bob", "secret") {
+		t.Error("Expected unknown user to be rejected")
+	}
+}
+
+// TestUserStoreRejectsInvalidHash tests that malformed password hashes fail config validation
+func TestUserStoreRejectsInvalidHash(t *testing.T) {
+	for _, hash := range []string{"", "secret", "pbkdf2-sha256$0$c2FsdA$a2V5", "md5$1$c2FsdA$a2V5"} {
+		if _, err := newUserStore([]UserConfig{{Username: "alice", PasswordHash: hash}}); err == nil {
+			t.Errorf("Expected hash %q to be rejected", hash)
+		}
+	}
+}
+
+// TestSelectSocks5Method tests method negotiation against the access policy
+func TestSelectSocks5Method(t *testing.T) {
+	encoded, _ := hashPassword("secret")
+	policy, err := newAccessPolicy(&Config{
+		AllowedIPs: []string{"127.0.0.1"},
+		Users:      []UserConfig{{Username: "alice", PasswordHash: encoded}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build policy: %v", err)
+	}
+
+	tests := []struct {
+		clientIP string
+		methods  []byte
+		expected byte
+	}{
+		{"127.0.0.1", []byte{noAuth}, noAuth},
+		{"127.0.0.1", []byte{noAuth, userPassAuth}, userPassAuth},
+		{"10.0.0.1", []byte{noAuth}, noAcceptableMethod},
+		{"10.0.0.1", []byte{noAuth, userPassAuth}, userPassAuth},
+		{"10.0.0.1", []byte{0x01}, noAcceptableMethod},
+	}
+	for _, tt := range tests {
+		if got := policy.selectSocks5Method(tt.clientIP, tt.methods); got != tt.expected {
+			t.Errorf("selectSocks5Method(%s, %v) = %#x, want %#x", tt.clientIP, tt.methods, got, tt.expected)
+		}
+	}
+
+	policy.requireAuth = true
+	if got := policy.selectSocks5Method("127.0.0.1", []byte{noAuth}); got != noAcceptableMethod {
+		t.Errorf("Expected no-auth to be refused when require_auth is set, got %#x", got)
+	}
+}
+
+// TestSocks5UserPassAuth tests the RFC 1929 sub-negotiation over a pipe
+func TestSocks5UserPassAuth(t *testing.T) {
+	encoded, _ := hashPassword("secret")
+	store, _ := newUserStore([]UserConfig{{Username: "alice", PasswordHash: encoded}})
+
+	for _, tt := range []struct {
+		password string
+		status   byte
+	}{{"secret", userPassSuccess}, {"wrong", userPassFailure}} {
+		server, client := net.Pipe()
+		go func() {
+			request := []byte{userPassVersion, 5}
+			request = append(request, "alice"...)
+			request = append(request, byte(len(tt.password)))
+			request = append(request, tt.password...)
+			client.Write(request)
+		}()
+
+		done := make(chan string)
+		go func() {
+			username, _ := socks5UserPassAuth(server, bufio.NewReader(server), store)
+			done <- username
+		}()
+
+		reply := make([]byte, 2)
+		if _, err := client.Read(reply); err != nil {
+			t.Fatalf("Failed to read auth reply: %v", err)
+		}
+		if reply[1] != tt.status {
+			t.Errorf("Password %q: expected status %d, got %d", tt.password, tt.status, reply[1])
+		}
+		if username := <-done; (username == "alice") != (tt.status == userPassSuccess) {
+			t.Errorf("Password %q: unexpected username %q", tt.password, username)
+		}
+		server.Close()
+		client.Close()
+	}
+}
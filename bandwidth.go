@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// throttleDisplayWindow is how long a direction is reported as throttled
+// after it last had to wait for tokens.
+const throttleDisplayWindow = time.Second
+
+// byteRate is a rate in bytes per second. In the config file it is a number of
+// bytes or a string with a binary K, M or G suffix, such as "512K" or "10MB".
+type byteRate int64
+
+// UnmarshalYAML parses a rate such as 1048576, "1M", "1MB" or "1MiB".
+func (r *byteRate) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+	rate, err := parseByteCount(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(text)), "/S"))
+	if err != nil {
+		return fmt.Errorf("invalid rate '%s', expected bytes per second such as 1048576 or \"1M\"", text)
+	}
+	*r = byteRate(rate)
+	return nil
+}
+
+// byteSize is an amount of data in bytes, written like a byteRate without
+// "/s", with an additional T suffix: 500M, 20G, 1T.
+type byteSize int64
+
+// UnmarshalYAML parses a size such as 1073741824, "1G" or "1GiB".
+func (s *byteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+	size, err := parseByteCount(text)
+	if err != nil {
+		return fmt.Errorf("invalid size '%s', expected bytes such as 1073741824 or \"1G\"", text)
+	}
+	*s = byteSize(size)
+	return nil
+}
+
+// parseByteCount converts a number with an optional binary K, M, G or T suffix to bytes.
+func parseByteCount(text string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(text))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+	multiplier := 1.0
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 || math.IsInf(number, 0) || number*multiplier > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid byte count '%s'", text)
+	}
+	return int64(number * multiplier), nil
+}
+
+// BandwidthLimit caps upload (client to destination) and download
+// (destination to client) rates. Zero means unlimited.
+type BandwidthLimit struct {
+	Upload   byteRate `yaml:"upload,omitempty"`
+	Download byteRate `yaml:"download,omitempty"`
+}
+
+// BandwidthConfig configures traffic shaping. Every connection is limited by
+// all scopes that apply to it; the slowest one sets its pace.
+type BandwidthConfig struct {
+	// Global is shared by all connections.
+	Global BandwidthLimit `yaml:"global,omitempty"`
+	// PerClient is shared by all connections from one client IP.
+	PerClient BandwidthLimit `yaml:"per_client,omitempty"`
+	// PerUser is shared by all connections of one authenticated user, unless
+	// the user has its own bandwidth setting.
+	PerUser BandwidthLimit `yaml:"per_user,omitempty"`
+}
+
+// tokenBucket allows rate bytes per second with bursts of up to one second.
+type tokenBucket struct {
+	rate   float64
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket, or nil if rate is unlimited.
+func newTokenBucket(rate byteRate) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take removes n tokens and returns how long the caller must wait until the
+// bucket is no longer in debt.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// bucketPair holds the upload and download buckets of one scope.
+type bucketPair struct {
+	limit    BandwidthLimit
+	upload   *tokenBucket
+	download *tokenBucket
+	refs     int
+}
+
+func newBucketPair(limit BandwidthLimit) *bucketPair {
+	return &bucketPair{limit: limit, upload: newTokenBucket(limit.Upload), download: newTokenBucket(limit.Download)}
+}
+
+// bucketGroup holds one bucketPair per key (client IP or username). Pairs are
+// created on first use and dropped when their last connection ends.
+type bucketGroup struct {
+	mutex   sync.Mutex
+	buckets map[string]*bucketPair
+}
+
+// acquire returns the pair for key, creating it with limit if needed.
+func (g *bucketGroup) acquire(key string, limit BandwidthLimit) *bucketPair {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.buckets == nil {
+		g.buckets = make(map[string]*bucketPair)
+	}
+	pair, exists := g.buckets[key]
+	if !exists {
+		pair = newBucketPair(limit)
+		g.buckets[key] = pair
+	}
+	pair.refs++
+	return pair
+}
+
+// release drops a reference taken by acquire.
+func (g *bucketGroup) release(key string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if pair, exists := g.buckets[key]; exists {
+		pair.refs--
+		if pair.refs <= 0 {
+			delete(g.buckets, key)
+		}
+	}
+}
+
+// bandwidthShaper is the runtime form of the bandwidth settings. Connections
+// keep the shaper of the configuration they were accepted with.
+type bandwidthShaper struct {
+	global     *bucketPair
+	perClient  BandwidthLimit
+	perUser    BandwidthLimit
+	userLimits map[string]BandwidthLimit
+	rules      []*bucketPair // by destination rule index; nil if unlimited
+	clients    bucketGroup
+	users      bucketGroup
+}
+
+// newBandwidthShaper builds the shaper from the bandwidth, user and destination rule settings.
+func newBandwidthShaper(config *Config) *bandwidthShaper {
+	shaper := &bandwidthShaper{
+		global:     newBucketPair(config.Bandwidth.Global),
+		perClient:  config.Bandwidth.PerClient,
+		perUser:    config.Bandwidth.PerUser,
+		userLimits: make(map[string]BandwidthLimit),
+		rules:      make([]*bucketPair, len(config.Destinations.Rules)),
+	}
+	for _, user := range config.Users {
+		if user.Bandwidth != (BandwidthLimit{}) {
+			shaper.userLimits[user.Username] = user.Bandwidth
+		}
+	}
+	for i, rule := range config.Destinations.Rules {
+		if rule.Bandwidth != (BandwidthLimit{}) {
+			shaper.rules[i] = newBucketPair(rule.Bandwidth)
+		}
+	}
+	return shaper
+}
+
+// connShaper paces one connection by every bucket that applies to it.
+type connShaper struct {
+	owner    *bandwidthShaper
+	clientIP string
+	username string
+	upload   []*tokenBucket
+	download []*tokenBucket
+	// uploadLimit and downloadLimit are the tightest configured rates (0: unlimited).
+	uploadLimit   int64
+	downloadLimit int64
+	// uploadThrottled and downloadThrottled hold when each direction last waited, in Unix nanoseconds.
+	uploadThrottled   atomic.Int64
+	downloadThrottled atomic.Int64
+}
+
+// add includes a scope's buckets in the connection's limits.
+func (c *connShaper) add(pair *bucketPair) {
+	if pair == nil {
+		return
+	}
+	if pair.upload != nil {
+		c.upload = append(c.upload, pair.upload)
+		c.uploadLimit = tighterLimit(c.uploadLimit, int64(pair.limit.Upload))
+	}
+	if pair.download != nil {
+		c.download = append(c.download, pair.download)
+		c.downloadLimit = tighterLimit(c.downloadLimit, int64(pair.limit.Download))
+	}
+}
+
+// tighterLimit returns the lower of two rates where 0 means unlimited.
+func tighterLimit(current, limit int64) int64 {
+	if current == 0 || limit < current {
+		return limit
+	}
+	return current
+}
+
+// shaperFor returns the shaper for a connection from clientIP, authenticated
+// as username (if any), to destination. It must be released when the
+// connection ends; removeConnection does this for attached shapers.
+func (cfg *proxyConfig) shaperFor(clientIP, username, destination string) *connShaper {
+	s := cfg.bandwidth
+	shaper := &connShaper{owner: s, clientIP: clientIP, username: username}
+	shaper.add(s.global)
+	if s.perClient != (BandwidthLimit{}) {
+		shaper.add(s.clients.acquire(clientIP, s.perClient))
+	}
+	if username != "" {
+		limit, exists := s.userLimits[username]
+		if !exists {
+			limit = s.perUser
+		}
+		if limit != (BandwidthLimit{}) {
+			shaper.add(s.users.acquire(username, limit))
+		} else {
+			shaper.username = ""
+		}
+	}
+	if index, _ := cfg.destinations.match(destination); index >= 0 {
+		shaper.add(s.rules[index])
+	}
+	return shaper
+}
+
+// release drops the connection's references to per-client and per-user buckets.
+func (c *connShaper) release() {
+	if c.owner.perClient != (BandwidthLimit{}) {
+		c.owner.clients.release(c.clientIP)
+	}
+	if c.username != "" {
+		c.owner.users.release(c.username)
+	}
+}
+
+// chunkSize bounds how many bytes to move at once so that limited
+// connections send about ten evenly spaced chunks per second.
+func (c *connShaper) chunkSize(outbound bool, size int) int {
+	limit := c.downloadLimit
+	if outbound {
+		limit = c.uploadLimit
+	}
+	if limit == 0 {
+		return size
+	}
+	chunk := int(limit / 10)
+	if chunk < minBufferSize {
+		chunk = minBufferSize
+	}
+	if chunk > size {
+		return size
+	}
+	return chunk
+}
+
+// wait charges n bytes in one direction to every bucket and sleeps until the
+// slowest of them allows more traffic.
+func (c *connShaper) wait(outbound bool, n int) {
+	buckets, throttled := c.download, &c.downloadThrottled
+	if outbound {
+		buckets, throttled = c.upload, &c.uploadThrottled
+	}
+	var delay time.Duration
+	for _, bucket := range buckets {
+		if d := bucket.take(n); d > delay {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		throttled.Store(time.Now().Add(delay).UnixNano())
+		time.Sleep(delay)
+	}
+}
+
+// throttled reports whether a direction has recently been slowed down.
+func (c *connShaper) throttled(outbound bool) bool {
+	last := c.downloadThrottled.Load()
+	if outbound {
+		last = c.uploadThrottled.Load()
+	}
+	return last != 0 && time.Since(time.Unix(0, last)) < throttleDisplayWindow
+}
+
+// attachShaper sets the bandwidth shaper of a registered connection.
+func attachShaper(id string, shaper *connShaper) {
+	stats.mutex.Lock()
+	conn, exists := stats.ActiveConnections[id]
+	if exists {
+		conn.shaper = shaper
+		conn.UploadLimit = shaper.uploadLimit
+		conn.DownloadLimit = shaper.downloadLimit
+	}
+	stats.mutex.Unlock()
+	if !exists {
+		shaper.release()
+	}
+}
+
+// throttle paces a transfer of n bytes on a connection by its attached shaper.
+func throttle(id string, outbound bool, n int) {
+	if shaper := connectionShaper(id); shaper != nil {
+		shaper.wait(outbound, n)
+	}
+}
+
+// connectionShaper returns the shaper attached to a connection, if any.
+func connectionShaper(id string) *connShaper {
+	stats.mutex.RLock()
+	defer stats.mutex.RUnlock()
+	if conn, exists := stats.ActiveConnections[id]; exists {
+		return conn.shaper
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TestParseByteRate tests rate values with and without unit suffixes
+func TestParseByteRate(t *testing.T) {
+	tests := []struct {
+		text string
+		rate byteRate
+	}{
+		{"1024", 1024},
+		{"512K", 512 << 10},
+		{"10MB", 10 << 20},
+		{"1.5MiB", 3 << 19},
+		{"2g", 2 << 30},
+		{"100KB/s", 100 << 10},
+	}
+	for _, tt := range tests {
+		var limit BandwidthLimit
+		err := yaml.Unmarshal([]byte("upload: "+tt.text), &limit)
+		if err != nil || limit.Upload != tt.rate {
+			t.Errorf("Parsing rate %q = %d, %v; want %d", tt.text, limit.Upload, err, tt.rate)
+		}
+	}
+	for _, text := range []string{"''", "fast", "-1M", "1X", "1G/min"} {
+		var limit BandwidthLimit
+		if err := yaml.Unmarshal([]byte("upload: "+text), &limit); err == nil {
+			t.Errorf("Expected rate %s to be rejected", text)
+		}
+	}
+}
+
+// TestTokenBucket tests that a bucket allows a one-second burst and then paces at its rate
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(10000)
+	if delay := bucket.take(10000); delay != 0 {
+		t.Errorf("Expected the initial burst to be free, got %v", delay)
+	}
+	if delay := bucket.take(5000); delay < 400*time.Millisecond || delay > 500*time.Millisecond {
+		t.Errorf("Expected about 500ms delay, got %v", delay)
+	}
+	if newTokenBucket(0) != nil {
+		t.Error("Expected no bucket for an unlimited rate")
+	}
+}
+
+// TestShaperScopes tests that every applicable scope limits a connection and per-key buckets are released
+func TestShaperScopes(t *testing.T) {
+	config := &Config{
+		Bandwidth: BandwidthConfig{
+			Global:    BandwidthLimit{Download: 10 << 20},
+			PerClient: BandwidthLimit{Upload: 1 << 20},
+			PerUser:   BandwidthLimit{Download: 2 << 20},
+		},
+		Users: []UserConfig{{Username: "slow", Bandwidth: BandwidthLimit{Download: 64 << 10}}},
+		Destinations: DestinationConfig{Rules: []DestinationRule{
+			{Action: "allow", Hosts: []string{"*.example.com"}, Bandwidth: BandwidthLimit{Upload: 128 << 10}},
+		}},
+	}
+	cfg := &proxyConfig{bandwidth: newBandwidthShaper(config)}
+	cfg.destinations, _ = newDestinationRules(config.Destinations)
+
+	shaper := cfg.shaperFor("192.0.2.1", "alice", "www.example.com:443")
+	if len(shaper.upload) != 2 || len(shaper.download) != 2 || shaper.uploadLimit != 128<<10 || shaper.downloadLimit != 2<<20 {
+		t.Errorf("Unexpected shaper: %d upload and %d download buckets, limits %d/%d",
+			len(shaper.upload), len(shaper.download), shaper.uploadLimit, shaper.downloadLimit)
+	}
+	slow := cfg.shaperFor("192.0.2.1", "slow", "other.test:443")
+	if slow.downloadLimit != 64<<10 || slow.uploadLimit != 1<<20 {
+		t.Errorf("Expected the user's own limit to replace per_user, got %d/%d", slow.downloadLimit, slow.uploadLimit)
+	}
+	if cfg.bandwidth.clients.buckets["192.0.2.1"].refs != 2 {
+		t.Error("Expected both connections to share the client's bucket")
+	}
+
+	shaper.release()
+	slow.release()
+	if len(cfg.bandwidth.clients.buckets) != 0 || len(cfg.bandwidth.users.buckets) != 0 {
+		t.Error("Expected per-client and per-user buckets to be dropped after release")
+	}
+}
+
+// TestCopyWithTrackingThrottled tests that relayed data is paced by the attached shaper
+func TestCopyWithTrackingThrottled(t *testing.T) {
+	cfg := &proxyConfig{bandwidth: newBandwidthShaper(&Config{
+		Bandwidth: BandwidthConfig{Global: BandwidthLimit{Download: 64 << 10}},
+	})}
+	cfg.destinations, _ = newDestinationRules(DestinationConfig{})
+
+	addConnection("shaped", "", "192.0.2.1", "", "SOCKS5", "192.0.2.2:80")
+	defer removeConnection("shaped")
+	attachShaper("shaped", cfg.shaperFor("192.0.2.1", "", "192.0.2.2:80"))
+
+	// The first 64 KB are the burst; the next 32 KB take about half a second.
+	var dst bytes.Buffer
+	start := time.Now()
+	copyWithTracking(&dst, bytes.NewReader(make([]byte, 96<<10)), "shaped", false, defaultRelayBufferSize)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected about 500ms to copy 96 KB at 64 KB/s, took %v", elapsed)
+	}
+	if dst.Len() != 96<<10 {
+		t.Errorf("Expected all data to be copied, got %d bytes", dst.Len())
+	}
+
+	info := getStats().ActiveConnections["shaped"]
+	if info.DownloadLimit != 64<<10 || !info.DownloadThrottled || info.UploadThrottled {
+		t.Errorf("Unexpected throttle state: %+v", info)
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultConfigPath       = "config.yaml"
+	defaultDialTimeout      = 30 * time.Second
+	defaultHandshakeTimeout = 30 * time.Second
+	defaultRelayBufferSize  = 32 * 1024
+	defaultUDPBufferSize    = 64 * 1024
+	minBufferSize           = 1024
+	maxBufferSize           = 1024 * 1024
+)
+
+// Protocol names accepted in a listener's protocols list.
+const (
+	protocolHTTP   = "http"
+	protocolSOCKS4 = "socks4"
+	protocolSOCKS5 = "socks5"
+)
+
+var allProtocols = []string{protocolHTTP, protocolSOCKS4, protocolSOCKS5}
+
+// Config holds the structure of the YAML configuration file.
+type Config struct {
+	Listeners     []ListenerConfig     `yaml:"listeners"`
+	Monitoring    MonitoringConfig     `yaml:"monitoring"`
+	Timeouts      TimeoutConfig        `yaml:"timeouts"`
+	Buffers       BufferConfig         `yaml:"buffers"`
+	AllowedIPs    []string             `yaml:"allowed_ips"`
+	DeniedIPs     []string             `yaml:"denied_ips"`
+	RequireAuth   bool                 `yaml:"require_auth"`
+	Users         []UserConfig         `yaml:"users"`
+	HTTP          HTTPConfig           `yaml:"http"`
+	Destinations  DestinationConfig    `yaml:"destinations"`
+	SSRFGuard     SSRFGuardConfig      `yaml:"ssrf_guard"`
+	Reload        ReloadConfig         `yaml:"reload"`
+	Bandwidth     BandwidthConfig      `yaml:"bandwidth"`
+	Limits        LimitsConfig         `yaml:"limits"`
+	Quotas        QuotaConfig          `yaml:"quotas"`
+	Upstreams     []UpstreamConfig     `yaml:"upstreams"`
+	UpstreamPools []UpstreamPoolConfig `yaml:"upstream_pools"`
+	Routes        []RouteRule          `yaml:"routes"`
+	Egress        EgressConfig         `yaml:"egress"`
+	Connect       ConnectConfig        `yaml:"connect"`
+}
+
+// ListenerConfig describes one address the proxy accepts clients on. The
+// access settings are optional; any left unset are taken from the top level.
+type ListenerConfig struct {
+	// Name identifies the listener in logs and monitoring (default: the address).
+	Name string `yaml:"name"`
+	// Address is host:port; an empty host listens on every interface.
+	Address string `yaml:"address"`
+	// Protocols lists the protocols detected on this listener (default: all).
+	Protocols   []string `yaml:"protocols"`
+	AllowedIPs  []string `yaml:"allowed_ips,omitempty"`
+	DeniedIPs   []string `yaml:"denied_ips,omitempty"`
+	RequireAuth *bool    `yaml:"require_auth,omitempty"`
+	// Users restricts authentication to these configured users (default: all).
+	Users []string `yaml:"users,omitempty"`
+	// TLS makes the listener accept TLS-wrapped proxy connections.
+	TLS ListenerTLSConfig `yaml:"tls,omitempty"`
+}
+
+// MonitoringConfig configures the monitoring web interface.
+type MonitoringConfig struct {
+	Address string `yaml:"address"`
+}
+
+// TimeoutConfig bounds how long the proxy waits on clients and destinations.
+type TimeoutConfig struct {
+	// Dial bounds name resolution and connecting to a destination.
+	Dial time.Duration `yaml:"dial"`
+	// Connect bounds each connection attempt to one of a destination's addresses.
+	Connect time.Duration `yaml:"connect"`
+	// Handshake bounds how long a client may take to send its proxy request.
+	Handshake time.Duration `yaml:"handshake"`
+	// Idle closes tunnels with no traffic in either direction for this long (0 disables).
+	Idle time.Duration `yaml:"idle"`
+	// Lifetime closes tunnels open for this long, however active (0 disables).
+	Lifetime time.Duration `yaml:"lifetime"`
+}
+
+// BufferConfig sets the sizes of the relay buffers in bytes.
+type BufferConfig struct {
+	Relay int `yaml:"relay"`
+	UDP   int `yaml:"udp"`
+}
+
+// proxyConfig is the runtime form of Config shared by all connection handlers.
+// It is never modified once loaded; a reload swaps in a new one.
+type proxyConfig struct {
+	version   int64
+	listeners []ListenerConfig
+	// listener is the name of the listener a connection arrived on; it is set
+	// on the per-connection copy returned by forListener.
+	listener string
+	// listenerAccess holds the access policy of each listener, by name.
+	listenerAccess map[string]*accessPolicy
+	monitoring     MonitoringConfig
+	timeouts       TimeoutConfig
+	buffers        BufferConfig
+	access         *accessPolicy
+	headers        headerRewriter
+	destinations   *destinationRules
+	guard          *ssrfGuard
+	reload         ReloadConfig
+	bandwidth      *bandwidthShaper
+	limits         LimitsConfig
+	quotas         *quotaPolicy
+	// routes holds the chain of upstreams to reach each upstream, by name.
+	routes  map[string]upstreamRoute
+	pools   map[string]*proxyPool
+	routing *routingTable
+	// egress is the default source selection; userEgress replaces it per user.
+	egress     *egressPolicy
+	userEgress map[string]*egressPolicy
+	connect    ConnectConfig
+}
+
+// configOverride lets an environment variable and a command line flag replace
+// a setting from the config file. Precedence, lowest first: built-in
+// defaults, config file, environment variable, command line flag.
+type configOverride struct {
+	flag  string
+	short string
+	env   string
+	usage string
+	apply func(config *Config, value string) error
+}
+
+var configOverrides = []configOverride{
+	{flag: "listen", env: "PROXY_LISTEN", usage: "Comma-separated proxy listen addresses, replacing the configured listeners",
+		apply: func(config *Config, value string) error {
+			config.Listeners = nil
+			for _, address := range strings.Split(value, ",") {
+				config.Listeners = append(config.Listeners, ListenerConfig{Address: strings.TrimSpace(address)})
+			}
+			return nil
+		}},
+	{flag: "monitor-port", short: "m", env: "PROXY_MONITOR_PORT", usage: "Port for the monitoring web interface",
+		apply: func(config *Config, value string) error {
+			config.Monitoring.Address = ":" + value
+			return nil
+		}},
+	{flag: "monitor-addr", env: "PROXY_MONITOR_ADDR", usage: "Listen address for the monitoring web interface",
+		apply: func(config *Config, value string) error {
+			config.Monitoring.Address = value
+			return nil
+		}},
+	{flag: "dial-timeout", env: "PROXY_DIAL_TIMEOUT", usage: "Timeout for connecting to destinations",
+		apply: durationOverride(func(config *Config) *time.Duration { return &config.Timeouts.Dial })},
+	{flag: "connect-timeout", env: "PROXY_CONNECT_TIMEOUT", usage: "Timeout for each connection attempt to a destination address",
+		apply: durationOverride(func(config *Config) *time.Duration { return &config.Timeouts.Connect })},
+	{flag: "handshake-timeout", env: "PROXY_HANDSHAKE_TIMEOUT", usage: "Timeout for clients to send their proxy request",
+		apply: durationOverride(func(config *Config) *time.Duration { return &config.Timeouts.Handshake })},
+	{flag: "idle-timeout", env: "PROXY_IDLE_TIMEOUT", usage: "Close tunnels idle for this long (0 disables)",
+		apply: durationOverride(func(config *Config) *time.Duration { return &config.Timeouts.Idle })},
+	{flag: "max-lifetime", env: "PROXY_MAX_LIFETIME", usage: "Close tunnels open for this long (0 disables)",
+		apply: durationOverride(func(config *Config) *time.Duration { return &config.Timeouts.Lifetime })},
+}
+
+// overrideFlags holds the command line values of configOverrides, by flag name.
+var overrideFlags = make(map[string]*string)
+
+// durationOverride returns an apply function that parses a duration into the selected field.
+func durationOverride(field func(config *Config) *time.Duration) func(*Config, string) error {
+	return func(config *Config, value string) error {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(config) = duration
+		return nil
+	}
+}
+
+// registerOverrideFlags defines a command line flag for every config override.
+func registerOverrideFlags() {
+	for _, override := range configOverrides {
+		value := flag.String(override.flag, "", fmt.Sprintf("%s (env %s)", override.usage, override.env))
+		if override.short != "" {
+			flag.StringVar(value, override.short, "", override.usage+" (shorthand)")
+		}
+		overrideFlags[override.flag] = value
+	}
+}
+
+// applyOverrides applies environment variables, then command line flags, on top of the file.
+func (c *Config) applyOverrides() error {
+	for _, override := range configOverrides {
+		if value := os.Getenv(override.env); value != "" {
+			if err := override.apply(c, value); err != nil {
+				return fmt.Errorf("%s: %v", override.env, err)
+			}
+		}
+	}
+	for _, override := range configOverrides {
+		if value := overrideFlags[override.flag]; value != nil && *value != "" {
+			if err := override.apply(c, *value); err != nil {
+				return fmt.Errorf("-%s: %v", override.flag, err)
+			}
+		}
+	}
+	return nil
+}
+
+// applyDefaults fills in every setting left empty.
+func (c *Config) applyDefaults() {
+	if len(c.Listeners) == 0 {
+		c.Listeners = []ListenerConfig{{Address: ":" + proxyPort}}
+	}
+	for i := range c.Listeners {
+		if c.Listeners[i].Name == "" {
+			c.Listeners[i].Name = c.Listeners[i].Address
+		}
+		if len(c.Listeners[i].Protocols) == 0 {
+			c.Listeners[i].Protocols = allProtocols
+		}
+	}
+	if c.Monitoring.Address == "" {
+		c.Monitoring.Address = ":" + monitorPort
+	}
+	if c.Timeouts.Dial == 0 {
+		c.Timeouts.Dial = defaultDialTimeout
+	}
+	if c.Timeouts.Connect == 0 {
+		c.Timeouts.Connect = defaultConnectTimeout
+	}
+	if c.Timeouts.Handshake == 0 {
+		c.Timeouts.Handshake = defaultHandshakeTimeout
+	}
+	if c.Buffers.Relay == 0 {
+		c.Buffers.Relay = defaultRelayBufferSize
+	}
+	if c.Buffers.UDP == 0 {
+		c.Buffers.UDP = defaultUDPBufferSize
+	}
+}
+
+// validate checks the listener, monitoring, timeout and buffer settings.
+func (c *Config) validate() error {
+	addresses := map[string]bool{c.Monitoring.Address: true}
+	names := make(map[string]bool)
+	if _, _, err := net.SplitHostPort(c.Monitoring.Address); err != nil {
+		return fmt.Errorf("monitoring address '%s': %v", c.Monitoring.Address, err)
+	}
+	for i, listener := range c.Listeners {
+		if _, _, err := net.SplitHostPort(listener.Address); err != nil {
+			return fmt.Errorf("listener %d address '%s': %v", i+1, listener.Address, err)
+		}
+		if addresses[listener.Address] {
+			return fmt.Errorf("listener %d: address '%s' is already in use by another listener or monitoring", i+1, listener.Address)
+		}
+		addresses[listener.Address] = true
+		if names[listener.Name] {
+			return fmt.Errorf("listener %d: duplicate name '%s'", i+1, listener.Name)
+		}
+		names[listener.Name] = true
+		if err := listener.TLS.validate(); err != nil {
+			return fmt.Errorf("listener %d: %v", i+1, err)
+		}
+		for _, protocol := range listener.Protocols {
+			if !isKnownProtocol(protocol) {
+				return fmt.Errorf("listener %d: unknown protocol '%s', expected one of %s", i+1, protocol, strings.Join(allProtocols, ", "))
+			}
+		}
+	}
+	if c.Timeouts.Dial < 0 || c.Timeouts.Connect < 0 || c.Timeouts.Handshake < 0 || c.Timeouts.Idle < 0 || c.Timeouts.Lifetime < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	if err := c.Connect.validate(); err != nil {
+		return err
+	}
+	if err := c.Limits.validate(); err != nil {
+		return err
+	}
+	for name, size := range map[string]int{"relay": c.Buffers.Relay, "udp": c.Buffers.UDP} {
+		if size < minBufferSize || size > maxBufferSize {
+			return fmt.Errorf("buffers %s: %d is outside %d-%d bytes", name, size, minBufferSize, maxBufferSize)
+		}
+	}
+	return nil
+}
+
+// isKnownProtocol reports whether protocol can be enabled on a listener.
+func isKnownProtocol(protocol string) bool {
+	for _, known := range allProtocols {
+		if protocol == known {
+			return true
+		}
+	}
+	return false
+}
+
+// parseConfig reads the config file and returns the effective settings after
+// overrides and defaults have been applied.
+func parseConfig(path string) (*Config, error) {
+	configFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file '%s': %v", path, err)
+	}
+
+	var config Config
+	err = yaml.UnmarshalStrict(configFile, &config)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse config file: %v", err)
+	}
+	if err := config.applyOverrides(); err != nil {
+		return nil, fmt.Errorf("invalid override: %v", err)
+	}
+	config.applyDefaults()
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+	return &config, nil
+}
+
+// newProxyConfig builds the runtime configuration from parsed settings.
+func newProxyConfig(config *Config) (*proxyConfig, error) {
+	policy, err := newAccessPolicy(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+	headers, err := newHeaderRewriter(config.HTTP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+	destinations, err := newDestinationRules(config.Destinations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+	routes, err := newUpstreamRoutes(config.Upstreams)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+	pools, err := newUpstreamPools(config.UpstreamPools, routes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+	known := func(name string) bool {
+		_, isUpstream := routes[name]
+		_, isPool := pools[name]
+		return isUpstream || isPool
+	}
+	if err := destinations.checkUpstreams(known); err != nil {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+	routing, err := newRoutingTable(config.Routes, known)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+	egress, err := newEgressPolicy(config.Egress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: egress: %v", err)
+	}
+	userEgress := make(map[string]*egressPolicy)
+	for _, user := range config.Users {
+		if userEgress[user.Username], err = newEgressPolicy(user.Egress); err != nil {
+			return nil, fmt.Errorf("invalid config file: user '%s' egress: %v", user.Username, err)
+		}
+	}
+	guard, err := newSSRFGuard(config.SSRFGuard)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+	quotas, err := newQuotaPolicy(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+	listenerAccess := make(map[string]*accessPolicy)
+	for _, listener := range config.Listeners {
+		listenerPolicy, err := newListenerAccessPolicy(config, listener)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config file: listener '%s': %v", listener.Name, err)
+		}
+		listenerAccess[listener.Name] = listenerPolicy
+	}
+	return &proxyConfig{
+		listeners:      config.Listeners,
+		listenerAccess: listenerAccess,
+		monitoring:     config.Monitoring,
+		timeouts:       config.Timeouts,
+		buffers:        config.Buffers,
+		access:         policy,
+		headers:        headers,
+		destinations:   destinations,
+		routes:         routes,
+		pools:          pools,
+		routing:        routing,
+		egress:         egress,
+		userEgress:     userEgress,
+		connect:        config.Connect,
+		guard:          guard,
+		reload:         config.Reload,
+		bandwidth:      newBandwidthShaper(config),
+		limits:         config.Limits,
+		quotas:         quotas,
+	}, nil
+}
+
+// forListener returns a copy of cfg for a connection accepted on the named
+// listener, with that listener's access policy in place of the global one.
+func (cfg *proxyConfig) forListener(name string) *proxyConfig {
+	scoped := *cfg
+	scoped.listener = name
+	if policy, exists := cfg.listenerAccess[name]; exists {
+		scoped.access = policy
+	}
+	return &scoped
+}
+
+// sameListeners reports whether other declares the same listeners as cfg, apart
+// from their access settings. Listening sockets are only opened at startup.
+func (cfg *proxyConfig) sameListeners(other *proxyConfig) bool {
+	if len(cfg.listeners) != len(other.listeners) {
+		return false
+	}
+	for i, listener := range cfg.listeners {
+		changed := other.listeners[i]
+		if listener.Name != changed.Name || listener.Address != changed.Address || listener.TLS != changed.TLS ||
+			strings.Join(listener.Protocols, ",") != strings.Join(changed.Protocols, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// loadConfig reads the YAML config file and builds the runtime configuration from it.
+func loadConfig(path string) (*proxyConfig, error) {
+	config, err := parseConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := newProxyConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d allowed and %d denied address entries, %d users and %d destination rules from config",
+		len(config.AllowedIPs), len(config.DeniedIPs), len(cfg.access.users.users), len(cfg.destinations.rules))
+	return cfg, nil
+}
+
+// checkConfig validates the config file and prints the effective settings.
+// Password hashes are redacted from the output.
+func checkConfig(path string) error {
+	config, err := parseConfig(path)
+	if err != nil {
+		return err
+	}
+	if _, err := newProxyConfig(config); err != nil {
+		return err
+	}
+
+	// Copy the users so that every setting is printed, with only the secrets redacted.
+	users := make([]UserConfig, len(config.Users))
+	for i, user := range config.Users {
+		users[i] = user
+		users[i].PasswordHash = "<redacted>"
+		if user.DigestHA1 != "" {
+			users[i].DigestHA1 = "<redacted>"
+		}
+		if user.DigestHA1SHA256 != "" {
+			users[i].DigestHA1SHA256 = "<redacted>"
+		}
+	}
+	config.Users = users
+	for i, upstream := range config.Upstreams {
+		if u, err := url.Parse(upstream.URL); err == nil {
+			config.Upstreams[i].URL = u.Redacted()
+		}
+	}
+
+	effective, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# Configuration '%s' is valid. Effective settings:\n%s", path, effective)
+	return nil
+}
+
+// handshakeDeadline returns when a client must have sent its request, or the
+// zero time if the handshake is not bounded.
+func (t TimeoutConfig) handshakeDeadline() time.Time {
+	if t.Handshake <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(t.Handshake)
+}
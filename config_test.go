@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestConfig writes content to a config file in a temporary directory
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+// TestParseConfigDefaults tests that an empty file gets the built-in defaults
+func TestParseConfigDefaults(t *testing.T) {
+	config, err := parseConfig(writeTestConfig(t, "allowed_ips: []\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if len(config.Listeners) != 1 || config.Listeners[0].Address != ":8080" || len(config.Listeners[0].Protocols) != 3 {
+		t.Errorf("Unexpected default listeners: %+v", config.Listeners)
+	}
+	if config.Monitoring.Address != ":8082" {
+		t.Errorf("Unexpected monitoring address: %q", config.Monitoring.Address)
+	}
+	if config.Timeouts.Dial != defaultDialTimeout || config.Timeouts.Connect != defaultConnectTimeout ||
+		config.Timeouts.Handshake != defaultHandshakeTimeout || config.Timeouts.Idle != 0 {
+		t.Errorf("Unexpected default timeouts: %+v", config.Timeouts)
+	}
+	if config.Buffers.Relay != defaultRelayBufferSize || config.Buffers.UDP != defaultUDPBufferSize {
+		t.Errorf("Unexpected default buffers: %+v", config.Buffers)
+	}
+}
+
+// TestParseConfigPrecedence tests that environment variables override the file and flags override both
+func TestParseConfigPrecedence(t *testing.T) {
+	path := writeTestConfig(t, `
+listeners:
+  - address: "127.0.0.1:1080"
+    protocols: [socks5]
+monitoring:
+  address: "127.0.0.1:9000"
+timeouts:
+  dial: 5s
+  idle: 1m
+`)
+	t.Setenv("PROXY_DIAL_TIMEOUT", "7s")
+	t.Setenv("PROXY_MONITOR_ADDR", "127.0.0.1:9001")
+	monitorFlag := "127.0.0.1:9002"
+	overrideFlags["monitor-addr"] = &monitorFlag
+	defer delete(overrideFlags, "monitor-addr")
+
+	config, err := parseConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if config.Listeners[0].Address != "127.0.0.1:1080" || strings.Join(config.Listeners[0].Protocols, ",") != "socks5" {
+		t.Errorf("Unexpected listeners: %+v", config.Listeners)
+	}
+	if config.Timeouts.Dial != 7*time.Second || config.Timeouts.Idle != time.Minute {
+		t.Errorf("Expected env to override dial timeout only, got %+v", config.Timeouts)
+	}
+	if config.Monitoring.Address != "127.0.0.1:9002" {
+		t.Errorf("Expected flag to win over env, got %q", config.Monitoring.Address)
+	}
+
+	t.Setenv("PROXY_LISTEN", "[::1]:3128, 127.0.0.1:3128")
+	config, err = parseConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if len(config.Listeners) != 2 || config.Listeners[0].Address != "[::1]:3128" || len(config.Listeners[1].Protocols) != 3 {
+		t.Errorf("Expected PROXY_LISTEN to replace the listeners, got %+v", config.Listeners)
+	}
+}
+
+// TestParseConfigValidation tests that invalid settings are rejected
+func TestParseConfigValidation(t *testing.T) {
+	for _, content := range []string{
+		"listeners: [{address: \"8080\"}]\n",
+		"listeners: [{address: \":8080\", protocols: [ftp]}]\n",
+		"listeners: [{address: \":8080\"}, {address: \":8080\"}]\n",
+		"monitoring: {address: \":8080\"}\n",
+		"timeouts: {dial: -1s}\n",
+		"connect: {family: ipv6}\n",
+		"buffers: {relay: 10}\n",
+		"alowed_ips: []\n",
+	} {
+		if _, err := parseConfig(writeTestConfig(t, content)); err == nil {
+			t.Errorf("Expected %q to be rejected", content)
+		}
+	}
+}
+
+// TestListenerAccessPolicies tests that listeners inherit unset access settings and override the rest
+func TestListenerAccessPolicies(t *testing.T) {
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	config, err := parseConfig(writeTestConfig(t, `
+listeners:
+  - name: socks-lan
+    address: "127.0.0.1:1080"
+    protocols: [socks5]
+    allowed_ips: ["10.0.0.0/8"]
+  - name: http-strict
+    address: "127.0.0.1:3128"
+    protocols: [http]
+    require_auth: true
+    users: [alice]
+  - address: "127.0.0.1:8080"
+allowed_ips: ["192.0.2.0/24"]
+users:
+  - username: alice
+    password_hash: "`+hash+`"
+  - username: bob
+    password_hash: "`+hash+`"
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	cfg, err := newProxyConfig(config)
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+
+	lan := cfg.forListener("socks-lan")
+	if lan.listener != "socks-lan" || !lan.access.allowsAnonymous("10.1.2.3") || lan.access.allowsAnonymous("192.0.2.1") {
+		t.Error("Expected socks-lan to use its own allow-list")
+	}
+	strict := cfg.forListener("http-strict").access
+	if strict.allowsAnonymous("192.0.2.1") || !strict.users.authenticate("alice", "secret") || strict.users.authenticate("bob", "secret") {
+		t.Error("Expected http-strict to require auth and accept only alice")
+	}
+	mixed := cfg.forListener("127.0.0.1:8080").access
+	if !mixed.allowsAnonymous("192.0.2.1") || !mixed.users.authenticate("bob", "secret") {
+		t.Error("Expected an unnamed listener to inherit the top-level policy")
+	}
+
+	config.Listeners[1].Users = []string{"carol"}
+	if _, err := newProxyConfig(config); err == nil {
+		t.Error("Expected an unknown listener user to be rejected")
+	}
+	if _, err := parseConfig(writeTestConfig(t, "listeners: [{name: a, address: \":1080\"}, {name: a, address: \":3128\"}]\n")); err == nil {
+		t.Error("Expected duplicate listener names to be rejected")
+	}
+}
+
+// TestCheckConfigRedaction tests that the effective config keeps every user setting but the secrets
+func TestCheckConfigRedaction(t *testing.T) {
+	path := writeTestConfig(t, `
+users:
+  - username: alice
+    password_hash: "pbkdf2-sha256$100000$BHJuKfaSaqrZ99SHjnQw9A$QeLBwEqo8p0l2c1yabXgskYT2JO+EuTgk8owkCZYXiA"
+    egress: {addresses: ["127.0.0.1"]}
+`)
+	stdout := os.Stdout
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	os.Stdout = writer
+	err = checkConfig(path)
+	os.Stdout = stdout
+	writer.Close()
+	if err != nil {
+		t.Fatalf("Expected the config to be valid: %v", err)
+	}
+	output, _ := io.ReadAll(reader)
+	if strings.Contains(string(output), "pbkdf2-sha256") || !strings.Contains(string(output), "password_hash: <redacted>") {
+		t.Errorf("Expected the password hash to be redacted:\n%s", output)
+	}
+	if !strings.Contains(string(output), "127.0.0.1") {
+		t.Errorf("Expected the user's egress in the effective config:\n%s", output)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// DestinationConfig describes which destinations clients may connect to.
+type DestinationConfig struct {
+	// Default is the action taken when no rule matches: "allow" (default) or "deny".
+	Default string            `yaml:"default"`
+	Rules   []DestinationRule `yaml:"rules"`
+	// Upstream names the upstream allowed destinations are dialed through
+	// unless their rule names one (default: direct).
+	Upstream string `yaml:"upstream,omitempty"`
+}
+
+// DestinationRule matches destinations by host and port. Rules are evaluated
+// in order and the first match decides.
+type DestinationRule struct {
+	Action string `yaml:"action"`
+	// Hosts may contain exact names, wildcard domains (*.example.com), IP
+	// addresses and CIDR ranges. An empty list matches any host.
+	Hosts []string `yaml:"hosts"`
+	// Ports may contain single ports and ranges (8000-8100). An empty list matches any port.
+	Ports []string `yaml:"ports"`
+	// Bandwidth limits the combined rate of all connections matching an allow rule.
+	Bandwidth BandwidthLimit `yaml:"bandwidth,omitempty"`
+	// Upstream names the upstream connections matching an allow rule are
+	// dialed through, or "direct" to bypass the default upstream.
+	Upstream string `yaml:"upstream,omitempty"`
+}
+
+type portRange struct {
+	low, high uint16
+}
+
+// destinationRule is the compiled form of DestinationRule.
+type destinationRule struct {
+	allow     bool
+	anyHost   bool
+	names     map[string]bool
+	wildcards []string // domain suffixes including the leading dot
+	networks  *prefixSet
+	ports     []portRange
+	upstream  string
+}
+
+// destinationRules is the compiled destination access-control list.
+type destinationRules struct {
+	rules        []destinationRule
+	defaultAllow bool
+	upstream     string
+}
+
+// parseRuleAction converts an allow/deny keyword to a boolean.
+func parseRuleAction(action string) (bool, error) {
+	switch strings.ToLower(action) {
+	case "allow":
+		return true, nil
+	case "deny":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid action '%s', expected allow or deny", action)
+	}
+}
+
+// parsePortRange parses "80" or "8000-8100".
+func parsePortRange(entry string) (portRange, error) {
+	lowStr, highStr, isRange := strings.Cut(strings.TrimSpace(entry), "-")
+	if !isRange {
+		highStr = lowStr
+	}
+	low, errLow := strconv.ParseUint(strings.TrimSpace(lowStr), 10, 16)
+	high, errHigh := strconv.ParseUint(strings.TrimSpace(highStr), 10, 16)
+	if errLow != nil || errHigh != nil || low == 0 || low > high {
+		return portRange{}, fmt.Errorf("invalid port or port range '%s'", entry)
+	}
+	return portRange{low: uint16(low), high: uint16(high)}, nil
+}
+
+// normalizeDomain lowercases a host name and strips any trailing dot.
+func normalizeDomain(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// newDestinationRules compiles the destinations section of the config.
+func newDestinationRules(config DestinationConfig) (*destinationRules, error) {
+	compiled := &destinationRules{defaultAllow: true, upstream: config.Upstream}
+	if config.Default != "" {
+		allow, err := parseRuleAction(config.Default)
+		if err != nil {
+			return nil, fmt.Errorf("destinations default: %v", err)
+		}
+		compiled.defaultAllow = allow
+	}
+
+	for i, rule := range config.Rules {
+		allow, err := parseRuleAction(rule.Action)
+		if err != nil {
+			return nil, fmt.Errorf("destination rule %d: %v", i+1, err)
+		}
+		if !allow && rule.Upstream != "" {
+			return nil, fmt.Errorf("destination rule %d: only allow rules can name an upstream", i+1)
+		}
+		entry, err := newDestinationMatch(rule.Hosts, rule.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("destination rule %d: %v", i+1, err)
+		}
+		entry.allow = allow
+		entry.upstream = rule.Upstream
+		compiled.rules = append(compiled.rules, entry)
+	}
+	return compiled, nil
+}
+
+// newDestinationMatch compiles the host and port patterns of a rule.
+func newDestinationMatch(hosts, ports []string) (destinationRule, error) {
+	entry := destinationRule{
+		anyHost:  len(hosts) == 0,
+		names:    make(map[string]bool),
+		networks: &prefixSet{},
+	}
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		switch {
+		case host == "*":
+			entry.anyHost = true
+		case strings.HasPrefix(host, "*."):
+			entry.wildcards = append(entry.wildcards, normalizeDomain(host[1:]))
+		case strings.Contains(host, "/") || net.ParseIP(host) != nil:
+			prefix, err := parseAddressPrefix(host)
+			if err != nil {
+				return entry, err
+			}
+			entry.networks.insert(prefix)
+		case host == "" || strings.Contains(host, "*"):
+			return entry, fmt.Errorf("invalid host pattern '%s'", host)
+		default:
+			entry.names[normalizeDomain(host)] = true
+		}
+	}
+	for _, port := range ports {
+		span, err := parsePortRange(port)
+		if err != nil {
+			return entry, err
+		}
+		entry.ports = append(entry.ports, span)
+	}
+	return entry, nil
+}
+
+// checkUpstreams verifies that every upstream the rules name is defined.
+// known reports whether an upstream or upstream pool is defined.
+func (d *destinationRules) checkUpstreams(known func(string) bool) error {
+	if d.upstream != "" && d.upstream != routeDirect && !known(d.upstream) {
+		return fmt.Errorf("destinations upstream: unknown upstream '%s'", d.upstream)
+	}
+	for i, rule := range d.rules {
+		if rule.upstream != "" && rule.upstream != routeDirect && !known(rule.upstream) {
+			return fmt.Errorf("destination rule %d: unknown upstream '%s'", i+1, rule.upstream)
+		}
+	}
+	return nil
+}
+
+// matchesHost reports whether host (a domain name or IP literal) matches the rule.
+func (r *destinationRule) matchesHost(host string) bool {
+	if r.anyHost {
+		return true
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return r.networks.contains(addr)
+	}
+	host = normalizeDomain(host)
+	if r.names[host] {
+		return true
+	}
+	for _, suffix := range r.wildcards {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPort reports whether port falls within one of the rule's ranges.
+func (r *destinationRule) matchesPort(port uint16) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, ports := range r.ports {
+		if port >= ports.low && port <= ports.high {
+			return true
+		}
+	}
+	return false
+}
+
+// splitDestination splits a "host:port" address; ok is false if it cannot be parsed.
+func splitDestination(address string) (host string, port uint16, ok bool) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, false
+	}
+	number, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, false
+	}
+	return host, uint16(number), true
+}
+
+// matches reports whether the rule's hosts and ports match host and port.
+func (r *destinationRule) matches(host string, port uint16) bool {
+	return r.matchesHost(host) && r.matchesPort(port)
+}
+
+// match returns the index of the first rule matching address ("host:port"),
+// or -1 if none does. valid is false if the address cannot be parsed.
+func (d *destinationRules) match(address string) (index int, valid bool) {
+	host, port, ok := splitDestination(address)
+	if !ok {
+		return -1, false
+	}
+	for i := range d.rules {
+		if d.rules[i].matches(host, port) {
+			return i, true
+		}
+	}
+	return -1, true
+}
+
+// permitsResolved reports whether address ("host:port"), allowed by the rules,
+// may be dialed at addr, one of the addresses its host resolves to. The
+// address is refused if a deny rule whose CIDR ranges contain addr comes
+// before the rule that allowed it, so that names resolving into a denied
+// range are treated like the IP literal would be.
+func (d *destinationRules) permitsResolved(address string, addr netip.AddrPort) bool {
+	if d == nil {
+		return true
+	}
+	index, valid := d.match(address)
+	if !valid {
+		return false
+	}
+	if index < 0 {
+		index = len(d.rules)
+	}
+	ip := addr.Addr().Unmap()
+	for _, rule := range d.rules[:index] {
+		if !rule.allow && rule.networks.contains(ip) && rule.matchesPort(addr.Port()) {
+			return false
+		}
+	}
+	return true
+}
+
+// allows reports whether clients may connect to address ("host:port").
+// Addresses that cannot be parsed are refused.
+func (d *destinationRules) allows(address string) bool {
+	index, valid := d.match(address)
+	if !valid {
+		return false
+	}
+	if index < 0 {
+		return d.defaultAllow
+	}
+	return d.rules[index].allow
+}
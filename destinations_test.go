@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TestDestinationRules tests rule ordering, host patterns and port ranges
+func TestDestinationRules(t *testing.T) {
+	var config DestinationConfig
+	err := yaml.Unmarshal([]byte(`
+default: deny
+rules:
+  - action: deny
+    hosts: ["admin.example.com", "10.66.0.0/16"]
+  - action: allow
+    hosts: ["*.example.com", "example.com", "10.0.0.0/8", "2001:db8::1"]
+    ports: [80, 443, "8000-8100"]
+  - action: allow
+    hosts: ["*"]
+    ports: [53]
+`), &config)
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	rules, err := newDestinationRules(config)
+	if err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"www.example.com:443", true},
+		{"a.b.EXAMPLE.com.:80", true},
+		{"example.com:8050", true},
+		{"example.com:22", false},
+		{"admin.example.com:443", false},
+		{"notexample.com:80", false},
+		{"10.1.2.3:80", true},
+		{"10.66.1.1:80", false},
+		{"[2001:db8::1]:443", true},
+		{"[2001:db8::2]:443", false},
+		{"anything.test:53", true},
+		{"anything.test:80", false},
+		{"no-port", false},
+	}
+	for _, tt := range tests {
+		if got := rules.allows(tt.address); got != tt.allowed {
+			t.Errorf("allows(%s) = %v, want %v", tt.address, got, tt.allowed)
+		}
+	}
+}
+
+// TestDestinationRulesValidation tests that malformed rules are rejected
+func TestDestinationRulesValidation(t *testing.T) {
+	empty, err := newDestinationRules(DestinationConfig{})
+	if err != nil || !empty.allows("example.com:25") {
+		t.Error("Expected an empty rule set to allow everything")
+	}
+
+	for _, config := range []DestinationConfig{
+		{Default: "maybe"},
+		{Rules: []DestinationRule{{Action: "block"}}},
+		{Rules: []DestinationRule{{Action: "deny", Hosts: []string{"foo.*.com"}}}},
+		{Rules: []DestinationRule{{Action: "deny", Hosts: []string{"10.0.0.0/40"}}}},
+		{Rules: []DestinationRule{{Action: "deny", Ports: []string{"100-10"}}}},
+		{Rules: []DestinationRule{{Action: "deny", Ports: []string{"70000"}}}},
+	} {
+		if _, err := newDestinationRules(config); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+}
+
+// TestDestinationRulesResolved tests that CIDR rules apply to the addresses names resolve to
+func TestDestinationRulesResolved(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	address := net.JoinHostPort("localhost", port)
+
+	denied, err := newProxyConfig(&Config{
+		SSRFGuard:    SSRFGuardConfig{Disabled: true},
+		Destinations: DestinationConfig{Rules: []DestinationRule{{Action: "deny", Hosts: []string{"127.0.0.0/8", "::1"}}}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	if !denied.destinations.allows(address) {
+		t.Fatalf("Expected %s to be allowed by name", address)
+	}
+	if _, err := denied.dialDirect(context.Background(), "192.0.2.1", address, nil); !errors.Is(err, errDestinationBlocked) {
+		t.Errorf("Expected a name resolving into a denied range to be blocked, got %v", err)
+	}
+
+	// A rule allowing the name before the deny rule takes precedence.
+	allowed, err := newProxyConfig(&Config{
+		SSRFGuard: SSRFGuardConfig{Disabled: true},
+		Destinations: DestinationConfig{Rules: []DestinationRule{
+			{Action: "allow", Hosts: []string{"localhost"}},
+			{Action: "deny", Hosts: []string{"127.0.0.0/8", "::1"}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	conn, err := allowed.dialDirect(context.Background(), "192.0.2.1", address, nil)
+	if err != nil {
+		t.Fatalf("Expected the name allowed before the deny rule to connect: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Address family preferences.
+const (
+	familyPreferV4 = "prefer-v4"
+	familyPreferV6 = "prefer-v6"
+	familyV4Only   = "v4-only"
+	familyV6Only   = "v6-only"
+)
+
+const (
+	defaultConnectTimeout = 10 * time.Second
+	// defaultAttemptDelay is the Connection Attempt Delay recommended by RFC 8305.
+	defaultAttemptDelay = 250 * time.Millisecond
+	// dialLatencySamples is how many recent dials the latency percentiles cover.
+	dialLatencySamples = 1000
+)
+
+// ConnectConfig controls how direct connections pick among a destination's
+// resolved addresses.
+type ConnectConfig struct {
+	// Family is prefer-v6 (default), prefer-v4, v4-only or v6-only.
+	Family string `yaml:"family,omitempty"`
+	// AttemptDelay is how long an attempt may run before the next address is
+	// tried in parallel (Happy Eyeballs, RFC 8305; default 250ms).
+	AttemptDelay time.Duration `yaml:"attempt_delay,omitempty"`
+	// Sequential tries the addresses one after another instead of racing them.
+	Sequential bool `yaml:"sequential,omitempty"`
+}
+
+// validate checks the family and attempt delay.
+func (c ConnectConfig) validate() error {
+	switch c.Family {
+	case "", familyPreferV4, familyPreferV6, familyV4Only, familyV6Only:
+	default:
+		return fmt.Errorf("connect family '%s': expected %s, %s, %s or %s", c.Family, familyPreferV6, familyPreferV4, familyV4Only, familyV6Only)
+	}
+	if c.AttemptDelay < 0 {
+		return fmt.Errorf("connect attempt_delay must not be negative")
+	}
+	return nil
+}
+
+// sortAddresses orders addrs for connection attempts: addresses of the other
+// family are dropped for the *-only preferences, and otherwise the families
+// alternate starting with the preferred one, keeping the resolver's order
+// within each family (RFC 8305 section 4).
+func sortAddresses(addrs []netip.AddrPort, family string) ([]netip.AddrPort, error) {
+	var v4, v6 []netip.AddrPort
+	for _, addr := range addrs {
+		if addr.Addr().Unmap().Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	first, second := v6, v4
+	switch family {
+	case familyPreferV4:
+		first, second = v4, v6
+	case familyV4Only:
+		first, second = v4, nil
+	case familyV6Only:
+		first, second = v6, nil
+	}
+	if len(first)+len(second) == 0 {
+		return nil, fmt.Errorf("no address of the allowed family (%s)", family)
+	}
+	sorted := make([]netip.AddrPort, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted, nil
+}
+
+// dialDirect connects to address without an upstream. The permitted resolved
+// addresses are tried in family preference order, each bounded by the
+// connect timeout. Unless connections are sequential, a new attempt starts
+// whenever the previous one fails or has run for the attempt delay, and the
+// first to connect wins.
+func (cfg *proxyConfig) dialDirect(ctx context.Context, clientIP, address string, egress *egressPolicy) (net.Conn, error) {
+	resolved, err := cfg.resolveDestination(ctx, "tcp", clientIP, address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := sortAddresses(resolved, cfg.connect.Family)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", address, err)
+	}
+	attempt := func(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+		if cfg.timeouts.Connect > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, cfg.timeouts.Connect)
+			defer cancel()
+		}
+		return egress.dial(ctx, addr.String())
+	}
+
+	if cfg.connect.Sequential || len(addrs) == 1 {
+		for _, addr := range addrs {
+			var conn net.Conn
+			if conn, err = attempt(ctx, addr); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+
+	delay := cfg.connect.AttemptDelay
+	if delay == 0 {
+		delay = defaultAttemptDelay
+	}
+	return raceAttempts(ctx, addrs, delay, attempt)
+}
+
+// raceAttempts starts attempt for each address in turn, moving on to the
+// next one when an attempt fails or after delay, and returns the first
+// connection made. Attempts still running are canceled and any connection
+// they make afterwards is closed. If every attempt fails, the last error is
+// returned.
+func raceAttempts(ctx context.Context, addrs []netip.AddrPort, delay time.Duration,
+	attempt func(context.Context, netip.AddrPort) (net.Conn, error)) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	var wg sync.WaitGroup
+	defer func() {
+		// Close connections that lost the race once their attempts return.
+		go func() {
+			wg.Wait()
+			close(results)
+			for late := range results {
+				if late.conn != nil {
+					late.conn.Close()
+				}
+			}
+		}()
+	}()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	next, running := 0, 0
+	var err error
+	for {
+		if next == len(addrs) && running == 0 {
+			return nil, err
+		}
+		var timeout <-chan time.Time
+		if next < len(addrs) {
+			timeout = timer.C
+		}
+		select {
+		case <-timeout:
+			addr := addrs[next]
+			next++
+			running++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := attempt(ctx, addr)
+				results <- result{conn, err}
+			}()
+			timer.Reset(delay)
+		case r := <-results:
+			running--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			err = r.err
+			if next < len(addrs) {
+				// A failed attempt starts the next one without waiting.
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(0)
+			}
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+			return nil, err
+		}
+	}
+}
+
+// dialLatency aggregates how long dials to destinations take.
+type dialLatency struct {
+	mutex    sync.Mutex
+	count    int64
+	failures int64
+	total    time.Duration
+	max      time.Duration
+	// samples holds the most recent successful dial times, as a ring.
+	samples []time.Duration
+	next    int
+}
+
+// dialLatencies records every dial made by dialDestination.
+var dialLatencies = &dialLatency{}
+
+// DialLatencyStats summarizes dial times in the monitoring API. The
+// percentiles cover the most recent successful dials.
+type DialLatencyStats struct {
+	Count     int64   `json:"count"`
+	Failures  int64   `json:"failures"`
+	AverageMs float64 `json:"average_ms"`
+	P50Ms     float64 `json:"p50_ms"`
+	P95Ms     float64 `json:"p95_ms"`
+	MaxMs     float64 `json:"max_ms"`
+}
+
+// record adds a dial that took elapsed and failed if err is set.
+func (d *dialLatency) record(elapsed time.Duration, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err != nil {
+		// Refused destinations are not dials that took time on the network.
+		if !errors.Is(err, errDestinationBlocked) {
+			d.failures++
+		}
+		return
+	}
+	d.count++
+	d.total += elapsed
+	if elapsed > d.max {
+		d.max = elapsed
+	}
+	if len(d.samples) < dialLatencySamples {
+		d.samples = append(d.samples, elapsed)
+	} else {
+		d.samples[d.next] = elapsed
+		d.next = (d.next + 1) % dialLatencySamples
+	}
+}
+
+// stats returns the aggregated dial times.
+func (d *dialLatency) stats() DialLatencyStats {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	result := DialLatencyStats{Count: d.count, Failures: d.failures, MaxMs: milliseconds(d.max)}
+	if d.count == 0 {
+		return result
+	}
+	result.AverageMs = milliseconds(d.total / time.Duration(d.count))
+	sorted := append([]time.Duration(nil), d.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	result.P50Ms = milliseconds(sorted[len(sorted)*50/100])
+	result.P95Ms = milliseconds(sorted[len(sorted)*95/100])
+	return result
+}
+
+// milliseconds converts d to fractional milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
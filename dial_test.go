@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSortAddresses tests family filtering and interleaving of resolved addresses
+func TestSortAddresses(t *testing.T) {
+	addrs := []netip.AddrPort{
+		netip.MustParseAddrPort("192.0.2.1:80"),
+		netip.MustParseAddrPort("192.0.2.2:80"),
+		netip.MustParseAddrPort("192.0.2.3:80"),
+		netip.MustParseAddrPort("[2001:db8::1]:80"),
+	}
+	tests := []struct {
+		family string
+		want   string
+	}{
+		{"", "[2001:db8::1]:80 192.0.2.1:80 192.0.2.2:80 192.0.2.3:80"},
+		{familyPreferV4, "192.0.2.1:80 [2001:db8::1]:80 192.0.2.2:80 192.0.2.3:80"},
+		{familyV4Only, "192.0.2.1:80 192.0.2.2:80 192.0.2.3:80"},
+		{familyV6Only, "[2001:db8::1]:80"},
+	}
+	for _, tt := range tests {
+		sorted, err := sortAddresses(addrs, tt.family)
+		if err != nil {
+			t.Fatalf("Failed to sort for %q: %v", tt.family, err)
+		}
+		var got []string
+		for _, addr := range sorted {
+			got = append(got, addr.String())
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("Family %q: expected %s, got %s", tt.family, tt.want, strings.Join(got, " "))
+		}
+	}
+	if _, err := sortAddresses(addrs[:1], familyV6Only); err == nil {
+		t.Error("Expected no IPv6 address to be an error")
+	}
+	if err := (ConnectConfig{Family: "v6-first"}).validate(); err == nil {
+		t.Error("Expected an unknown family to be rejected")
+	}
+}
+
+// TestRaceAttempts tests that a hanging attempt is overtaken and failures start the next attempt at once
+func TestRaceAttempts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	live := netip.MustParseAddrPort(listener.Addr().String())
+	hanging := netip.MustParseAddrPort("[2001:db8::1]:80")
+	failing := netip.MustParseAddrPort("[2001:db8::2]:80")
+
+	canceled := make(chan bool, 1)
+	attempt := func(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+		switch addr {
+		case hanging:
+			<-ctx.Done()
+			canceled <- true
+			return nil, ctx.Err()
+		case failing:
+			return nil, errors.New("connection refused")
+		}
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", addr.String())
+	}
+
+	start := time.Now()
+	conn, err := raceAttempts(context.Background(), []netip.AddrPort{hanging, live}, 50*time.Millisecond, attempt)
+	if err != nil {
+		t.Fatalf("Expected the second address to connect: %v", err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected the second attempt after the attempt delay, took %v", elapsed)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the hanging attempt to be canceled")
+	}
+
+	start = time.Now()
+	conn, err = raceAttempts(context.Background(), []netip.AddrPort{failing, live}, time.Hour, attempt)
+	if err != nil {
+		t.Fatalf("Expected the second address to connect: %v", err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected a failed attempt to start the next one at once, took %v", elapsed)
+	}
+
+	if _, err := raceAttempts(context.Background(), []netip.AddrPort{failing, failing}, time.Millisecond, attempt); err == nil || err.Error() != "connection refused" {
+		t.Errorf("Expected the last error when every attempt fails, got %v", err)
+	}
+}
+
+// TestDialDirectFamily tests that the family preference restricts the addresses dialed
+func TestDialDirectFamily(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	for family, ok := range map[string]bool{familyPreferV6: true, familyV4Only: true, familyV6Only: false} {
+		cfg, err := newProxyConfig(&Config{SSRFGuard: SSRFGuardConfig{Disabled: true}, Connect: ConnectConfig{Family: family}})
+		if err != nil {
+			t.Fatalf("Failed to build config: %v", err)
+		}
+		conn, err := cfg.dialDirect(context.Background(), "192.0.2.1", listener.Addr().String(), nil)
+		if (err == nil) != ok {
+			t.Errorf("Family %s: expected success %v, got %v", family, ok, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// TestDialLatencyStats tests the aggregated dial times
+func TestDialLatencyStats(t *testing.T) {
+	latency := &dialLatency{}
+	for i := 1; i <= 100; i++ {
+		latency.record(time.Duration(i)*time.Millisecond, nil)
+	}
+	latency.record(time.Second, errors.New("connection refused"))
+	latency.record(0, errDestinationBlocked)
+
+	stats := latency.stats()
+	if stats.Count != 100 || stats.Failures != 1 {
+		t.Errorf("Expected 100 dials and 1 failure, got %+v", stats)
+	}
+	if stats.AverageMs != 50.5 || stats.P50Ms != 51 || stats.P95Ms != 96 || stats.MaxMs != 100 {
+		t.Errorf("Unexpected dial times: %+v", stats)
+	}
+}
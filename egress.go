@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// EgressConfig selects the local source address and network interface of
+// outgoing connections to destinations and first-hop upstreams.
+type EgressConfig struct {
+	// Addresses are local IP addresses used in turn as the source address.
+	// Each connection uses one of the same family as the address it dials.
+	Addresses []string `yaml:"addresses,omitempty"`
+	// Interface binds outgoing sockets to a network interface (SO_BINDTODEVICE,
+	// Linux only, needs CAP_NET_RAW).
+	Interface string `yaml:"interface,omitempty"`
+}
+
+// egressPolicy is the runtime form of EgressConfig. A nil policy dials with
+// the system's default route and source address.
+type egressPolicy struct {
+	addresses []netip.Addr
+	iface     string
+	next      atomic.Uint64
+}
+
+// newEgressPolicy checks an egress setting and returns its policy, or nil if
+// it selects nothing.
+func newEgressPolicy(config EgressConfig) (*egressPolicy, error) {
+	if len(config.Addresses) == 0 && config.Interface == "" {
+		return nil, nil
+	}
+	policy := &egressPolicy{iface: config.Interface}
+	for _, entry := range config.Addresses {
+		addr, err := netip.ParseAddr(strings.TrimSpace(entry))
+		if err != nil || addr.Zone() != "" {
+			return nil, fmt.Errorf("invalid source address '%s'", entry)
+		}
+		policy.addresses = append(policy.addresses, addr.Unmap())
+	}
+	if policy.iface != "" {
+		if !bindToDeviceSupported {
+			return nil, fmt.Errorf("interface binding is not supported on this platform")
+		}
+		if _, err := net.InterfaceByName(policy.iface); err != nil {
+			return nil, fmt.Errorf("interface '%s': %v", policy.iface, err)
+		}
+	}
+	return policy, nil
+}
+
+// String describes the policy, for example "192.0.2.10|192.0.2.11%eth1".
+func (p *egressPolicy) String() string {
+	if p == nil {
+		return ""
+	}
+	addresses := make([]string, len(p.addresses))
+	for i, addr := range p.addresses {
+		addresses[i] = addr.String()
+	}
+	description := strings.Join(addresses, "|")
+	if p.iface != "" {
+		description += "%" + p.iface
+	}
+	return description
+}
+
+// source returns the next source address to dial address ("host:port")
+// from. Only addresses of the destination's family are used for an IP
+// literal; the dialer then also resolves names to that family.
+func (p *egressPolicy) source(address string) (netip.Addr, error) {
+	if len(p.addresses) == 0 {
+		return netip.Addr{}, nil
+	}
+	candidates := p.addresses
+	host, _, _ := net.SplitHostPort(address)
+	if dest, err := netip.ParseAddr(host); err == nil {
+		candidates = nil
+		for _, addr := range p.addresses {
+			if addr.Is4() == dest.Unmap().Is4() {
+				candidates = append(candidates, addr)
+			}
+		}
+		if len(candidates) == 0 {
+			return netip.Addr{}, fmt.Errorf("no source address for %s", dest)
+		}
+	}
+	return candidates[int(p.next.Add(1)-1)%len(candidates)], nil
+}
+
+// dial connects to address over TCP from the policy's next source address
+// and interface.
+func (p *egressPolicy) dial(ctx context.Context, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	if p != nil {
+		source, err := p.source(address)
+		if err != nil {
+			return nil, err
+		}
+		if source.IsValid() {
+			dialer.LocalAddr = &net.TCPAddr{IP: source.AsSlice()}
+		}
+		if p.iface != "" {
+			dialer.Control = bindToDevice(p.iface)
+		}
+	}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// localIP returns the local IP address of conn, or "" if it has none.
+func localIP(conn net.Conn) string {
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
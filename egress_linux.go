@@ -0,0 +1,20 @@
+package main
+
+import "syscall"
+
+// bindToDeviceSupported reports whether egress interfaces can be selected.
+const bindToDeviceSupported = true
+
+// bindToDevice returns a dialer Control function binding sockets to iface.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// bindToDeviceSupported reports whether egress interfaces can be selected.
+const bindToDeviceSupported = false
+
+// bindToDevice is only available on Linux; newEgressPolicy refuses interfaces elsewhere.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
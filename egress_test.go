@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestEgressPolicy tests source address validation and round-robin by address family
+func TestEgressPolicy(t *testing.T) {
+	policy, err := newEgressPolicy(EgressConfig{Addresses: []string{"192.0.2.10", "2001:db8::10", "192.0.2.11"}})
+	if err != nil {
+		t.Fatalf("Failed to build egress policy: %v", err)
+	}
+	var sources []string
+	for i := 0; i < 3; i++ {
+		source, err := policy.source("198.51.100.1:443")
+		if err != nil {
+			t.Fatalf("Expected an IPv4 source: %v", err)
+		}
+		sources = append(sources, source.String())
+	}
+	if sources[0] == sources[1] || sources[0] != sources[2] {
+		t.Errorf("Expected IPv4 sources in turn, got %v", sources)
+	}
+	if source, err := policy.source("[2001:db8::1]:443"); err != nil || source.String() != "2001:db8::10" {
+		t.Errorf("Expected the IPv6 source, got %v, %v", source, err)
+	}
+
+	v4only, _ := newEgressPolicy(EgressConfig{Addresses: []string{"192.0.2.10"}})
+	if _, err := v4only.source("[2001:db8::1]:443"); err == nil {
+		t.Error("Expected no source for an IPv6 destination")
+	}
+	if none, err := newEgressPolicy(EgressConfig{}); none != nil || err != nil {
+		t.Errorf("Expected no policy without settings, got %v, %v", none, err)
+	}
+	for _, config := range []EgressConfig{
+		{Addresses: []string{"192.0.2.300"}},
+		{Addresses: []string{"fe80::1%eth0"}},
+		{Interface: "no-such-interface0"},
+	} {
+		if _, err := newEgressPolicy(config); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+}
+
+// TestEgressDial tests that connections are made from the selected source address
+func TestEgressDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	accepted := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		conn.Close()
+	}()
+
+	policy, _ := newEgressPolicy(EgressConfig{Addresses: []string{"127.0.0.2"}})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := policy.dial(ctx, listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial from 127.0.0.2: %v", err)
+	}
+	defer conn.Close()
+	if local := localIP(conn); local != "127.0.0.2" {
+		t.Errorf("Expected local address 127.0.0.2, got %s", local)
+	}
+	if remote := <-accepted; remote != "127.0.0.2" {
+		t.Errorf("Expected the server to see 127.0.0.2, got %s", remote)
+	}
+}
+
+// TestEgressSelection tests that route rules override users, which override the top-level egress
+func TestEgressSelection(t *testing.T) {
+	encoded, _ := hashPassword("secret")
+	cfg, err := newProxyConfig(&Config{
+		Egress: EgressConfig{Addresses: []string{"192.0.2.10"}},
+		Users:  []UserConfig{{Username: "alice", PasswordHash: encoded, Egress: EgressConfig{Addresses: []string{"192.0.2.20"}}}},
+		Routes: []RouteRule{{Hosts: []string{"*.example.com"}, Action: "direct", Egress: EgressConfig{Addresses: []string{"192.0.2.30"}}}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	tests := []struct {
+		user    string
+		address string
+		egress  string
+	}{
+		{"", "other.test:443", "192.0.2.10"},
+		{"bob", "other.test:443", "192.0.2.10"},
+		{"alice", "other.test:443", "192.0.2.20"},
+		{"alice", "www.example.com:443", "192.0.2.30"},
+	}
+	for _, tt := range tests {
+		if egress := cfg.routeConnection("198.51.100.1", tt.user, tt.address).Egress; egress != tt.egress {
+			t.Errorf("Expected egress %s for %q to %s, got %q", tt.egress, tt.user, tt.address, egress)
+		}
+	}
+
+	if _, err := newProxyConfig(&Config{Routes: []RouteRule{{Action: "direct", Egress: EgressConfig{Addresses: []string{"nowhere"}}}}}); err == nil {
+		t.Error("Expected an invalid route egress to be rejected")
+	}
+}
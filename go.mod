@@ -3,6 +3,6 @@ module proxy
 go 1.24.2
 
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	github.com/gorilla/websocket v1.5.3
+	gopkg.in/yaml.v2 v2.4.0
 )
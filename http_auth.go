@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyAuthRealm = "proxy"
+	// digestNonceLifetime is how long a Digest nonce is accepted before the
+	// client is asked to retry with a fresh one (stale=true).
+	digestNonceLifetime = 5 * time.Minute
+)
+
+// digestNonceSecret signs Digest nonces so they can be validated without storing them.
+var digestNonceSecret = func() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(fmt.Sprintf("could not generate digest nonce secret: %v", err))
+	}
+	return secret
+}()
+
+// digestAlgorithm describes a Digest hash algorithm (RFC 7616).
+type digestAlgorithm struct {
+	name string
+	hash func() hash.Hash
+}
+
+var digestAlgorithms = []digestAlgorithm{
+	{name: "SHA-256", hash: sha256.New},
+	{name: "MD5", hash: md5.New},
+}
+
+// digestHash returns the lowercase hex digest of the colon-joined parts.
+func digestHash(newHash func() hash.Hash, parts ...string) string {
+	h := newHash()
+	h.Write([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// computeDigestHA1 computes H(username:realm:password) for storage in config.yaml.
+func computeDigestHA1(newHash func() hash.Hash, username, password string) string {
+	return digestHash(newHash, username, proxyAuthRealm, password)
+}
+
+// digestNonceData is the length of a nonce's creation time and random part.
+const digestNonceData = 16
+
+// newDigestNonce returns a unique nonce that embeds its creation time and a MAC.
+func newDigestNonce() string {
+	return signDigestNonce(time.Now())
+}
+
+// signDigestNonce returns a nonce issued at the given time.
+func signDigestNonce(issued time.Time) string {
+	buf := binary.BigEndian.AppendUint64(nil, uint64(issued.Unix()))
+	buf = binary.BigEndian.AppendUint64(buf, randUint64())
+	mac := hmac.New(sha256.New, digestNonceSecret)
+	mac.Write(buf)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(buf))
+}
+
+// randUint64 returns a random number from the system's secure source.
+func randUint64() uint64 {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Sprintf("could not generate digest nonce: %v", err))
+	}
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// checkDigestNonce reports whether the nonce was issued by this proxy and whether it is still fresh.
+func checkDigestNonce(nonce string) (valid, fresh bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) != digestNonceData+sha256.Size {
+		return false, false
+	}
+	mac := hmac.New(sha256.New, digestNonceSecret)
+	mac.Write(raw[:digestNonceData])
+	if !hmac.Equal(mac.Sum(nil), raw[digestNonceData:]) {
+		return false, false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(raw[:8])), 0)
+	return true, time.Since(issued) < digestNonceLifetime
+}
+
+// nonceCounter remembers the highest nonce count (nc) each Digest nonce was
+// used with, so that a captured Proxy-Authorization header cannot be
+// replayed. Entries are dropped once their nonce has expired.
+type nonceCounter struct {
+	mutex  sync.Mutex
+	counts map[string]nonceCount
+	swept  time.Time
+}
+
+type nonceCount struct {
+	nc      uint64
+	expires time.Time
+}
+
+var digestNonceCounts = &nonceCounter{counts: make(map[string]nonceCount)}
+
+// advance records nc for nonce and reports whether it is higher than any
+// count the nonce was used with before.
+func (c *nonceCounter) advance(nonce string, nc uint64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.swept) >= digestNonceLifetime {
+		for key, count := range c.counts {
+			if now.After(count.expires) {
+				delete(c.counts, key)
+			}
+		}
+		c.swept = now
+	}
+	if seen, exists := c.counts[nonce]; exists && nc <= seen.nc {
+		return false
+	}
+	c.counts[nonce] = nonceCount{nc: nc, expires: now.Add(digestNonceLifetime)}
+	return true
+}
+
+// parseAuthParams parses the comma-separated key=value list of an
+// Authorization header, honouring quoted strings.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " ")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			value = b.String()
+			s = s[min(i+1, len(s)):]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// authenticateBasic validates a Basic Proxy-Authorization credential.
+func (s *userStore) authenticateBasic(credentials string) (string, bool) {
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || !s.authenticate(username, password) {
+		return "", false
+	}
+	return username, true
+}
+
+// authenticateDigest validates a Digest Proxy-Authorization credential.
+// stale is set when the response was correct for an expired nonce, or for a
+// nonce count that was already used, so that the client retries with a new
+// nonce.
+// The uri parameter may carry the request target as sent or its origin-form,
+// since clients disagree on which one to use through a proxy.
+func (s *userStore) authenticateDigest(req *http.Request, credentials string) (username string, ok, stale bool) {
+	params := parseAuthParams(credentials)
+	username = params["username"]
+
+	algorithmName := params["algorithm"]
+	if algorithmName == "" {
+		algorithmName = "MD5"
+	}
+	var algorithm *digestAlgorithm
+	for i := range digestAlgorithms {
+		if strings.EqualFold(digestAlgorithms[i].name, algorithmName) {
+			algorithm = &digestAlgorithms[i]
+		}
+	}
+	ha1 := s.digestHA1(username, algorithmName)
+	if algorithm == nil || ha1 == "" || params["realm"] != proxyAuthRealm || params["qop"] != "auth" {
+		return "", false, false
+	}
+	if uri := params["uri"]; uri != req.RequestURI && uri != req.URL.RequestURI() {
+		return "", false, false
+	}
+
+	valid, fresh := checkDigestNonce(params["nonce"])
+	if !valid {
+		return "", false, false
+	}
+
+	ha2 := digestHash(algorithm.hash, req.Method, params["uri"])
+	expected := digestHash(algorithm.hash, ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+		return "", false, false
+	}
+	if !fresh {
+		return "", false, true
+	}
+	nc, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil {
+		return "", false, false
+	}
+	if !digestNonceCounts.advance(params["nonce"], nc) {
+		return "", false, true
+	}
+	return username, true, false
+}
+
+// authenticateHTTP checks the Proxy-Authorization header of req and returns
+// the authenticated username. When the client is not allowed through, it
+// returns ok=false and the challenge response to send back.
+func (p *accessPolicy) authenticateHTTP(req *http.Request, clientIP string) (username string, ok bool, challenge *http.Response) {
+	authorization := req.Header.Get("Proxy-Authorization")
+	req.Header.Del("Proxy-Authorization")
+
+	if authorization == "" && p.certUser != "" {
+		return p.certUser, true, nil
+	}
+	if authorization == "" && p.allowsAnonymous(clientIP) {
+		return "", true, nil
+	}
+
+	stale := false
+	if !p.users.empty() {
+		scheme, credentials, _ := strings.Cut(authorization, " ")
+		switch strings.ToLower(scheme) {
+		case "basic":
+			if username, ok := p.users.authenticateBasic(strings.TrimSpace(credentials)); ok {
+				return username, true, nil
+			}
+		case "digest":
+			var ok bool
+			username, ok, stale = p.users.authenticateDigest(req, credentials)
+			if ok {
+				return username, true, nil
+			}
+		}
+	}
+	return "", false, p.authChallenge(stale)
+}
+
+// authChallenge builds a 407 response offering every scheme the user store supports.
+func (p *accessPolicy) authChallenge(stale bool) *http.Response {
+	resp := httpErrorResponse(http.StatusProxyAuthRequired)
+	resp.Header.Add("Proxy-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, proxyAuthRealm))
+	for _, algorithm := range digestAlgorithms {
+		if !p.users.hasDigest(algorithm.name) {
+			continue
+		}
+		challenge := fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=%s, nonce="%s"`,
+			proxyAuthRealm, algorithm.name, newDigestNonce())
+		if stale {
+			challenge += ", stale=true"
+		}
+		resp.Header.Add("Proxy-Authenticate", challenge)
+	}
+	return resp
+}
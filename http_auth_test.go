@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHTTPPolicy builds a policy with one user able to use Basic and Digest
+func newTestHTTPPolicy(t *testing.T) *accessPolicy {
+	encoded, _ := hashPassword("secret")
+	policy, err := newAccessPolicy(&Config{
+		AllowedIPs: []string{"127.0.0.1"},
+		Users: []UserConfig{{
+			Username:        "alice",
+			PasswordHash:    encoded,
+			DigestHA1:       computeDigestHA1(md5.New, "alice", "secret"),
+			DigestHA1SHA256: computeDigestHA1(sha256.New, "alice", "secret"),
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build policy: %v", err)
+	}
+	return policy
+}
+
+// digestAuthorization computes a client Digest response for the first use of nonce
+func digestAuthorization(req *http.Request, algorithm digestAlgorithm, password, nonce string) string {
+	return digestAuthorizationCount(req, algorithm, password, nonce, "00000001")
+}
+
+// digestAuthorizationCount computes a client Digest response for req with the nonce count nc
+func digestAuthorizationCount(req *http.Request, algorithm digestAlgorithm, password, nonce, nc string) string {
+	ha1 := computeDigestHA1(algorithm.hash, "alice", password)
+	ha2 := digestHash(algorithm.hash, req.Method, req.RequestURI)
+	response := digestHash(algorithm.hash, ha1, nonce, nc, "abcdef", "auth", ha2)
+	return fmt.Sprintf(`Digest username="alice", realm="%s", nonce="%s", uri="%s", algorithm=%s, qop=auth, nc=%s, cnonce="abcdef", response="%s"`,
+		proxyAuthRealm, nonce, req.RequestURI, algorithm.name, nc, response)
+}
+
+// newTestProxyRequest builds a request as read from a proxy client
+func newTestProxyRequest(authorization string) *http.Request {
+	req, _ := http.NewRequest("GET", "http://example.com/index.html", nil)
+	req.RequestURI = "http://example.com/index.html"
+	if authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	return req
+}
+
+// TestAuthenticateHTTPBasic tests Basic credentials and anonymous access
+func TestAuthenticateHTTPBasic(t *testing.T) {
+	policy := newTestHTTPPolicy(t)
+
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	req := newTestProxyRequest(basic)
+	username, ok, _ := policy.authenticateHTTP(req, "10.0.0.1")
+	if !ok || username != "alice" {
+		t.Fatalf("Expected alice to authenticate, got %q (ok=%v)", username, ok)
+	}
+	if req.Header.Get("Proxy-Authorization") != "" {
+		t.Error("Expected credentials to be stripped from the request")
+	}
+
+	wrong := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:wrong"))
+	if _, ok, challenge := policy.authenticateHTTP(newTestProxyRequest(wrong), "127.0.0.1"); ok || challenge.StatusCode != http.StatusProxyAuthRequired {
+		t.Error("Expected wrong credentials to get a 407 challenge")
+	}
+
+	if _, ok, _ := policy.authenticateHTTP(newTestProxyRequest(""), "127.0.0.1"); !ok {
+		t.Error("Expected anonymous access from an allowed IP")
+	}
+
+	_, ok, challenge := policy.authenticateHTTP(newTestProxyRequest(""), "10.0.0.1")
+	if ok {
+		t.Fatal("Expected anonymous access from another IP to be refused")
+	}
+	if schemes := challenge.Header.Values("Proxy-Authenticate"); len(schemes) != 3 {
+		t.Errorf("Expected Basic and two Digest challenges, got %v", schemes)
+	}
+}
+
+// TestAuthenticateHTTPDigest tests Digest responses for both algorithms and stale nonces
+func TestAuthenticateHTTPDigest(t *testing.T) {
+	policy := newTestHTTPPolicy(t)
+
+	for _, algorithm := range digestAlgorithms {
+		req := newTestProxyRequest("")
+		req.Header.Set("Proxy-Authorization", digestAuthorization(req, algorithm, "secret", newDigestNonce()))
+		if username, ok, _ := policy.authenticateHTTP(req, "10.0.0.1"); !ok || username != "alice" {
+			t.Errorf("%s: expected alice to authenticate", algorithm.name)
+		}
+
+		req = newTestProxyRequest("")
+		req.Header.Set("Proxy-Authorization", digestAuthorization(req, algorithm, "wrong", newDigestNonce()))
+		if _, ok, _ := policy.authenticateHTTP(req, "10.0.0.1"); ok {
+			t.Errorf("%s: expected wrong password to be rejected", algorithm.name)
+		}
+	}
+
+	// A correct response for an expired nonce must ask the client to retry.
+	oldNonce := signDigestNonce(time.Now().Add(-2 * digestNonceLifetime))
+
+	req := newTestProxyRequest("")
+	req.Header.Set("Proxy-Authorization", digestAuthorization(req, digestAlgorithms[0], "secret", oldNonce))
+	_, ok, challenge := policy.authenticateHTTP(req, "10.0.0.1")
+	if ok {
+		t.Fatal("Expected expired nonce to be rejected")
+	}
+	for _, value := range challenge.Header.Values("Proxy-Authenticate")[1:] {
+		if len(value) < len("stale=true") || value[len(value)-len("stale=true"):] != "stale=true" {
+			t.Errorf("Expected stale Digest challenge, got %q", value)
+		}
+	}
+}
+
+// TestAuthenticateHTTPDigestReplay tests that a Digest response cannot be used twice
+func TestAuthenticateHTTPDigestReplay(t *testing.T) {
+	policy := newTestHTTPPolicy(t)
+	nonce := newDigestNonce()
+	if nonce == newDigestNonce() {
+		t.Fatal("Expected every nonce to be unique")
+	}
+
+	req := newTestProxyRequest("")
+	captured := digestAuthorization(req, digestAlgorithms[0], "secret", nonce)
+	req.Header.Set("Proxy-Authorization", captured)
+	if _, ok, _ := policy.authenticateHTTP(req, "10.0.0.1"); !ok {
+		t.Fatal("Expected the first use of the nonce to authenticate")
+	}
+
+	req = newTestProxyRequest(captured)
+	_, ok, challenge := policy.authenticateHTTP(req, "10.0.0.1")
+	if ok {
+		t.Fatal("Expected a replayed response to be rejected")
+	}
+	for _, value := range challenge.Header.Values("Proxy-Authenticate")[1:] {
+		if !strings.HasSuffix(value, "stale=true") {
+			t.Errorf("Expected a stale Digest challenge after a replay, got %q", value)
+		}
+	}
+
+	req = newTestProxyRequest("")
+	req.Header.Set("Proxy-Authorization", digestAuthorizationCount(req, digestAlgorithms[0], "secret", nonce, "00000002"))
+	if _, ok, _ := policy.authenticateHTTP(req, "10.0.0.1"); !ok {
+		t.Error("Expected a higher nonce count to authenticate")
+	}
+}
+
+// TestParseAuthParams tests parsing of quoted and unquoted Digest parameters
+func TestParseAuthParams(t *testing.T) {
+	params := parseAuthParams(`username="a\"b", qop=auth, uri="/x,y", nc=00000001`)
+	expected := map[string]string{"username": `a"b`, "qop": "auth", "uri": "/x,y", "nc": "00000001"}
+	for key, value := range expected {
+		if params[key] != value {
+			t.Errorf("Expected %s=%q, got %q", key, value, params[key])
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	upstreamMaxIdlePerHost = 4
+	upstreamIdleTimeout    = 90 * time.Second
+)
+
+// upstreamConn is a persistent connection to an origin server.
+type upstreamConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	idleSince time.Time
+}
+
+// upstreamPool keeps idle origin connections per host:port so that requests
+// from any client connection can reuse them.
+type upstreamPool struct {
+	idle  map[string][]*upstreamConn
+	mutex sync.Mutex
+}
+
+var upstreams = &upstreamPool{
+	idle: make(map[string][]*upstreamConn),
+}
+
+// idler is implemented by connections that count differently while idle,
+// such as connections through pool members.
+type idler interface {
+	setIdle(idle bool)
+}
+
+// setIdle marks upstream as idle in or taken out of the pool.
+func (upstream *upstreamConn) setIdle(idle bool) {
+	if conn, ok := upstream.conn.(idler); ok {
+		conn.setIdle(idle)
+	}
+}
+
+// get returns an idle connection to address, or nil if none is available.
+func (p *upstreamPool) get(address string) *upstreamConn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	conns := p.idle[address]
+	for len(conns) > 0 {
+		upstream := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(upstream.idleSince) < upstreamIdleTimeout {
+			p.idle[address] = conns
+			upstream.setIdle(false)
+			return upstream
+		}
+		upstream.conn.Close()
+	}
+	delete(p.idle, address)
+	return nil
+}
+
+// put returns a connection to the pool, closing it if the host already has
+// enough idle connections.
+func (p *upstreamPool) put(address string, upstream *upstreamConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.idle[address]) >= upstreamMaxIdlePerHost {
+		upstream.conn.Close()
+		return
+	}
+	upstream.idleSince = time.Now()
+	upstream.setIdle(true)
+	p.idle[address] = append(p.idle[address], upstream)
+}
+
+// reapIdle closes connections that have been idle longer than upstreamIdleTimeout.
+func (p *upstreamPool) reapIdle() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for address, conns := range p.idle {
+		kept := conns[:0]
+		for _, upstream := range conns {
+			if time.Since(upstream.idleSince) < upstreamIdleTimeout {
+				kept = append(kept, upstream)
+			} else {
+				upstream.conn.Close()
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.idle, address)
+		} else {
+			p.idle[address] = kept
+		}
+	}
+}
+
+// startUpstreamReaper starts a goroutine that periodically closes stale pooled connections
+func startUpstreamReaper() {
+	go func() {
+		ticker := time.NewTicker(upstreamIdleTimeout / 3)
+		defer ticker.Stop()
+		for range ticker.C {
+			upstreams.reapIdle()
+		}
+	}()
+}
+
+// trackingWriter records the bytes written through it in the monitoring system.
+type trackingWriter struct {
+	w        io.Writer
+	connID   string
+	outbound bool
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if n > 0 {
+		if t.outbound {
+			updateBandwidth(t.connID, 0, int64(n))
+		} else {
+			updateBandwidth(t.connID, int64(n), 0)
+		}
+		throttle(t.connID, t.outbound, n)
+	}
+	return n, err
+}
+
+// httpDestination returns the host:port a request should be sent to.
+func httpDestination(req *http.Request) string {
+	address := req.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "80")
+	}
+	return address
+}
+
+// httpErrorResponse builds a minimal response for errors generated by the proxy itself.
+func httpErrorResponse(statusCode int) *http.Response {
+	body := http.StatusText(statusCode)
+	return &http.Response{
+		StatusCode:    statusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// forwardHTTPRequest sends one request upstream and relays the response.
+// It reports whether the client connection can be used for another request.
+func forwardHTTPRequest(clientConn net.Conn, reader *bufio.Reader, req *http.Request, cfg *proxyConfig, debug bool, connID, clientIP, username string) bool {
+	address := httpDestination(req)
+	target := req.URL.String()
+
+	decision := cfg.routeConnection(clientIP, username, address)
+	if decision.rejected() {
+		if debug {
+			log.Printf("HTTP: Destination '%s' blocked for %s by %s", address, clientIP, decision.Rule)
+		}
+		recordBlocked()
+		// The connection can only be reused if the request body is not left unread.
+		errResp := httpErrorResponse(http.StatusForbidden)
+		errResp.Close = req.Close || (req.Body != nil && req.Body != http.NoBody)
+		if err := errResp.Write(clientConn); err != nil {
+			return false
+		}
+		return !errResp.Close
+	}
+
+	cfg.headers.rewriteRequest(req, clientIP)
+
+	// Register request in monitoring system
+	addConnection(connID, cfg.listener, clientIP, username, "HTTP", address)
+	attachCloser(connID, clientConn)
+	attachShaper(connID, cfg.shaperFor(clientIP, username, address))
+	defer removeConnection(connID)
+
+	clientWriter := &trackingWriter{w: clientConn, connID: connID}
+
+	resp, upstream, err := roundTripUpstream(cfg, clientIP, address, decision, req, connID, debug)
+	if err != nil {
+		if debug {
+			log.Printf("HTTP: Request to '%s' failed: %v", address, err)
+		}
+		status := http.StatusBadGateway
+		if errors.Is(err, errDestinationBlocked) {
+			recordBlocked()
+			status = http.StatusForbidden
+		}
+		errResp := httpErrorResponse(status)
+		errResp.Close = true
+		errResp.Write(clientWriter)
+		return false
+	}
+	attachCloser(connID, &tunnelCloser{client: clientConn, server: upstream.conn})
+
+	// Relay interim responses such as 100 Continue before the final one.
+	for resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+		cfg.headers.rewriteResponse(resp)
+		if err := resp.Write(clientWriter); err != nil {
+			upstream.conn.Close()
+			return false
+		}
+		resp, err = http.ReadResponse(upstream.reader, req)
+		if err != nil {
+			upstream.conn.Close()
+			return false
+		}
+	}
+
+	cfg.headers.rewriteResponse(resp)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// The connection now carries another protocol (e.g. WebSocket): relay raw bytes.
+		defer upstream.conn.Close()
+		if err := resp.Write(clientWriter); err != nil {
+			return false
+		}
+		tunnel := newTunnel(cfg, connID, clientConn, upstream.conn)
+		attachCloser(connID, tunnel)
+		tunnel.relay(reader, upstream.reader, cfg.buffers.Relay)
+		return false
+	}
+
+	upstreamReusable := !resp.Close
+	keepAlive := !req.Close && !resp.Close
+	resp.Close = !keepAlive
+
+	err = resp.Write(clientWriter)
+	resp.Body.Close()
+	if err != nil || !upstreamReusable {
+		upstream.conn.Close()
+	} else {
+		upstreams.put(poolKey(decision, address), upstream)
+	}
+
+	if debug {
+		log.Printf("HTTP: %s %s -> %d (keep-alive: %v)", req.Method, target, resp.StatusCode, keepAlive && err == nil)
+	}
+	return keepAlive && err == nil
+}
+
+// roundTripUpstream writes req to a pooled or new connection to address and
+// reads the response headers. Connections are pooled per route, and direct
+// ones are only reused if the SSRF guard and destination rules let this client
+// reach the address they are connected to.
+func roundTripUpstream(cfg *proxyConfig, clientIP, address string, decision routeDecision, req *http.Request, connID string, debug bool) (*http.Response, *upstreamConn, error) {
+	key := poolKey(decision, address)
+	for {
+		upstream := upstreams.get(key)
+		if upstream != nil && decision.Action == routeActionDirect && !cfg.reusable(clientIP, address, upstream.conn) {
+			upstreams.put(key, upstream)
+			upstream = nil
+		}
+		reused := upstream != nil
+		if reused {
+			attachRoute(connID, decision.Route)
+			attachEgress(connID, localIP(upstream.conn))
+		} else {
+			conn, err := cfg.dialDestination(connID, clientIP, address, decision)
+			if err != nil {
+				return nil, nil, err
+			}
+			upstream = &upstreamConn{conn: conn, reader: bufio.NewReader(conn)}
+		}
+
+		resp, err := upstream.roundTrip(req, connID)
+		if err == nil {
+			return resp, upstream, nil
+		}
+		upstream.conn.Close()
+
+		// A pooled connection may have been closed by the server while idle;
+		// retry on a fresh one if the request has no body to replay.
+		if !reused || (req.Body != nil && req.Body != http.NoBody) {
+			return nil, nil, err
+		}
+		if debug {
+			log.Printf("HTTP: Pooled connection to '%s' failed, retrying: %v", address, err)
+		}
+	}
+}
+
+// poolKey identifies pooled connections to address over the decided route
+// and egress.
+func poolKey(decision routeDecision, address string) string {
+	key := address
+	if decision.Action != routeActionDirect {
+		key = decision.Route + " > " + address
+	}
+	if decision.Egress != "" {
+		key = decision.Egress + " > " + key
+	}
+	return key
+}
+
+// reusable reports whether the client at clientIP may reuse conn, a direct
+// connection to address, under the current SSRF guard and destination rules.
+func (cfg *proxyConfig) reusable(clientIP, address string, conn net.Conn) bool {
+	remote, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+	return cfg.guard.permits(clientIP, remote.Addr()) && cfg.destinations.permitsResolved(address, remote)
+}
+
+// roundTrip writes req on the connection and reads the response headers.
+func (u *upstreamConn) roundTrip(req *http.Request, connID string) (*http.Response, error) {
+	if err := req.Write(&trackingWriter{w: u.conn, connID: connID, outbound: true}); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(u.reader, req)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestUpstreamPoolReuse tests that idle connections are reused per host and expire
+func TestUpstreamPoolReuse(t *testing.T) {
+	pool := &upstreamPool{idle: make(map[string][]*upstreamConn)}
+	server, client := net.Pipe()
+	defer server.Close()
+
+	upstream := &upstreamConn{conn: client, reader: bufio.NewReader(client)}
+	pool.put("example.com:80", upstream)
+
+	if got := pool.get("other.example:80"); got != nil {
+		t.Error("Expected no connection for another host")
+	}
+	if got := pool.get("example.com:80"); got != upstream {
+		t.Error("Expected pooled connection to be reused")
+	}
+	if got := pool.get("example.com:80"); got != nil {
+		t.Error("Expected pool to be empty after reuse")
+	}
+
+	pool.put("example.com:80", upstream)
+	upstream.idleSince = time.Now().Add(-2 * upstreamIdleTimeout)
+	pool.reapIdle()
+	if got := pool.get("example.com:80"); got != nil {
+		t.Error("Expected expired connection to be reaped")
+	}
+}
+
+// TestHTTPForwardKeepAlive tests that requests on one client connection are routed to their own hosts
+func TestHTTPForwardKeepAlive(t *testing.T) {
+	newOrigin := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		}))
+	}
+	first := newOrigin("first")
+	defer first.Close()
+	second := newOrigin("second")
+	defer second.Close()
+
+	config := &Config{
+		AllowedIPs: []string{"127.0.0.1"},
+		SSRFGuard:  SSRFGuardConfig{AllowedDestinations: []string{"127.0.0.1"}},
+	}
+	config.applyDefaults()
+	cfg, err := newProxyConfig(config)
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+
+	proxySide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	go func() {
+		defer proxySide.Close()
+		handleHTTP(proxySide, bufio.NewReader(proxySide), cfg, false, generateConnectionID(), "127.0.0.1")
+	}()
+
+	clientReader := bufio.NewReader(clientSide)
+	for _, tt := range []struct {
+		origin   *httptest.Server
+		path     string
+		expected string
+	}{
+		{first, "/a", "first /a"},
+		{second, "/b", "second /b"},
+		{first, "/c", "first /c"},
+	} {
+		req, _ := http.NewRequest("GET", tt.origin.URL+tt.path, nil)
+		if err := req.WriteProxy(clientSide); err != nil {
+			t.Fatalf("Failed to write request: %v", err)
+		}
+		resp, err := http.ReadResponse(clientReader, req)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tt.expected {
+			t.Errorf("Expected %q, got %q", tt.expected, body)
+		}
+		if resp.Close {
+			t.Fatal("Expected client connection to stay open")
+		}
+	}
+}
+
+// TestHTTPForwardReload tests that a reload applies to the next request on a kept-alive connection
+func TestHTTPForwardReload(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer origin.Close()
+
+	configs := make([]*proxyConfig, 3)
+	for i, config := range []*Config{
+		{AllowedIPs: []string{"127.0.0.1"}},
+		{AllowedIPs: []string{"127.0.0.1"}, Destinations: DestinationConfig{Rules: []DestinationRule{{Action: "deny", Hosts: []string{"127.0.0.1"}}}}},
+		{AllowedIPs: []string{"192.0.2.1"}},
+	} {
+		config.SSRFGuard = SSRFGuardConfig{AllowedDestinations: []string{"127.0.0.1"}}
+		config.applyDefaults()
+		cfg, err := newProxyConfig(config)
+		if err != nil {
+			t.Fatalf("Failed to build config: %v", err)
+		}
+		cfg.version = int64(i + 1)
+		configs[i] = cfg
+	}
+	saved := liveConfig.get()
+	defer liveConfig.current.Store(saved)
+	liveConfig.current.Store(configs[0])
+
+	proxySide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer proxySide.Close()
+		handleHTTP(proxySide, bufio.NewReader(proxySide), configs[0], false, generateConnectionID(), "127.0.0.1")
+	}()
+
+	clientReader := bufio.NewReader(clientSide)
+	for i, expected := range []int{http.StatusOK, http.StatusForbidden} {
+		liveConfig.current.Store(configs[i])
+		req, _ := http.NewRequest("GET", origin.URL+"/", nil)
+		if err := req.WriteProxy(clientSide); err != nil {
+			t.Fatalf("Failed to write request: %v", err)
+		}
+		resp, err := http.ReadResponse(clientReader, req)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Expected %d with config version %d, got %d", expected, i+1, resp.StatusCode)
+		}
+	}
+
+	// A client that is no longer allowed is disconnected at its next request.
+	liveConfig.current.Store(configs[2])
+	req, _ := http.NewRequest("GET", origin.URL+"/", nil)
+	go req.WriteProxy(clientSide)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the connection to be closed once the client is no longer allowed")
+	}
+}
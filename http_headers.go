@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders are meaningful only for a single connection and must not be
+// forwarded by a proxy (RFC 9110 section 7.6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HTTPConfig controls how the proxy rewrites forwarded HTTP messages.
+type HTTPConfig struct {
+	// Via is the pseudonym added to the Via header; "off" disables the header.
+	Via string `yaml:"via"`
+	// ForwardedHeaders selects how the client address is passed to origins:
+	// "none", "x-forwarded-for", "forwarded" or "both".
+	ForwardedHeaders string `yaml:"forwarded_headers"`
+}
+
+// headerRewriter applies the configured header policy to forwarded messages.
+type headerRewriter struct {
+	via           string
+	xForwardedFor bool
+	forwarded     bool
+}
+
+// newHeaderRewriter validates the HTTP section of the config.
+func newHeaderRewriter(config HTTPConfig) (headerRewriter, error) {
+	rewriter := headerRewriter{via: config.Via}
+	switch rewriter.via {
+	case "":
+		rewriter.via = "proxy"
+	case "off":
+		rewriter.via = ""
+	}
+
+	switch strings.ToLower(config.ForwardedHeaders) {
+	case "", "none":
+	case "x-forwarded-for":
+		rewriter.xForwardedFor = true
+	case "forwarded":
+		rewriter.forwarded = true
+	case "both":
+		rewriter.xForwardedFor = true
+		rewriter.forwarded = true
+	default:
+		return headerRewriter{}, fmt.Errorf("invalid http.forwarded_headers '%s'", config.ForwardedHeaders)
+	}
+	return rewriter, nil
+}
+
+// upgradeType returns the protocol requested in an Upgrade header, if the
+// Connection header marks it as an upgrade.
+func upgradeType(header http.Header) string {
+	for _, value := range header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// removeHopByHopHeaders strips hop-by-hop headers, including any listed in Connection.
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// rewriteRequest prepares a client request to be sent to an origin server.
+func (h headerRewriter) rewriteRequest(req *http.Request, clientIP string) {
+	upgrade := upgradeType(req.Header)
+	keepTrailers := false
+	for _, value := range req.Header.Values("TE") {
+		if strings.Contains(strings.ToLower(value), "trailers") {
+			keepTrailers = true
+		}
+	}
+
+	removeHopByHopHeaders(req.Header)
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+	if keepTrailers {
+		req.Header.Set("TE", "trailers")
+	}
+
+	// Origin servers expect origin-form ("/path?query"); the authority moves to Host.
+	if req.URL.IsAbs() {
+		req.Host = req.URL.Host
+		req.URL.Scheme = ""
+		req.URL.Host = ""
+	}
+	req.RequestURI = ""
+
+	if h.via != "" {
+		addVia(req.Header, req.ProtoMajor, req.ProtoMinor, h.via)
+	}
+	if h.xForwardedFor {
+		if prior := strings.Join(req.Header.Values("X-Forwarded-For"), ", "); prior != "" {
+			req.Header.Set("X-Forwarded-For", prior+", "+clientIP)
+		} else {
+			req.Header.Set("X-Forwarded-For", clientIP)
+		}
+	}
+	if h.forwarded {
+		node := clientIP
+		if strings.Contains(clientIP, ":") {
+			node = `"[` + clientIP + `]"`
+		}
+		element := "for=" + node + ";proto=http"
+		if req.Host != "" {
+			element += `;host="` + req.Host + `"`
+		}
+		if prior := strings.Join(req.Header.Values("Forwarded"), ", "); prior != "" {
+			element = prior + ", " + element
+		}
+		req.Header.Set("Forwarded", element)
+	}
+}
+
+// rewriteResponse prepares an origin response to be sent back to the client.
+func (h headerRewriter) rewriteResponse(resp *http.Response) {
+	upgrade := ""
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		upgrade = upgradeType(resp.Header)
+	}
+
+	removeHopByHopHeaders(resp.Header)
+	if upgrade != "" {
+		resp.Header.Set("Connection", "Upgrade")
+		resp.Header.Set("Upgrade", upgrade)
+	}
+	if h.via != "" {
+		addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, h.via)
+	}
+}
+
+// addVia appends this proxy to the Via header.
+func addVia(header http.Header, major, minor int, pseudonym string) {
+	entry := fmt.Sprintf("%d.%d %s", major, minor, pseudonym)
+	if prior := strings.Join(header.Values("Via"), ", "); prior != "" {
+		entry = prior + ", " + entry
+	}
+	header.Set("Via", entry)
+}
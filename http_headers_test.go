@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// readTestRequest parses a raw proxy request as the HTTP handler would
+func readTestRequest(t *testing.T, raw string) *http.Request {
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("Failed to parse request: %v", err)
+	}
+	return req
+}
+
+// TestRewriteRequestStripsHopByHopHeaders tests removal of proxy and Connection-listed headers
+func TestRewriteRequestStripsHopByHopHeaders(t *testing.T) {
+	req := readTestRequest(t, "GET http://example.com/path?q=1 HTTP/1.1\r\n"+
+		"Host: ignored.example\r\n"+
+		"Proxy-Connection: keep-alive\r\n"+
+		"Proxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n"+
+		"Connection: X-Private, keep-alive\r\n"+
+		"X-Private: secret\r\n"+
+		"Keep-Alive: timeout=5\r\n"+
+		"TE: trailers, deflate\r\n"+
+		"Accept: */*\r\n\r\n")
+
+	rewriter, _ := newHeaderRewriter(HTTPConfig{})
+	rewriter.rewriteRequest(req, "192.0.2.1")
+
+	for _, name := range []string{"Proxy-Connection", "Proxy-Authorization", "Connection", "X-Private", "Keep-Alive"} {
+		if req.Header.Get(name) != "" {
+			t.Errorf("Expected %s to be stripped", name)
+		}
+	}
+	if req.Header.Get("Accept") != "*/*" {
+		t.Error("Expected end-to-end headers to be kept")
+	}
+	if req.Header.Get("TE") != "trailers" {
+		t.Errorf("Expected TE: trailers to be kept, got %q", req.Header.Get("TE"))
+	}
+	if req.Host != "example.com" || req.URL.RequestURI() != "/path?q=1" || req.URL.IsAbs() {
+		t.Errorf("Expected origin-form request to example.com, got host %q and URL %q", req.Host, req.URL)
+	}
+	if req.Header.Get("Via") != "1.1 proxy" {
+		t.Errorf("Expected default Via header, got %q", req.Header.Get("Via"))
+	}
+}
+
+// TestRewriteRequestKeepsUpgrade tests that protocol upgrades survive hop-by-hop stripping
+func TestRewriteRequestKeepsUpgrade(t *testing.T) {
+	req := readTestRequest(t, "GET http://example.com/ws HTTP/1.1\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+
+	rewriter, _ := newHeaderRewriter(HTTPConfig{Via: "off"})
+	rewriter.rewriteRequest(req, "192.0.2.1")
+
+	if req.Header.Get("Connection") != "Upgrade" || req.Header.Get("Upgrade") != "websocket" {
+		t.Errorf("Expected upgrade headers to be kept, got %v", req.Header)
+	}
+	if req.Header.Get("Via") != "" {
+		t.Error("Expected no Via header when disabled")
+	}
+}
+
+// TestRewriteRequestForwardedHeaders tests X-Forwarded-For and Forwarded generation
+func TestRewriteRequestForwardedHeaders(t *testing.T) {
+	req := readTestRequest(t, "GET http://example.com/ HTTP/1.1\r\n"+
+		"X-Forwarded-For: 198.51.100.7\r\n\r\n")
+
+	rewriter, err := newHeaderRewriter(HTTPConfig{Via: "edge", ForwardedHeaders: "both"})
+	if err != nil {
+		t.Fatalf("Failed to build rewriter: %v", err)
+	}
+	rewriter.rewriteRequest(req, "2001:db8::1")
+
+	if got := req.Header.Get("X-Forwarded-For"); got != "198.51.100.7, 2001:db8::1" {
+		t.Errorf("Unexpected X-Forwarded-For: %q", got)
+	}
+	if got := req.Header.Get("Forwarded"); got != `for="[2001:db8::1]";proto=http;host="example.com"` {
+		t.Errorf("Unexpected Forwarded: %q", got)
+	}
+	if got := req.Header.Get("Via"); got != "1.1 edge" {
+		t.Errorf("Unexpected Via: %q", got)
+	}
+
+	if _, err := newHeaderRewriter(HTTPConfig{ForwardedHeaders: "sometimes"}); err == nil {
+		t.Error("Expected invalid forwarded_headers to be rejected")
+	}
+}
+
+// TestRewriteResponseStripsHopByHopHeaders tests header cleanup in the response direction
+func TestRewriteResponseStripsHopByHopHeaders(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Connection":         {"X-Hop"},
+			"X-Hop":              {"1"},
+			"Proxy-Authenticate": {"Basic"},
+			"Content-Type":       {"text/plain"},
+			"Via":                {"1.1 origin-cache"},
+		},
+	}
+
+	rewriter, _ := newHeaderRewriter(HTTPConfig{})
+	rewriter.rewriteResponse(resp)
+
+	if resp.Header.Get("X-Hop") != "" || resp.Header.Get("Proxy-Authenticate") != "" {
+		t.Errorf("Expected hop-by-hop headers to be stripped, got %v", resp.Header)
+	}
+	if resp.Header.Get("Content-Type") != "text/plain" {
+		t.Error("Expected end-to-end headers to be kept")
+	}
+	if got := resp.Header.Get("Via"); got != "1.1 origin-cache, 1.1 proxy" {
+		t.Errorf("Unexpected Via: %q", got)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// prefixSet is a binary trie of address prefixes. Every address is stored in
+// its 16-byte form, with IPv4 mapped into ::ffff:0:0/96, so that an IPv4
+// client matches its entry whichever socket family it arrived on.
+type prefixSet struct {
+	root prefixNode
+}
+
+type prefixNode struct {
+	children [2]*prefixNode
+	// terminal marks the end of a configured prefix: every address below it matches.
+	terminal bool
+}
+
+// parseAddressPrefix parses an IP address or CIDR range into its normalised 16-byte prefix.
+func parseAddressPrefix(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if !strings.Contains(entry, "/") {
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid address '%s'", entry)
+		}
+		return netip.PrefixFrom(normalizeAddr(addr), 128), nil
+	}
+
+	prefix, err := netip.ParsePrefix(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR range '%s'", entry)
+	}
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+	return netip.PrefixFrom(normalizeAddr(prefix.Addr()), bits).Masked(), nil
+}
+
+// normalizeAddr drops any zone and returns the 16-byte form of addr.
+func normalizeAddr(addr netip.Addr) netip.Addr {
+	return netip.AddrFrom16(addr.Unmap().WithZone("").As16())
+}
+
+// newPrefixSet builds a set from a list of addresses and CIDR ranges.
+func newPrefixSet(entries []string) (*prefixSet, error) {
+	set := &prefixSet{}
+	for _, entry := range entries {
+		prefix, err := parseAddressPrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		set.insert(prefix)
+	}
+	return set, nil
+}
+
+// insert adds prefix to the set. Prefixes already covered by a shorter one are not stored.
+func (s *prefixSet) insert(prefix netip.Prefix) {
+	addr := prefix.Addr().As16()
+	node := &s.root
+	for i := 0; i < prefix.Bits(); i++ {
+		if node.terminal {
+			return
+		}
+		bit := addr[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &prefixNode{}
+		}
+		node = node.children[bit]
+	}
+	node.terminal = true
+	node.children = [2]*prefixNode{}
+}
+
+// contains reports whether addr falls within any prefix of the set.
+func (s *prefixSet) contains(addr netip.Addr) bool {
+	raw := normalizeAddr(addr).As16()
+	node := &s.root
+	for i := 0; node != nil; i++ {
+		if node.terminal {
+			return true
+		}
+		if i == 128 {
+			break
+		}
+		node = node.children[raw[i/8]>>(7-i%8)&1]
+	}
+	return false
+}
+
+// clientFilter decides which client addresses are allowed or denied.
+// Deny entries take precedence over allow entries.
+type clientFilter struct {
+	allowed *prefixSet
+	denied  *prefixSet
+}
+
+// newClientFilter builds a filter from the allowed_ips and denied_ips config lists.
+func newClientFilter(allowed, denied []string) (*clientFilter, error) {
+	allowSet, err := newPrefixSet(allowed)
+	if err != nil {
+		return nil, fmt.Errorf("allowed_ips: %v", err)
+	}
+	denySet, err := newPrefixSet(denied)
+	if err != nil {
+		return nil, fmt.Errorf("denied_ips: %v", err)
+	}
+	return &clientFilter{allowed: allowSet, denied: denySet}, nil
+}
+
+// isDenied reports whether clientIP matches a deny entry. Unparseable addresses are denied.
+func (f *clientFilter) isDenied(clientIP string) bool {
+	addr, err := netip.ParseAddr(clientIP)
+	return err != nil || f.denied.contains(addr)
+}
+
+// isAllowed reports whether clientIP matches an allow entry and no deny entry.
+func (f *clientFilter) isAllowed(clientIP string) bool {
+	addr, err := netip.ParseAddr(clientIP)
+	return err == nil && f.allowed.contains(addr) && !f.denied.contains(addr)
+}
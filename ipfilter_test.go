@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+// TestClientFilter tests CIDR matching, deny precedence and address normalisation
+func TestClientFilter(t *testing.T) {
+	filter, err := newClientFilter(
+		[]string{"10.0.0.0/8", "192.168.1.20", "2001:db8::/32", "::1"},
+		[]string{"10.1.0.0/16", "2001:db8::bad"},
+	)
+	if err != nil {
+		t.Fatalf("Failed to build filter: %v", err)
+	}
+
+	tests := []struct {
+		clientIP string
+		allowed  bool
+		denied   bool
+	}{
+		{"10.2.3.4", true, false},
+		{"10.1.2.3", false, true},
+		{"11.0.0.1", false, false},
+		{"192.168.1.20", true, false},
+		{"192.168.1.21", false, false},
+		{"::ffff:10.2.3.4", true, false},
+		{"::ffff:10.1.2.3", false, true},
+		{"2001:db8:1::5", true, false},
+		{"2001:db8::bad", false, true},
+		{"2001:db9::1", false, false},
+		{"::1", true, false},
+		{"fe80::1%eth0", false, false},
+		{"not-an-ip", false, true},
+	}
+	for _, tt := range tests {
+		if got := filter.isAllowed(tt.clientIP); got != tt.allowed {
+			t.Errorf("isAllowed(%s) = %v, want %v", tt.clientIP, got, tt.allowed)
+		}
+		if got := filter.isDenied(tt.clientIP); got != tt.denied {
+			t.Errorf("isDenied(%s) = %v, want %v", tt.clientIP, got, tt.denied)
+		}
+	}
+}
+
+// TestPrefixSetOverlaps tests that nested and mapped entries collapse correctly
+func TestPrefixSetOverlaps(t *testing.T) {
+	set, err := newPrefixSet([]string{"172.16.5.1", "172.16.0.0/12", "::ffff:203.0.113.0/120", "fe80::1%eth0"})
+	if err != nil {
+		t.Fatalf("Failed to build set: %v", err)
+	}
+	for _, ip := range []string{"172.16.5.1", "172.31.255.255", "203.0.113.9", "fe80::1"} {
+		addr, _ := parseAddressPrefix(ip)
+		if !set.contains(addr.Addr()) {
+			t.Errorf("Expected %s to match", ip)
+		}
+	}
+	addr, _ := parseAddressPrefix("172.32.0.1")
+	if set.contains(addr.Addr()) {
+		t.Error("Expected 172.32.0.1 not to match")
+	}
+
+	for _, entry := range []string{"10.0.0.0/33", "300.1.1.1", "example.com"} {
+		if _, err := newPrefixSet([]string{entry}); err == nil {
+			t.Errorf("Expected %q to be rejected", entry)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// admissionSweepInterval is how often idle per-client and per-user counters are dropped.
+const admissionSweepInterval = time.Minute
+
+// errRateLimited is returned when a connection would exceed a configured limit.
+var errRateLimited = errors.New("connection limit exceeded")
+
+// LimitsConfig caps how many connections clients may hold and open. Client
+// connections count against the global and per-client limits from the moment
+// they are accepted, including while they negotiate or wait between kept-alive
+// requests. Every HTTP request, CONNECT tunnel and SOCKS command of an
+// authenticated user counts against the per-user limits.
+type LimitsConfig struct {
+	// MaxConnections caps the connections in flight across all clients (0: unlimited).
+	MaxConnections int         `yaml:"max_connections"`
+	PerClient      ClientLimit `yaml:"per_client"`
+	PerUser        ClientLimit `yaml:"per_user"`
+}
+
+// ClientLimit caps the connections of one client IP or one authenticated user.
+type ClientLimit struct {
+	// MaxConnections caps concurrent connections (0: unlimited).
+	MaxConnections int `yaml:"max_connections"`
+	// Rate limits new connections per second (0: unlimited).
+	Rate float64 `yaml:"rate"`
+	// Burst is how many connections may be opened at once before Rate applies
+	// (default: Rate rounded up).
+	Burst int `yaml:"burst"`
+}
+
+// validate checks that the limits are not negative.
+func (c LimitsConfig) validate() error {
+	if c.MaxConnections < 0 {
+		return fmt.Errorf("limits max_connections must not be negative")
+	}
+	for name, limit := range map[string]ClientLimit{"per_client": c.PerClient, "per_user": c.PerUser} {
+		if limit.MaxConnections < 0 || limit.Rate < 0 || limit.Burst < 0 {
+			return fmt.Errorf("limits %s values must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// burst returns the configured burst or its default.
+func (l ClientLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// admissionCounter tracks the connections of one client IP or user.
+type admissionCounter struct {
+	active int
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last connection, up to the burst.
+func (c *admissionCounter) refill(limit ClientLimit, now time.Time) {
+	c.tokens = math.Min(limit.burst(), c.tokens+now.Sub(c.last).Seconds()*limit.Rate)
+	c.last = now
+}
+
+// allows reports whether another connection fits within limit, without recording it.
+func (c *admissionCounter) allows(limit ClientLimit) bool {
+	if limit.MaxConnections > 0 && c.active >= limit.MaxConnections {
+		return false
+	}
+	return limit.Rate <= 0 || c.tokens >= 1
+}
+
+// admissionControl counts connections in flight. The counts live outside the
+// configuration so that a reload applies new limits to the existing counts.
+type admissionControl struct {
+	mutex   sync.Mutex
+	total   int
+	clients map[string]*admissionCounter
+	users   map[string]*admissionCounter
+	swept   time.Time
+}
+
+var admissions = &admissionControl{
+	clients: make(map[string]*admissionCounter),
+	users:   make(map[string]*admissionCounter),
+}
+
+// counter returns the counter for key, creating it with a full burst.
+func counter(counters map[string]*admissionCounter, key string, limit ClientLimit, now time.Time) *admissionCounter {
+	c, exists := counters[key]
+	if !exists {
+		c = &admissionCounter{tokens: limit.burst(), last: now}
+		counters[key] = c
+	}
+	c.refill(limit, now)
+	return c
+}
+
+// admitClient records a new client connection from clientIP, or returns
+// errRateLimited if it would exceed the global or per-client limits. The
+// returned function must be called when the connection closes.
+func (a *admissionControl) admitClient(limits LimitsConfig, clientIP string) (release func(), err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	a.sweep(limits, now)
+	if limits.MaxConnections > 0 && a.total >= limits.MaxConnections {
+		return nil, fmt.Errorf("%w: %d connections open", errRateLimited, a.total)
+	}
+	client := counter(a.clients, clientIP, limits.PerClient, now)
+	if !client.allows(limits.PerClient) {
+		return nil, fmt.Errorf("%w for client %s", errRateLimited, clientIP)
+	}
+	a.total++
+	client.active++
+	client.tokens--
+	return a.releaser(func() {
+		a.total--
+		client.active--
+	}), nil
+}
+
+// admitUser records a new request of the authenticated user username, or
+// returns errRateLimited if it would exceed the per-user limits. Anonymous
+// requests are not counted. The returned function must be called when the
+// request ends.
+func (a *admissionControl) admitUser(limits LimitsConfig, username string) (release func(), err error) {
+	if username == "" {
+		return func() {}, nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	a.sweep(limits, now)
+	user := counter(a.users, username, limits.PerUser, now)
+	if !user.allows(limits.PerUser) {
+		return nil, fmt.Errorf("%w for user '%s'", errRateLimited, username)
+	}
+	user.active++
+	user.tokens--
+	return a.releaser(func() { user.active-- }), nil
+}
+
+// releaser returns a function that runs undo under a.mutex, once.
+func (a *admissionControl) releaser(undo func()) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mutex.Lock()
+			defer a.mutex.Unlock()
+			undo()
+		})
+	}
+}
+
+// sweep drops counters with no active connections whose rate tokens have
+// fully refilled, as they are equivalent to new ones. The caller must hold a.mutex.
+func (a *admissionControl) sweep(limits LimitsConfig, now time.Time) {
+	if now.Sub(a.swept) < admissionSweepInterval {
+		return
+	}
+	a.swept = now
+	for _, group := range []struct {
+		counters map[string]*admissionCounter
+		limit    ClientLimit
+	}{{a.clients, limits.PerClient}, {a.users, limits.PerUser}} {
+		for key, c := range group.counters {
+			c.refill(group.limit, now)
+			if c.active == 0 && c.tokens >= group.limit.burst() {
+				delete(group.counters, key)
+			}
+		}
+	}
+}
+
+// admitClient applies the global and per-client connection limits to a newly
+// accepted client connection.
+func (cfg *proxyConfig) admitClient(clientIP string) (release func(), err error) {
+	return admissions.admitClient(cfg.limits, clientIP)
+}
+
+// admit applies the transfer quotas and per-user connection limits to a new request.
+func (cfg *proxyConfig) admit(clientIP, username string) (release func(), err error) {
+	if err := cfg.quotas.check(clientIP, username); err != nil {
+		return nil, err
+	}
+	return admissions.admitUser(cfg.limits, username)
+}
+
+// recordRefused counts a connection refused by admit
+func recordRefused(err error) {
+	stats.mutex.Lock()
+	if errors.Is(err, errQuotaExceeded) {
+		stats.QuotaExceededConnections++
+	} else {
+		stats.RateLimitedConnections++
+	}
+	stats.mutex.Unlock()
+
+	// Signal broadcast update (non-blocking)
+	select {
+	case broadcastChan <- struct{}{}:
+	default:
+		// Channel is full, skip this update to prevent blocking
+	}
+}
+
+// refuseClient answers a client connection refused by admitClient in its
+// protocol: 429 Too Many Requests over HTTP, reply 0x02 over SOCKS5 and
+// 0x5B over SOCKS4. The request is read first so that the client sees the
+// refusal instead of a reset.
+func refuseClient(conn net.Conn, reader *bufio.Reader, protocol string) {
+	switch protocol {
+	case protocolSOCKS5:
+		refuseSocks5(conn, reader)
+	case protocolSOCKS4:
+		if _, err := readSocks4Request(reader); err == nil {
+			conn.Write(socks4Reply(socks4Rejected, nil))
+		}
+	default:
+		if _, err := http.ReadRequest(reader); err != nil {
+			return
+		}
+		resp := httpErrorResponse(http.StatusTooManyRequests)
+		resp.Header.Set("Retry-After", "1")
+		resp.Close = true
+		resp.Write(conn)
+	}
+}
+
+// refuseSocks5 negotiates far enough to read the SOCKS5 request and refuses
+// it with reply 0x02. Offered credentials are accepted unchecked, as the
+// request is refused regardless and checking them would cost a PBKDF2 run.
+func refuseSocks5(conn net.Conn, reader *bufio.Reader) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return
+	}
+	method := byte(noAcceptableMethod)
+	for _, offered := range methods {
+		if offered == noAuth || (offered == userPassAuth && method == noAcceptableMethod) {
+			method = offered
+		}
+	}
+	conn.Write([]byte{socks5Version, method})
+	switch method {
+	case noAcceptableMethod:
+		return
+	case userPassAuth:
+		if _, err := reader.ReadByte(); err != nil {
+			return
+		}
+		if _, err := readLengthPrefixed(reader); err != nil {
+			return
+		}
+		if _, err := readLengthPrefixed(reader); err != nil {
+			return
+		}
+		conn.Write([]byte{userPassVersion, userPassSuccess})
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return
+	}
+	if _, err := readSocks5Address(reader, request[3]); err != nil {
+		return
+	}
+	conn.Write(socks5Reply(socks5RulesetDenied, nil))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestAdmissionConcurrency tests the global, per-client and per-user concurrent connection caps
+func TestAdmissionConcurrency(t *testing.T) {
+	control := &admissionControl{clients: make(map[string]*admissionCounter), users: make(map[string]*admissionCounter)}
+	limits := LimitsConfig{
+		MaxConnections: 3,
+		PerClient:      ClientLimit{MaxConnections: 2},
+		PerUser:        ClientLimit{MaxConnections: 1},
+	}
+
+	first, err := control.admitClient(limits, "192.0.2.1")
+	if err != nil {
+		t.Fatalf("Expected the first connection to be admitted: %v", err)
+	}
+	if _, err := control.admitClient(limits, "192.0.2.1"); err != nil {
+		t.Fatalf("Expected the second connection to be admitted: %v", err)
+	}
+	if _, err := control.admitClient(limits, "192.0.2.1"); !errors.Is(err, errRateLimited) {
+		t.Errorf("Expected the per-client cap to refuse a third connection, got %v", err)
+	}
+	if _, err := control.admitClient(limits, "192.0.2.2"); err != nil {
+		t.Fatalf("Expected another client to be admitted: %v", err)
+	}
+	if _, err := control.admitUser(limits, "alice"); err != nil {
+		t.Fatalf("Expected alice to be admitted: %v", err)
+	}
+	if _, err := control.admitUser(limits, "alice"); !errors.Is(err, errRateLimited) {
+		t.Errorf("Expected the per-user cap to refuse alice's second request, got %v", err)
+	}
+	if _, err := control.admitUser(limits, ""); err != nil {
+		t.Errorf("Expected anonymous requests not to be counted per user: %v", err)
+	}
+	if _, err := control.admitClient(limits, "192.0.2.4"); !errors.Is(err, errRateLimited) {
+		t.Errorf("Expected the global cap to refuse a fourth connection, got %v", err)
+	}
+
+	first()
+	first()
+	if _, err := control.admitClient(limits, "192.0.2.4"); err != nil {
+		t.Errorf("Expected a released slot to be reusable once: %v", err)
+	}
+	if control.total != 3 {
+		t.Errorf("Expected 3 connections in flight, got %d", control.total)
+	}
+}
+
+// TestAdmissionRate tests that new connections are limited to the burst and then the rate
+func TestAdmissionRate(t *testing.T) {
+	control := &admissionControl{clients: make(map[string]*admissionCounter), users: make(map[string]*admissionCounter)}
+	limits := LimitsConfig{PerClient: ClientLimit{Rate: 10, Burst: 3}}
+
+	for i := 0; i < 3; i++ {
+		release, err := control.admitClient(limits, "192.0.2.1")
+		if err != nil {
+			t.Fatalf("Expected connection %d to fit the burst: %v", i+1, err)
+		}
+		release()
+	}
+	if _, err := control.admitClient(limits, "192.0.2.1"); !errors.Is(err, errRateLimited) {
+		t.Errorf("Expected the rate limit to refuse a fourth connection, got %v", err)
+	}
+	other, err := control.admitClient(limits, "192.0.2.2")
+	if err != nil {
+		t.Fatalf("Expected another client to be unaffected: %v", err)
+	}
+	other()
+
+	time.Sleep(150 * time.Millisecond)
+	release, err := control.admitClient(limits, "192.0.2.1")
+	if err != nil {
+		t.Fatalf("Expected a token to be available after 100ms: %v", err)
+	}
+	release()
+
+	control.swept = time.Time{}
+	control.sweep(limits, time.Now().Add(time.Minute))
+	if _, exists := control.clients["192.0.2.1"]; exists || len(control.clients) != 0 {
+		t.Errorf("Expected idle counters to be swept, have %d", len(control.clients))
+	}
+}
+
+// TestAdmissionSilentClient tests that a connection which never sends a byte holds its client's
+// slot, and that refused connections are answered in their protocol
+func TestAdmissionSilentClient(t *testing.T) {
+	cfg, err := newProxyConfig(&Config{
+		AllowedIPs: []string{"127.0.0.1"},
+		Timeouts:   TimeoutConfig{Handshake: 5 * time.Second},
+		Limits:     LimitsConfig{PerClient: ClientLimit{MaxConnections: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	listener := &proxyListener{name: "limits", protocols: map[string]bool{protocolHTTP: true, protocolSOCKS5: true, protocolSOCKS4: true}}
+
+	silent, silentServer := tcpPair(t)
+	defer silent.Close()
+	go handleConnection(silentServer, cfg, listener, false)
+
+	// Wait until the silent connection has been admitted.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		admissions.mutex.Lock()
+		counter := admissions.clients["127.0.0.1"]
+		admitted := counter != nil && counter.active == 1
+		admissions.mutex.Unlock()
+		if admitted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the silent connection to be counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Refused connections are answered in the protocol they speak.
+	for _, refusal := range []struct {
+		protocol string
+		request  []byte
+		reply    []byte
+	}{
+		{"HTTP", []byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"), []byte("HTTP/1.1 429 Too Many Requests\r\nConnection: close\r\nContent-Length: 17\r\nRetry-After: 1\r\n")},
+		{"SOCKS5", []byte{5, 1, noAuth, 5, connectCmd, 0, 1, 127, 0, 0, 1, 0, 80}, []byte{5, noAuth, 5, socks5RulesetDenied}},
+		{"SOCKS5 with credentials", []byte{5, 1, userPassAuth, userPassVersion, 1, 'a', 1, 'b', 5, connectCmd, 0, 1, 127, 0, 0, 1, 0, 80},
+			[]byte{5, userPassAuth, userPassVersion, userPassSuccess, 5, socks5RulesetDenied}},
+		{"SOCKS4", []byte{4, connectCmd, 0, 80, 127, 0, 0, 1, 0}, []byte{socks4ReplyVersion, socks4Rejected}},
+	} {
+		client, server := tcpPair(t)
+		done := make(chan struct{})
+		go func() {
+			handleConnection(server, cfg, listener, false)
+			close(done)
+		}()
+		client.Write(refusal.request)
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		reply, err := io.ReadAll(client)
+		if err != nil || !bytes.HasPrefix(reply, refusal.reply) {
+			t.Errorf("Expected the %s refusal %q, got %q, %v", refusal.protocol, refusal.reply, reply, err)
+		}
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected the refused %s connection to be closed", refusal.protocol)
+		}
+	}
+}
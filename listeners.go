@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+)
+
+// proxyListener accepts clients on one configured address. Listeners are
+// opened at startup; changing them requires a restart.
+type proxyListener struct {
+	name      string
+	address   string
+	protocols map[string]bool
+	listener  net.Listener
+	// tls is set when the listener terminates TLS before protocol detection.
+	tls *tlsFiles
+}
+
+// listenProxy opens the listening socket for a configured listener.
+func listenProxy(config ListenerConfig) (*proxyListener, error) {
+	var files *tlsFiles
+	if config.TLS.enabled() {
+		var err error
+		if files, err = newTLSFiles(config.TLS); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	protocols := make(map[string]bool)
+	for _, protocol := range config.Protocols {
+		protocols[protocol] = true
+	}
+	return &proxyListener{name: config.Name, address: config.Address, protocols: protocols, listener: listener, tls: files}, nil
+}
+
+// allows reports whether protocol is enabled on this listener.
+func (l *proxyListener) allows(protocol string) bool {
+	return l.protocols[protocol]
+}
+
+// serve accepts clients until the listener is closed. Each connection is
+// handled with the configuration that is active when it is accepted, scoped
+// to this listener's access policy.
+func (l *proxyListener) serve() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if debugMode {
+				log.Printf("Failed to accept connection on %s: %v", l.address, err)
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go handleConnection(conn, liveConfig.get().forListener(l.name), l, debugMode)
+	}
+}
@@ -2,68 +2,104 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
-	"strconv"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"gopkg.in/yaml.v2"
 )
 
 const (
-	proxyPort     = "8080"
-	monitorPort   = "8082"
-	socks5Version = 0x05
-	noAuth        = 0x00
-	connectCmd    = 0x01
-	ipv4Addr      = 0x01
-	domainAddr    = 0x03
-	ipv6Addr      = 0x04
+	proxyPort       = "8080"
+	monitorPort     = "8082"
+	socks4Version   = 0x04
+	socks5Version   = 0x05
+	noAuth          = 0x00
+	connectCmd      = 0x01
+	bindCmd         = 0x02
+	udpAssociateCmd = 0x03
+	ipv4Addr        = 0x01
+	domainAddr      = 0x03
+	ipv6Addr        = 0x04
 )
 
-// Config holds the structure of the YAML configuration file.
-type Config struct {
-	AllowedIPs []string `yaml:"allowed_ips"`
-}
-
 // ConnectionInfo holds information about an active connection
 type ConnectionInfo struct {
-	ID            string    `json:"id"`
-	ClientIP      string    `json:"client_ip"`
-	Protocol      string    `json:"protocol"`
-	Destination   string    `json:"destination"`
-	DomainName    string    `json:"domain_name"`
+	ID          string `json:"id"`
+	Listener    string `json:"listener"`
+	ClientIP    string `json:"client_ip"`
+	Username    string `json:"username,omitempty"`
+	Protocol    string `json:"protocol"`
+	Destination string `json:"destination"`
+	DomainName  string `json:"domain_name"`
+	// Route is "direct" or the upstreams the connection is relayed through
+	Route string `json:"route,omitempty"`
+	// Egress is the local address the outgoing connection was made from
+	Egress string `json:"egress,omitempty"`
+	// DialMs is how long connecting to the destination or upstream took
+	DialMs        float64   `json:"dial_ms,omitempty"`
 	StartTime     time.Time `json:"start_time"`
 	Duration      string    `json:"duration"`
 	BytesReceived int64     `json:"bytes_received"`
 	BytesSent     int64     `json:"bytes_sent"`
 	BandwidthIn   float64   `json:"bandwidth_in"`  // bytes per second (current window)
 	BandwidthOut  float64   `json:"bandwidth_out"` // bytes per second (current window)
+	// Configured limits in bytes per second (0: unlimited) and whether each
+	// direction is currently being slowed down to meet them
+	UploadLimit       int64 `json:"upload_limit"`
+	DownloadLimit     int64 `json:"download_limit"`
+	UploadThrottled   bool  `json:"upload_throttled"`
+	DownloadThrottled bool  `json:"download_throttled"`
+	// Why each direction of a tunnel finished, empty while it is open; a tunnel
+	// with one direction finished is half-closed
+	UploadClosed   string `json:"upload_closed,omitempty"`
+	DownloadClosed string `json:"download_closed,omitempty"`
 	// For time-windowed bandwidth calculation
 	LastUpdateTime  time.Time `json:"-"`
 	WindowBytesIn   int64     `json:"-"`
 	WindowBytesOut  int64     `json:"-"`
 	WindowStartTime time.Time `json:"-"`
+	// closer ends the connection when a config reload denies it
+	closer io.Closer
+	// shaper limits the connection's bandwidth
+	shaper *connShaper
 }
 
 // MonitoringStats holds overall statistics
 type MonitoringStats struct {
-	TotalConnections    int                        `json:"total_connections"`
-	ActiveConnections   map[string]*ConnectionInfo `json:"active_connections"`
-	TotalBytesReceived  int64                      `json:"total_bytes_received"`
-	TotalBytesSent      int64                      `json:"total_bytes_sent"`
-	CurrentBandwidthIn  float64                    `json:"current_bandwidth_in"`  // bytes per second
-	CurrentBandwidthOut float64                    `json:"current_bandwidth_out"` // bytes per second
+	TotalConnections   int                        `json:"total_connections"`
+	ActiveConnections  map[string]*ConnectionInfo `json:"active_connections"`
+	TotalBytesReceived int64                      `json:"total_bytes_received"`
+	TotalBytesSent     int64                      `json:"total_bytes_sent"`
+	BlockedConnections int64                      `json:"blocked_connections"`
+	// RateLimitedConnections and QuotaExceededConnections count connections
+	// refused by the connection limits and the transfer quotas
+	RateLimitedConnections   int64 `json:"rate_limited_connections"`
+	QuotaExceededConnections int64 `json:"quota_exceeded_connections"`
+	// QuotaWarnings lists users and clients past their soft or hard quota
+	QuotaWarnings []QuotaUsage `json:"quota_warnings,omitempty"`
+	// UpstreamPools reports the health and traffic share of pool members
+	UpstreamPools []PoolStatus `json:"upstream_pools,omitempty"`
+	// DialLatency aggregates how long connecting to destinations takes
+	DialLatency DialLatencyStats `json:"dial_latency"`
+	// CloseReasons counts ended tunnels by why they ended
+	CloseReasons        map[string]int64 `json:"close_reasons"`
+	CurrentBandwidthIn  float64          `json:"current_bandwidth_in"`  // bytes per second
+	CurrentBandwidthOut float64          `json:"current_bandwidth_out"` // bytes per second
 	mutex               sync.RWMutex
 }
 
@@ -75,9 +111,8 @@ var upgrader = websocket.Upgrader{
 }
 
 var (
-	debugMode      bool
-	monitoringPort string
-	stats          = &MonitoringStats{
+	debugMode bool
+	stats     = &MonitoringStats{
 		ActiveConnections: make(map[string]*ConnectionInfo),
 	}
 	wsClients     = make(map[*websocket.Conn]bool)
@@ -85,27 +120,6 @@ var (
 	broadcastChan = make(chan struct{}, 100) // Buffered channel to prevent blocking
 )
 
-// loadConfig reads the YAML config file and returns a map of allowed IPs for quick lookup.
-func loadConfig(path string) (map[string]bool, error) {
-	allowedIPs := make(map[string]bool)
-	configFile, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("could not read config file '%s': %v", path, err)
-	}
-
-	var config Config
-	err = yaml.Unmarshal(configFile, &config)
-	if err != nil {
-		return nil, fmt.Errorf("could not parse config file: %v", err)
-	}
-
-	for _, ip := range config.AllowedIPs {
-		allowedIPs[ip] = true
-	}
-	log.Printf("Loaded %d allowed IPs from config", len(allowedIPs))
-	return allowedIPs, nil
-}
-
 // reverseDNSLookup attempts to resolve an IP address to a domain name
 func reverseDNSLookup(destination string) string {
 	// Parse the destination to extract just the IP if it contains a port
@@ -138,14 +152,16 @@ func reverseDNSLookup(destination string) string {
 }
 
 // addConnection registers a new connection in the monitoring system
-func addConnection(id, clientIP, protocol, destination string) {
+func addConnection(id, listener, clientIP, username, protocol, destination string) {
 	// Perform reverse DNS lookup for the destination
 	domainName := reverseDNSLookup(destination)
 
 	stats.mutex.Lock()
 	conn := &ConnectionInfo{
 		ID:              id,
+		Listener:        listener,
 		ClientIP:        clientIP,
+		Username:        username,
 		Protocol:        protocol,
 		Destination:     destination,
 		DomainName:      domainName,
@@ -171,11 +187,140 @@ func addConnection(id, clientIP, protocol, destination string) {
 	}
 }
 
+// tunnelCloser closes both ends of a relayed connection, so that neither copy
+// direction stays blocked on the other socket
+type tunnelCloser struct {
+	client, server net.Conn
+}
+
+func (t *tunnelCloser) Close() error {
+	t.client.Close()
+	return t.server.Close()
+}
+
+// attachCloser records how to close a connection when a config reload denies
+// it or it exceeds the idle timeout
+func attachCloser(id string, closer io.Closer) {
+	stats.mutex.Lock()
+	if conn, exists := stats.ActiveConnections[id]; exists {
+		conn.closer = closer
+	}
+	stats.mutex.Unlock()
+}
+
+// attachRoute records the route a connection's destination is dialed through.
+func attachRoute(id, route string) {
+	stats.mutex.Lock()
+	if conn, exists := stats.ActiveConnections[id]; exists {
+		conn.Route = route
+	}
+	stats.mutex.Unlock()
+}
+
+// attachEgress records the local address a connection's outgoing side uses.
+func attachEgress(id, address string) {
+	stats.mutex.Lock()
+	if conn, exists := stats.ActiveConnections[id]; exists {
+		conn.Egress = address
+	}
+	stats.mutex.Unlock()
+}
+
+// attachDial records the local address of a newly dialed outgoing connection
+// and how long dialing took.
+func attachDial(id, address string, elapsed time.Duration) {
+	stats.mutex.Lock()
+	if conn, exists := stats.ActiveConnections[id]; exists {
+		conn.Egress = address
+		conn.DialMs = milliseconds(elapsed)
+	}
+	stats.mutex.Unlock()
+}
+
+// attachDirectionClosed records why the upload (outbound) or download
+// direction of a tunnel finished.
+func attachDirectionClosed(id string, outbound bool, reason string) {
+	stats.mutex.Lock()
+	if conn, exists := stats.ActiveConnections[id]; exists {
+		if outbound {
+			conn.UploadClosed = reason
+		} else {
+			conn.DownloadClosed = reason
+		}
+	}
+	stats.mutex.Unlock()
+}
+
+// startIdleReaper starts a goroutine that closes connections with no traffic
+// in either direction for longer than the idle timeout. Connections sharing a
+// closer, such as the flows of a UDP association, are closed only once all of
+// them are idle. Tunnels enforce the timeout themselves with deadlines.
+func startIdleReaper() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			timeout := liveConfig.get().timeouts.Idle
+			if timeout <= 0 {
+				continue
+			}
+
+			idle := make(map[io.Closer]bool)
+			stats.mutex.RLock()
+			for _, conn := range stats.ActiveConnections {
+				if _, isTunnel := conn.closer.(*tunnel); conn.closer == nil || isTunnel {
+					continue
+				}
+				lastActivity := conn.LastUpdateTime
+				if lastActivity.IsZero() {
+					lastActivity = conn.StartTime
+				}
+				isIdle := now.Sub(lastActivity) > timeout
+				if allIdle, seen := idle[conn.closer]; seen {
+					isIdle = isIdle && allIdle
+				}
+				idle[conn.closer] = isIdle
+			}
+			stats.mutex.RUnlock()
+
+			for closer, isIdle := range idle {
+				if isIdle {
+					if debugMode {
+						log.Printf("Closing connection idle for more than %s", timeout)
+					}
+					closer.Close()
+				}
+			}
+		}
+	}()
+}
+
 // removeConnection removes a connection from the monitoring system
 func removeConnection(id string) {
 	stats.mutex.Lock()
+	var shaper *connShaper
+	if conn, exists := stats.ActiveConnections[id]; exists {
+		shaper = conn.shaper
+	}
 	delete(stats.ActiveConnections, id)
 	stats.mutex.Unlock()
+	if shaper != nil {
+		shaper.release()
+	}
+
+	// Signal broadcast update (non-blocking)
+	select {
+	case broadcastChan <- struct{}{}:
+	default:
+		// Channel is full, skip this update to prevent blocking
+	}
+}
+
+// recordBlocked counts a connection attempt refused by the destination rules
+func recordBlocked() {
+	stats.mutex.Lock()
+	stats.BlockedConnections++
+	stats.mutex.Unlock()
 
 	// Signal broadcast update (non-blocking)
 	select {
@@ -198,6 +343,7 @@ func updateBandwidth(id string, bytesReceived, bytesSent int64) {
 		conn.BytesSent += bytesSent
 		stats.TotalBytesReceived += bytesReceived
 		stats.TotalBytesSent += bytesSent
+		usage.record(conn.ClientIP, conn.Username, bytesReceived+bytesSent)
 
 		// Initialize window if this is the first update
 		if conn.WindowStartTime.IsZero() {
@@ -238,8 +384,12 @@ func updateBandwidth(id string, bytesReceived, bytesSent int64) {
 }
 
 // copyWithTracking copies data between connections while tracking bandwidth
-func copyWithTracking(dst io.Writer, src io.Reader, connID string, isOutbound bool) (written int64, err error) {
-	buffer := make([]byte, 32*1024) // 32KB buffer
+func copyWithTracking(dst io.Writer, src io.Reader, connID string, isOutbound bool, bufferSize int) (written int64, err error) {
+	buffer := make([]byte, bufferSize)
+	shaper := connectionShaper(connID)
+	if shaper != nil {
+		buffer = buffer[:shaper.chunkSize(isOutbound, bufferSize)]
+	}
 	for {
 		nr, er := src.Read(buffer)
 		if nr > 0 {
@@ -252,6 +402,9 @@ func copyWithTracking(dst io.Writer, src io.Reader, connID string, isOutbound bo
 				} else {
 					updateBandwidth(connID, int64(nw), 0)
 				}
+				if shaper != nil {
+					shaper.wait(isOutbound, nw)
+				}
 			}
 			if ew != nil {
 				err = ew
@@ -273,22 +426,39 @@ func copyWithTracking(dst io.Writer, src io.Reader, connID string, isOutbound bo
 }
 
 // getStats returns current statistics (thread-safe)
-func getStats() MonitoringStats {
+func getStats() *MonitoringStats {
+	// These take their own locks and can be slow; build them before locking stats.
+	warnings, pools, latency := quotaWarnings(), poolStatuses(), dialLatencies.stats()
+
 	stats.mutex.RLock()
 	defer stats.mutex.RUnlock()
 
 	now := time.Now()
-	result := MonitoringStats{
-		TotalConnections:   stats.TotalConnections,
-		ActiveConnections:  make(map[string]*ConnectionInfo),
-		TotalBytesReceived: stats.TotalBytesReceived,
-		TotalBytesSent:     stats.TotalBytesSent,
+	result := &MonitoringStats{
+		TotalConnections:         stats.TotalConnections,
+		ActiveConnections:        make(map[string]*ConnectionInfo),
+		TotalBytesReceived:       stats.TotalBytesReceived,
+		TotalBytesSent:           stats.TotalBytesSent,
+		BlockedConnections:       stats.BlockedConnections,
+		RateLimitedConnections:   stats.RateLimitedConnections,
+		QuotaExceededConnections: stats.QuotaExceededConnections,
+		QuotaWarnings:            warnings,
+		UpstreamPools:            pools,
+		DialLatency:              latency,
+		CloseReasons:             make(map[string]int64),
+	}
+	for reason, count := range stats.CloseReasons {
+		result.CloseReasons[reason] = count
 	}
 
 	var totalBandwidthIn, totalBandwidthOut float64
 	for id, conn := range stats.ActiveConnections {
 		connCopy := *conn
 		connCopy.Duration = time.Since(conn.StartTime).Round(time.Second).String()
+		if conn.shaper != nil {
+			connCopy.UploadThrottled = conn.shaper.throttled(true)
+			connCopy.DownloadThrottled = conn.shaper.throttled(false)
+		}
 
 		// Check if connection has been idle for more than 2 seconds
 		if !conn.LastUpdateTime.IsZero() && now.Sub(conn.LastUpdateTime) > 2*time.Second {
@@ -387,22 +557,26 @@ func handleDashboard(w http.ResponseWriter, r *http.Request) {
 }
 
 // startMonitoringServer starts the web monitoring server
-func startMonitoringServer(port string) {
+func startMonitoringServer(address string) {
 	// Create a new ServeMux to avoid conflicts with default handlers
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", handleDashboard)
 	mux.HandleFunc("/ws", handleWebSocket)
 	mux.HandleFunc("/api/stats", handleAPI)
-	
+	mux.HandleFunc("/api/config", handleConfigAPI)
+	mux.HandleFunc("/api/usage", handleUsageAPI)
+	mux.HandleFunc("/api/route", handleRouteAPI)
+
 	// Serve static files (CSS and JS)
 	fs := http.FileServer(http.Dir("static/"))
 	mux.Handle("/static/", http.StripPrefix("/static/", fs))
 
-	log.Printf("Starting monitoring server on port %s", port)
+	_, port, _ := net.SplitHostPort(address)
+	log.Printf("Starting monitoring server on %s", address)
 	log.Printf("Dashboard available at: http://vps.j4.gl:%s", port)
 
 	server := &http.Server{
-		Addr:    ":" + port,
+		Addr:    address,
 		Handler: mux,
 	}
 
@@ -452,8 +626,8 @@ func generateConnectionID() string {
 }
 
 // isPortAvailable checks if a TCP port is available.
-func isPortAvailable(port string) bool {
-	ln, err := net.Listen("tcp", ":"+port)
+func isPortAvailable(address string) bool {
+	ln, err := net.Listen("tcp", address)
 	if err != nil {
 		return false
 	}
@@ -464,53 +638,127 @@ func isPortAvailable(port string) bool {
 func main() {
 	flag.BoolVar(&debugMode, "debug", false, "Enable debug logging for connections")
 	flag.BoolVar(&debugMode, "d", false, "Enable debug logging for connections (shorthand)")
-	flag.StringVar(&monitoringPort, "monitor-port", monitorPort, "Port for the monitoring web interface")
-	flag.StringVar(&monitoringPort, "m", monitorPort, "Port for the monitoring web interface (shorthand)")
+	registerOverrideFlags()
+	configPath := flag.String("config", "", "Path to the config file (env PROXY_CONFIG, default "+defaultConfigPath+")")
+	checkConfigMode := flag.Bool("check-config", false, "Validate the config file, print the effective configuration and exit")
+	hashPasswordMode := flag.Bool("hash-password", false, "Read a password from stdin, print its hash for config.yaml and exit")
+	hashUsername := flag.String("user", "", "With -hash-password, also print HTTP Digest hashes for this username")
 	flag.Parse()
 
-	// Check if proxy port is available
-	if !isPortAvailable(proxyPort) {
-		log.Fatalf("Port %s is already in use.", proxyPort)
+	if *hashPasswordMode {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatalf("Failed to read password: %v", err)
+		}
+		password = strings.TrimRight(password, "\r\n")
+		hash, err := hashPassword(password)
+		if err != nil {
+			log.Fatalf("Failed to hash password: %v", err)
+		}
+		if *hashUsername == "" {
+			fmt.Println(hash)
+			return
+		}
+		fmt.Printf("- username: %q\n", *hashUsername)
+		fmt.Printf("  password_hash: %q\n", hash)
+		fmt.Printf("  digest_ha1: %q\n", computeDigestHA1(md5.New, *hashUsername, password))
+		fmt.Printf("  digest_ha1_sha256: %q\n", computeDigestHA1(sha256.New, *hashUsername, password))
+		return
 	}
 
-	// Check if monitoring port is available
-	if !isPortAvailable(monitoringPort) {
-		log.Fatalf("Monitoring port %s is already in use.", monitoringPort)
+	switch {
+	case *configPath != "":
+		liveConfig.path = *configPath
+	case os.Getenv("PROXY_CONFIG") != "":
+		liveConfig.path = os.Getenv("PROXY_CONFIG")
+	}
+
+	if *checkConfigMode {
+		if err := checkConfig(liveConfig.path); err != nil {
+			fmt.Fprintf(os.Stderr, "Configuration '%s' is invalid: %v\n", liveConfig.path, err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	allowedIPs, err := loadConfig("config.yaml")
+	cfg, err := liveConfig.load()
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Check if monitoring port is available
+	if !isPortAvailable(cfg.monitoring.Address) {
+		log.Fatalf("Monitoring address %s is already in use.", cfg.monitoring.Address)
+	}
+
+	// Open every listener before serving so that a busy port is reported at startup
+	var listeners []*proxyListener
+	for _, config := range cfg.listeners {
+		listener, err := listenProxy(config)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", config.Address, err)
+		}
+		defer listener.listener.Close()
+		listeners = append(listeners, listener)
+	}
+
+	// Account transferred bytes against quotas and keep usage across restarts
+	if err := startQuotaAccounting(cfg); err != nil {
+		log.Fatalf("Failed to open usage store: %v", err)
+	}
+
+	// Save usage before exiting on SIGINT/SIGTERM
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-shutdown
+		stopQuotaAccounting()
+		log.Printf("Received %v, exiting", sig)
+		os.Exit(0)
+	}()
+
+	// Reload the configuration on SIGHUP and when the file changes
+	liveConfig.start()
+
 	// Start broadcast worker for WebSocket updates
 	startBroadcastWorker()
 
-	// Start monitoring server in a separate goroutine
-	go startMonitoringServer(monitoringPort)
+	// Close pooled upstream HTTP connections that stay idle too long
+	startUpstreamReaper()
 
-	listener, err := net.Listen("tcp", ":"+proxyPort)
-	if err != nil {
-		log.Fatalf("Failed to listen on port %s: %v", proxyPort, err)
-	}
-	defer listener.Close()
-	log.Printf("Proxy server listening on port %s", proxyPort)
-	log.Printf("HTTP/HTTPS proxy configuration: http://vps.j4.gl:%s", proxyPort)
-	log.Printf("SOCKS5 proxy configuration: socks5://vps.j4.gl:%s", proxyPort)
+	// Probe the members of upstream pools
+	startHealthChecks()
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			if debugMode {
-				log.Printf("Failed to accept connection: %v", err)
-			}
-			continue
+	// Close tunnels that exceed the idle timeout
+	startIdleReaper()
+
+	// Start monitoring server in a separate goroutine
+	go startMonitoringServer(cfg.monitoring.Address)
+
+	for i, listener := range listeners {
+		_, port, _ := net.SplitHostPort(listener.address)
+		log.Printf("Proxy server listening on %s as '%s' (%s)", listener.address, listener.name, strings.Join(cfg.listeners[i].Protocols, ", "))
+		scheme, transport := "http", ""
+		if listener.tls != nil {
+			scheme, transport = "https", " over TLS"
+		}
+		if listener.allows(protocolHTTP) {
+			log.Printf("HTTP/HTTPS proxy configuration: %s://vps.j4.gl:%s", scheme, port)
 		}
-		go handleConnection(conn, allowedIPs, debugMode)
+		if listener.allows(protocolSOCKS5) {
+			log.Printf("SOCKS5%s proxy configuration: socks5://vps.j4.gl:%s", transport, port)
+		}
+	}
+
+	for _, listener := range listeners[1:] {
+		go listener.serve()
 	}
+	listeners[0].serve()
 }
 
-func handleConnection(conn net.Conn, allowedIPs map[string]bool, debug bool) {
+func handleConnection(conn net.Conn, cfg *proxyConfig, listener *proxyListener, debug bool) {
+	policy := cfg.access
+
 	defer conn.Close()
 
 	clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
@@ -521,16 +769,61 @@ func handleConnection(conn net.Conn, allowedIPs map[string]bool, debug bool) {
 		return
 	}
 
-	if !allowedIPs[clientIP] {
+	if !policy.mayConnect(clientIP) {
 		if debug {
-			log.Printf("Connection from unauthorized IP %s blocked.", clientIP)
+			log.Printf("Connection from unauthorized IP %s on listener %s blocked.", clientIP, listener.name)
 		}
 		return
 	}
 
-	if debug {
+	// The connection counts against the limits from now on, so that clients
+	// cannot hold slots by stalling before or between requests. A refused
+	// client is still answered in its protocol once it has been sniffed.
+	release, refused := cfg.admitClient(clientIP)
+	if refused != nil {
+		if debug {
+			log.Printf("Connection from %s on listener %s refused: %v", clientIP, listener.name, refused)
+		}
+		recordRefused(refused)
+	} else {
+		defer release()
+	}
+
+	if debug && refused == nil {
 		log.Printf("Accepted new client from %s", conn.RemoteAddr())
-		log.Printf("Client %s is authorized.", clientIP)
+		if policy.allowsAnonymous(clientIP) {
+			log.Printf("Client %s is authorized.", clientIP)
+		} else {
+			log.Printf("Client %s must authenticate.", clientIP)
+		}
+	}
+
+	// The client must send its proxy request within the handshake timeout;
+	// handlers clear the deadline once the request has been read.
+	conn.SetDeadline(cfg.timeouts.handshakeDeadline())
+
+	if listener.tls != nil {
+		tlsConn := tls.Server(conn, listener.tls.tlsConfig())
+		if err := tlsConn.Handshake(); err != nil {
+			if debug {
+				log.Printf("TLS handshake with %s on listener %s failed: %v", clientIP, listener.name, err)
+			}
+			return
+		}
+		conn = tlsConn
+		if username := clientCertUser(tlsConn.ConnectionState()); username != "" {
+			policy = policy.withCertUser(username)
+			if policy.certUser == "" {
+				if debug {
+					log.Printf("TLS: Client certificate '%s' from %s does not match a user", username, clientIP)
+				}
+			} else {
+				cfg.access = policy
+				if debug {
+					log.Printf("TLS: Client %s identified by certificate as '%s'", clientIP, username)
+				}
+			}
+		}
 	}
 
 	// Generate unique connection ID
@@ -542,75 +835,191 @@ func handleConnection(conn net.Conn, allowedIPs map[string]bool, debug bool) {
 		return
 	}
 
-	if firstByte[0] == socks5Version {
+	protocol := protocolHTTP
+	switch firstByte[0] {
+	case socks5Version:
+		protocol = protocolSOCKS5
+	case socks4Version:
+		protocol = protocolSOCKS4
+	}
+	if !listener.allows(protocol) {
+		if debug {
+			log.Printf("Protocol %s is not enabled on listener %s, closing connection from %s", protocol, listener.name, clientIP)
+		}
+		return
+	}
+	if refused != nil {
+		refuseClient(conn, reader, protocol)
+		return
+	}
+
+	switch firstByte[0] {
+	case socks5Version:
 		if debug {
 			log.Println("Detected SOCKS5 connection")
 		}
-		handleSocks5(conn, reader, debug, connID, clientIP)
-	} else {
+		handleSocks5(conn, reader, cfg, debug, connID, clientIP)
+	case socks4Version:
+		if debug {
+			log.Println("Detected SOCKS4 connection")
+		}
+		// SOCKS4 has no authentication, so only allow-listed clients and
+		// clients identified by a certificate may use it.
+		if !policy.allowsAnonymous(clientIP) && policy.certUser == "" {
+			if debug {
+				log.Printf("SOCKS4: Client %s is not authorized for unauthenticated access.", clientIP)
+			}
+			return
+		}
+		handleSocks4(conn, reader, cfg, debug, connID, clientIP)
+	default:
 		if debug {
 			log.Println("Detected HTTP connection")
 		}
-		handleHTTP(conn, reader, debug, connID, clientIP)
+		handleHTTP(conn, reader, cfg, debug, connID, clientIP)
 	}
 }
 
-func handleHTTP(clientConn net.Conn, reader *bufio.Reader, debug bool, connID, clientIP string) {
-	req, err := http.ReadRequest(reader)
-	if err != nil {
-		if debug {
-			log.Printf("Failed to read HTTP request: %v", err)
+// handleHTTP serves HTTP proxy requests on a persistent client connection.
+// Plain requests are forwarded one by one, each with its own monitoring entry;
+// a CONNECT request turns the connection into a tunnel.
+func handleHTTP(clientConn net.Conn, reader *bufio.Reader, cfg *proxyConfig, debug bool, connID, clientIP string) {
+	for {
+		// The handshake timeout also bounds how long a kept-alive connection
+		// may wait for its next request.
+		clientConn.SetReadDeadline(cfg.timeouts.handshakeDeadline())
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if debug && err != io.EOF {
+				log.Printf("Failed to read HTTP request: %v", err)
+			}
+			return
 		}
-		return
+		clientConn.SetDeadline(time.Time{})
+
+		// Each request follows the configuration active when it arrives, so
+		// reloaded rules also apply to kept-alive connections.
+		if live := liveConfig.get(); live != nil && live.version != cfg.version {
+			cfg = currentConfig(clientConn, live, cfg.listener)
+			if !cfg.access.mayConnect(clientIP) {
+				if debug {
+					log.Printf("HTTP: Client %s is no longer allowed after a reload, closing connection", clientIP)
+				}
+				return
+			}
+		}
+
+		username, ok, challenge := cfg.access.authenticateHTTP(req, clientIP)
+		if !ok {
+			if debug {
+				log.Printf("HTTP: Proxy authentication required for %s", clientIP)
+			}
+			// The connection can only be reused if the request body is not left unread.
+			challenge.Close = req.Body != nil && req.Body != http.NoBody
+			if err := challenge.Write(clientConn); err != nil || challenge.Close {
+				return
+			}
+			continue
+		}
+		if debug && username != "" {
+			log.Printf("HTTP: Client %s authenticated as '%s'", clientIP, username)
+		}
+
+		release, err := cfg.admit(clientIP, username)
+		if err != nil {
+			if debug {
+				log.Printf("HTTP: %v", err)
+			}
+			recordRefused(err)
+			var resp *http.Response
+			if errors.Is(err, errQuotaExceeded) {
+				resp = httpErrorResponse(http.StatusForbidden)
+			} else {
+				resp = httpErrorResponse(http.StatusTooManyRequests)
+				resp.Header.Set("Retry-After", "1")
+			}
+			// The connection can only be reused if the request body is not left unread.
+			resp.Close = req.Method == "CONNECT" || (req.Body != nil && req.Body != http.NoBody)
+			if err := resp.Write(clientConn); err != nil || resp.Close {
+				return
+			}
+			continue
+		}
+		if req.Method == "CONNECT" {
+			handleHTTPConnect(clientConn, reader, req, cfg, debug, connID, clientIP, username)
+			release()
+			return
+		}
+		keepAlive := forwardHTTPRequest(clientConn, reader, req, cfg, debug, connID, clientIP, username)
+		release()
+		if !keepAlive {
+			return
+		}
+		connID = generateConnectionID()
 	}
+}
 
-	address := req.Host
-	if _, _, err := net.SplitHostPort(address); err != nil {
-		address = net.JoinHostPort(address, "80")
+// currentConfig scopes live to listener and to the user identified by the
+// TLS client certificate of conn, as handleConnection does for new connections.
+func currentConfig(conn net.Conn, live *proxyConfig, listener string) *proxyConfig {
+	cfg := live.forListener(listener)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if username := clientCertUser(tlsConn.ConnectionState()); username != "" {
+			cfg.access = cfg.access.withCertUser(username)
+		}
+	}
+	return cfg
+}
+
+// handleHTTPConnect opens a tunnel for a CONNECT request and relays raw bytes.
+func handleHTTPConnect(clientConn net.Conn, reader *bufio.Reader, req *http.Request, cfg *proxyConfig, debug bool, connID, clientIP, username string) {
+	address := httpDestination(req)
+
+	decision := cfg.routeConnection(clientIP, username, address)
+	if decision.rejected() {
+		if debug {
+			log.Printf("HTTP: Destination '%s' blocked for %s by %s", address, clientIP, decision.Rule)
+		}
+		recordBlocked()
+		httpErrorResponse(http.StatusForbidden).Write(clientConn)
+		return
 	}
 
 	// Register connection in monitoring system
-	addConnection(connID, clientIP, "HTTP", address)
+	addConnection(connID, cfg.listener, clientIP, username, "HTTP", address)
+	attachCloser(connID, clientConn)
+	attachShaper(connID, cfg.shaperFor(clientIP, username, address))
 	defer removeConnection(connID)
 
-	serverConn, err := net.Dial("tcp", address)
+	serverConn, err := cfg.dialDestination(connID, clientIP, address, decision)
 	if err != nil {
 		if debug {
 			log.Printf("Failed to connect to destination '%s': %v", address, err)
 		}
-		resp := &http.Response{
-			StatusCode: http.StatusBadGateway,
-			ProtoMajor: 1,
-			ProtoMinor: 1,
-			Body:       io.NopCloser(strings.NewReader("Bad Gateway")),
+		status := http.StatusBadGateway
+		if errors.Is(err, errDestinationBlocked) {
+			recordBlocked()
+			status = http.StatusForbidden
 		}
-		resp.Write(clientConn)
+		httpErrorResponse(status).Write(clientConn)
 		return
 	}
 	defer serverConn.Close()
+	tunnel := newTunnel(cfg, connID, clientConn, serverConn)
+	attachCloser(connID, tunnel)
 
-	if req.Method == "CONNECT" {
-		fmt.Fprint(clientConn, "HTTP/1.1 200 Connection established\r\n\r\n")
-	} else {
-		err = req.Write(serverConn)
-		if err != nil {
-			if debug {
-				log.Printf("Failed to write request to destination: %v", err)
-			}
-			return
-		}
-	}
+	fmt.Fprint(clientConn, "HTTP/1.1 200 Connection established\r\n\r\n")
 
 	if debug {
 		log.Printf("Relaying data between client and %s", address)
 	}
 
-	// Use tracking copies for bandwidth monitoring
-	go copyWithTracking(serverConn, clientConn, connID, true) // Client to server (outbound)
-	copyWithTracking(clientConn, serverConn, connID, false)   // Server to client (inbound)
+	tunnel.relay(reader, serverConn, cfg.buffers.Relay)
 }
 
-func handleSocks5(clientConn net.Conn, reader *bufio.Reader, debug bool, connID, clientIP string) {
+func handleSocks5(clientConn net.Conn, reader *bufio.Reader, cfg *proxyConfig, debug bool, connID, clientIP string) {
+	policy := cfg.access
+
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(reader, header); err != nil {
 		if debug {
@@ -637,7 +1046,29 @@ func handleSocks5(clientConn net.Conn, reader *bufio.Reader, debug bool, connID,
 		return
 	}
 
-	clientConn.Write([]byte{socks5Version, noAuth})
+	method := policy.selectSocks5Method(clientIP, methods)
+	clientConn.Write([]byte{socks5Version, method})
+	if method == noAcceptableMethod {
+		if debug {
+			log.Printf("SOCKS5: No acceptable authentication method offered by %s", clientIP)
+		}
+		return
+	}
+
+	username := policy.certUser
+	if method == userPassAuth {
+		var err error
+		username, err = socks5UserPassAuth(clientConn, reader, policy.users)
+		if err != nil {
+			if debug {
+				log.Printf("SOCKS5: Authentication failed for %s: %v", clientIP, err)
+			}
+			return
+		}
+		if debug {
+			log.Printf("SOCKS5: Client %s authenticated as '%s'", clientIP, username)
+		}
+	}
 
 	reqHeader := make([]byte, 4)
 	if _, err := io.ReadFull(reader, reqHeader); err != nil {
@@ -647,88 +1078,90 @@ func handleSocks5(clientConn net.Conn, reader *bufio.Reader, debug bool, connID,
 		return
 	}
 
-	if reqHeader[0] != socks5Version || reqHeader[1] != connectCmd {
+	if reqHeader[0] != socks5Version {
 		if debug {
-			log.Printf("SOCKS5: Invalid request. Version: %d, Command: %d", reqHeader[0], reqHeader[1])
+			log.Printf("SOCKS5: Invalid request version: %d", reqHeader[0])
 		}
 		return
 	}
 
-	var host string
-	addrType := reqHeader[3]
-	switch addrType {
-	case ipv4Addr:
-		addr := make([]byte, 4)
-		if _, err := io.ReadFull(reader, addr); err != nil {
-			if debug {
-				log.Printf("SOCKS5: Failed to read IPv4 address: %v", err)
-			}
-			return
-		}
-		host = net.IP(addr).String()
-	case domainAddr:
-		lenByte, err := reader.ReadByte()
-		if err != nil {
-			if debug {
-				log.Printf("SOCKS5: Failed to read domain length: %v", err)
-			}
-			return
+	command := reqHeader[1]
+	if command != connectCmd && command != bindCmd && command != udpAssociateCmd {
+		if debug {
+			log.Printf("SOCKS5: Unsupported command: %d", command)
 		}
-		domain := make([]byte, lenByte)
-		if _, err := io.ReadFull(reader, domain); err != nil {
-			if debug {
-				log.Printf("SOCKS5: Failed to read domain: %v", err)
-			}
-			return
+		clientConn.Write(socks5Reply(socks5CommandNotSupported, nil))
+		return
+	}
+
+	address, err := readSocks5Address(reader, reqHeader[3])
+	if err != nil {
+		if debug {
+			log.Printf("SOCKS5: %v", err)
 		}
-		host = string(domain)
-	case ipv6Addr:
-		addr := make([]byte, 16)
-		if _, err := io.ReadFull(reader, addr); err != nil {
-			if debug {
-				log.Printf("SOCKS5: Failed to read IPv6 address: %v", err)
-			}
-			return
+		if errors.Is(err, errUnsupportedAddrType) {
+			clientConn.Write(socks5Reply(socks5AddrTypeNotSupported, nil))
 		}
-		host = net.IP(addr).String()
-	default:
+		return
+	}
+	clientConn.SetDeadline(time.Time{})
+
+	release, err := cfg.admit(clientIP, username)
+	if err != nil {
 		if debug {
-			log.Printf("SOCKS5: Unknown address type: %d", addrType)
+			log.Printf("SOCKS5: %v", err)
 		}
+		recordRefused(err)
+		clientConn.Write(socks5Reply(socks5RulesetDenied, nil))
 		return
 	}
+	defer release()
 
-	portBytes := make([]byte, 2)
-	if _, err := io.ReadFull(reader, portBytes); err != nil {
+	switch command {
+	case bindCmd:
+		handleSocks5Bind(clientConn, reader, cfg, debug, connID, clientIP, username, address)
+		return
+	case udpAssociateCmd:
+		handleSocks5UDPAssociate(clientConn, reader, cfg, debug, connID, clientIP, username, address)
+		return
+	}
+
+	decision := cfg.routeConnection(clientIP, username, address)
+	if decision.rejected() {
 		if debug {
-			log.Printf("SOCKS5: Failed to read port: %v", err)
+			log.Printf("SOCKS5: Destination '%s' blocked for %s by %s", address, clientIP, decision.Rule)
 		}
+		recordBlocked()
+		clientConn.Write(socks5Reply(socks5RulesetDenied, nil))
 		return
 	}
-	port := binary.BigEndian.Uint16(portBytes)
-	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
 
 	// Register connection in monitoring system
-	addConnection(connID, clientIP, "SOCKS5", address)
+	addConnection(connID, cfg.listener, clientIP, username, "SOCKS5", address)
+	attachCloser(connID, clientConn)
+	attachShaper(connID, cfg.shaperFor(clientIP, username, address))
 	defer removeConnection(connID)
 
-	destConn, err := net.Dial("tcp", address)
+	destConn, err := cfg.dialDestination(connID, clientIP, address, decision)
 	if err != nil {
 		if debug {
 			log.Printf("SOCKS5: Failed to connect to destination '%s': %v", address, err)
 		}
-		clientConn.Write([]byte{0x05, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}) // Host unreachable
+		if errors.Is(err, errDestinationBlocked) {
+			recordBlocked()
+		}
+		clientConn.Write(socks5Reply(socks5ReplyCode(err), nil))
 		return
 	}
 	defer destConn.Close()
+	tunnel := newTunnel(cfg, connID, clientConn, destConn)
+	attachCloser(connID, tunnel)
 
-	clientConn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	clientConn.Write(socks5Reply(socks5Succeeded, destConn.LocalAddr()))
 
 	if debug {
 		log.Printf("SOCKS5: Relaying data for %s", address)
 	}
 
-	// Use tracking copies for bandwidth monitoring
-	go copyWithTracking(destConn, reader, connID, true)   // Client to server (outbound)
-	copyWithTracking(clientConn, destConn, connID, false) // Server to client (inbound)
+	tunnel.relay(reader, destConn, cfg.buffers.Relay)
 }
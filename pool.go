@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pool balancing strategies.
+const (
+	balanceRoundRobin       = "round-robin"
+	balanceLeastConnections = "least-connections"
+	balanceClientHash       = "client-hash"
+)
+
+// Health check types.
+const (
+	healthCheckTCP     = "tcp"
+	healthCheckConnect = "connect"
+)
+
+const (
+	defaultPoolMaxFailures     = 3
+	defaultPoolEjectDuration   = 30 * time.Second
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+)
+
+// Member states reported by the monitoring API.
+const (
+	memberUp      = "up"
+	memberDown    = "down"
+	memberEjected = "ejected"
+)
+
+// UpstreamPoolConfig spreads connections over several upstreams. Routes and
+// destination rules can name a pool wherever they can name an upstream.
+type UpstreamPoolConfig struct {
+	Name string `yaml:"name"`
+	// Members names the upstreams in the pool.
+	Members []string `yaml:"members"`
+	// Balance is round-robin (default), least-connections or client-hash,
+	// which keeps each client on the same member while it is available.
+	Balance     string            `yaml:"balance,omitempty"`
+	HealthCheck HealthCheckConfig `yaml:"health_check,omitempty"`
+	// MaxFailures is how many consecutive failed dials eject a member, and how
+	// many consecutive failed health checks mark it down (default 3).
+	MaxFailures int `yaml:"max_failures,omitempty"`
+	// EjectDuration is how long an ejected member is skipped (default 30s).
+	EjectDuration time.Duration `yaml:"eject_duration,omitempty"`
+}
+
+// HealthCheckConfig probes pool members in the background.
+type HealthCheckConfig struct {
+	// Type is "tcp" to connect to the member, or "connect" to open a tunnel
+	// to Target through it. Empty disables active checks.
+	Type     string        `yaml:"type,omitempty"`
+	Target   string        `yaml:"target,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Timeout  time.Duration `yaml:"timeout,omitempty"`
+}
+
+// memberState is the health and traffic of one pool member. It outlives
+// configuration reloads that keep the member, so that a reload does not
+// reset health or counters.
+type memberState struct {
+	mutex         sync.Mutex
+	down          bool // failed max_failures health checks in a row
+	checkFailures int
+	dialFailures  int
+	ejectedUntil  time.Time
+	checking      bool
+	lastCheck     time.Time
+	lastError     string
+
+	active      atomic.Int64
+	connections atomic.Int64
+	bytes       atomic.Int64
+}
+
+// poolState holds the member states and round-robin position of a pool.
+// Members are keyed by memberKey, so that an upstream that is redefined with
+// another URL starts with a fresh state.
+type poolState struct {
+	next    atomic.Uint64
+	mutex   sync.Mutex
+	members map[string]*memberState
+}
+
+// poolStates keeps the state of every pool by name across reloads.
+var poolStates = struct {
+	mutex sync.Mutex
+	pools map[string]*poolState
+}{pools: make(map[string]*poolState)}
+
+// memberKey identifies a pool member by its name and the hops it is reached through.
+func memberKey(name string, route upstreamRoute) string {
+	key := name
+	for _, hop := range route {
+		key += " " + hop.scheme + "://" + hop.address
+	}
+	return key
+}
+
+// statesFor returns the persistent state of a pool and of its members by key.
+func statesFor(pool string, keys []string) (*poolState, []*memberState) {
+	poolStates.mutex.Lock()
+	state, exists := poolStates.pools[pool]
+	if !exists {
+		state = &poolState{members: make(map[string]*memberState)}
+		poolStates.pools[pool] = state
+	}
+	poolStates.mutex.Unlock()
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	result := make([]*memberState, len(keys))
+	for i, key := range keys {
+		if state.members[key] == nil {
+			state.members[key] = &memberState{}
+		}
+		result[i] = state.members[key]
+	}
+	return state, result
+}
+
+// retainPoolStates drops the state of pools and members that are not in
+// pools, the pools of the configuration now active.
+func retainPoolStates(pools map[string]*proxyPool) {
+	poolStates.mutex.Lock()
+	defer poolStates.mutex.Unlock()
+
+	kept := make(map[string]*poolState)
+	for name, pool := range pools {
+		members := make(map[string]*memberState)
+		for _, member := range pool.members {
+			members[memberKey(member.name, member.route)] = member.state
+		}
+		pool.state.mutex.Lock()
+		pool.state.members = members
+		pool.state.mutex.Unlock()
+		kept[name] = pool.state
+	}
+	poolStates.pools = kept
+}
+
+// poolMember is an upstream in a pool.
+type poolMember struct {
+	name  string
+	route upstreamRoute
+	state *memberState
+}
+
+// proxyPool is the runtime form of UpstreamPoolConfig.
+type proxyPool struct {
+	name          string
+	balance       string
+	members       []*poolMember
+	check         HealthCheckConfig
+	maxFailures   int
+	ejectDuration time.Duration
+	state         *poolState
+}
+
+// newUpstreamPools builds the pools from their settings. routes holds the
+// chain of every defined upstream; pool names must not clash with them.
+func newUpstreamPools(configs []UpstreamPoolConfig, routes map[string]upstreamRoute) (map[string]*proxyPool, error) {
+	pools := make(map[string]*proxyPool)
+	for _, config := range configs {
+		if config.Name == "" || config.Name == routeDirect {
+			return nil, fmt.Errorf("upstream pool name must be set and not '%s'", routeDirect)
+		}
+		if _, exists := routes[config.Name]; exists {
+			return nil, fmt.Errorf("upstream pool '%s': name is already used by an upstream", config.Name)
+		}
+		if _, exists := pools[config.Name]; exists {
+			return nil, fmt.Errorf("duplicate upstream pool name '%s'", config.Name)
+		}
+		if len(config.Members) == 0 {
+			return nil, fmt.Errorf("upstream pool '%s': no members", config.Name)
+		}
+		pool := &proxyPool{
+			name:          config.Name,
+			balance:       config.Balance,
+			check:         config.HealthCheck,
+			maxFailures:   config.MaxFailures,
+			ejectDuration: config.EjectDuration,
+		}
+		switch pool.balance {
+		case "":
+			pool.balance = balanceRoundRobin
+		case balanceRoundRobin, balanceLeastConnections, balanceClientHash:
+		default:
+			return nil, fmt.Errorf("upstream pool '%s': invalid balance '%s', expected %s, %s or %s",
+				config.Name, config.Balance, balanceRoundRobin, balanceLeastConnections, balanceClientHash)
+		}
+		switch pool.check.Type {
+		case "", healthCheckTCP:
+		case healthCheckConnect:
+			if _, _, ok := splitDestination(pool.check.Target); !ok {
+				return nil, fmt.Errorf("upstream pool '%s': connect health check needs a host:port target", config.Name)
+			}
+		default:
+			return nil, fmt.Errorf("upstream pool '%s': invalid health check type '%s', expected tcp or connect",
+				config.Name, pool.check.Type)
+		}
+		if pool.maxFailures < 0 || pool.ejectDuration < 0 || pool.check.Interval < 0 || pool.check.Timeout < 0 {
+			return nil, fmt.Errorf("upstream pool '%s': values must not be negative", config.Name)
+		}
+		if pool.maxFailures == 0 {
+			pool.maxFailures = defaultPoolMaxFailures
+		}
+		if pool.ejectDuration == 0 {
+			pool.ejectDuration = defaultPoolEjectDuration
+		}
+		if pool.check.Interval == 0 {
+			pool.check.Interval = defaultHealthCheckInterval
+		}
+		if pool.check.Timeout == 0 {
+			pool.check.Timeout = defaultHealthCheckTimeout
+		}
+
+		keys := make([]string, len(config.Members))
+		for i, name := range config.Members {
+			route, exists := routes[name]
+			if !exists {
+				return nil, fmt.Errorf("upstream pool '%s': unknown upstream '%s'", config.Name, name)
+			}
+			keys[i] = memberKey(name, route)
+			pool.members = append(pool.members, &poolMember{name: name, route: route})
+		}
+		var states []*memberState
+		pool.state, states = statesFor(config.Name, keys)
+		for i, member := range pool.members {
+			member.state = states[i]
+		}
+		pools[config.Name] = pool
+	}
+	return pools, nil
+}
+
+// status returns the member's state at now.
+func (m *poolMember) status(now time.Time) string {
+	m.state.mutex.Lock()
+	defer m.state.mutex.Unlock()
+	switch {
+	case m.state.down:
+		return memberDown
+	case now.Before(m.state.ejectedUntil):
+		return memberEjected
+	default:
+		return memberUp
+	}
+}
+
+// order returns the available members in the order they should be tried for
+// a connection from clientIP: the balancing choice first, then the failover
+// candidates.
+func (p *proxyPool) order(clientIP string) []*poolMember {
+	now := time.Now()
+	var available []*poolMember
+	for _, member := range p.members {
+		if member.status(now) == memberUp {
+			available = append(available, member)
+		}
+	}
+	if len(available) == 0 {
+		return nil
+	}
+
+	switch p.balance {
+	case balanceLeastConnections:
+		sort.SliceStable(available, func(i, j int) bool {
+			return available[i].state.active.Load() < available[j].state.active.Load()
+		})
+	case balanceClientHash:
+		// Rendezvous hashing: a client only moves when its member becomes unavailable.
+		score := func(member *poolMember) uint64 {
+			hash := fnv.New64a()
+			hash.Write([]byte(clientIP + "\x00" + member.name))
+			return hash.Sum64()
+		}
+		sort.Slice(available, func(i, j int) bool { return score(available[i]) > score(available[j]) })
+	default:
+		start := int(p.state.next.Add(1)-1) % len(available)
+		available = append(available[start:], available[:start]...)
+	}
+	return available
+}
+
+// dial connects to address through the pool, failing over to the next
+// member when one cannot be reached. Members are ejected after max_failures
+// consecutive failed dials. A refusal by the destination is returned at once,
+// as other members would not fare better.
+func (p *proxyPool) dial(ctx context.Context, connID, clientIP, address string, egress *egressPolicy) (net.Conn, error) {
+	members := p.order(clientIP)
+	if len(members) == 0 {
+		return nil, fmt.Errorf("upstream pool '%s': no healthy upstream", p.name)
+	}
+	var err error
+	for _, member := range members {
+		attachRoute(connID, p.name+": "+member.route.String())
+		var conn net.Conn
+		conn, err = member.route.dial(ctx, egress, address)
+		if err == nil || errors.Is(err, errConnectRefused) {
+			member.dialSucceeded()
+		}
+		if err == nil {
+			return member.track(conn), nil
+		}
+		if errors.Is(err, errConnectRefused) || ctx.Err() != nil {
+			return nil, err
+		}
+		member.dialFailed(p, err)
+	}
+	return nil, err
+}
+
+// dialSucceeded resets the member's consecutive dial failures.
+func (m *poolMember) dialSucceeded() {
+	m.state.mutex.Lock()
+	m.state.dialFailures = 0
+	m.state.mutex.Unlock()
+}
+
+// dialFailed counts a failed dial and ejects the member after max_failures in a row.
+func (m *poolMember) dialFailed(p *proxyPool, err error) {
+	m.state.mutex.Lock()
+	defer m.state.mutex.Unlock()
+	m.state.dialFailures++
+	m.state.lastError = err.Error()
+	if m.state.dialFailures >= p.maxFailures {
+		m.state.dialFailures = 0
+		m.state.ejectedUntil = time.Now().Add(p.ejectDuration)
+		log.Printf("Upstream pool '%s': ejecting '%s' for %v after %d failed connections: %v",
+			p.name, m.name, p.ejectDuration, p.maxFailures, err)
+	}
+}
+
+// memberConn counts the traffic of a connection through a pool member.
+type memberConn struct {
+	net.Conn
+	state  *memberState
+	mutex  sync.Mutex // guards idle and closed
+	idle   bool
+	closed bool
+}
+
+// track counts conn as an active connection of the member until it is closed.
+func (m *poolMember) track(conn net.Conn) net.Conn {
+	m.state.active.Add(1)
+	m.state.connections.Add(1)
+	return &memberConn{Conn: conn, state: m.state}
+}
+
+// setIdle stops counting the connection as active while it waits in the
+// keep-alive pool, and counts it again once it is taken out.
+func (c *memberConn) setIdle(idle bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed || c.idle == idle {
+		return
+	}
+	c.idle = idle
+	if idle {
+		c.state.active.Add(-1)
+	} else {
+		c.state.active.Add(1)
+	}
+}
+
+func (c *memberConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.state.bytes.Add(int64(n))
+	return n, err
+}
+
+func (c *memberConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.state.bytes.Add(int64(n))
+	return n, err
+}
+
+func (c *memberConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *memberConn) Close() error {
+	c.mutex.Lock()
+	if !c.closed {
+		c.closed = true
+		if !c.idle {
+			c.state.active.Add(-1)
+		}
+	}
+	c.mutex.Unlock()
+	return c.Conn.Close()
+}
+
+// startHealthChecks probes the members of pools with a health check at
+// their configured interval from the default egress, following configuration
+// reloads.
+func startHealthChecks() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			now := time.Now()
+			cfg := liveConfig.get()
+			for _, pool := range cfg.pools {
+				if pool.check.Type == "" {
+					continue
+				}
+				for _, member := range pool.members {
+					if member.checkDue(pool.check.Interval, now) {
+						go member.probe(pool, cfg.egress)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// checkDue reports whether the member should be probed now and, if so, marks
+// the check as in progress.
+func (m *poolMember) checkDue(interval time.Duration, now time.Time) bool {
+	m.state.mutex.Lock()
+	defer m.state.mutex.Unlock()
+	if m.state.checking || now.Sub(m.state.lastCheck) < interval {
+		return false
+	}
+	m.state.checking = true
+	return true
+}
+
+// probe runs one health check against the member and records the result.
+// A member is marked down after max_failures failed checks in a row and up
+// again after one successful check.
+func (m *poolMember) probe(p *proxyPool, egress *egressPolicy) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.check.Timeout)
+	defer cancel()
+
+	var conn net.Conn
+	var err error
+	if p.check.Type == healthCheckConnect {
+		conn, err = m.route.dial(ctx, egress, p.check.Target)
+	} else {
+		conn, err = egress.dial(ctx, m.route[0].address)
+	}
+	if err == nil {
+		conn.Close()
+	}
+
+	m.state.mutex.Lock()
+	defer m.state.mutex.Unlock()
+	m.state.checking = false
+	m.state.lastCheck = time.Now()
+	if err == nil {
+		if m.state.down {
+			log.Printf("Upstream pool '%s': '%s' is up", p.name, m.name)
+		}
+		m.state.down = false
+		m.state.checkFailures = 0
+		m.state.lastError = ""
+		return
+	}
+	m.state.lastError = err.Error()
+	m.state.checkFailures++
+	if !m.state.down && m.state.checkFailures >= p.maxFailures {
+		m.state.down = true
+		log.Printf("Upstream pool '%s': '%s' is down after %d failed health checks: %v", p.name, m.name, m.state.checkFailures, err)
+	}
+}
+
+// PoolStatus reports the members of an upstream pool in the monitoring API.
+type PoolStatus struct {
+	Name    string             `json:"name"`
+	Balance string             `json:"balance"`
+	Members []PoolMemberStatus `json:"members"`
+}
+
+// PoolMemberStatus is the health and traffic of one pool member. Share is
+// the member's percentage of the connections the pool has made.
+type PoolMemberStatus struct {
+	Name        string    `json:"name"`
+	Route       string    `json:"route"`
+	State       string    `json:"state"`
+	Active      int64     `json:"active"`
+	Connections int64     `json:"connections"`
+	Bytes       int64     `json:"bytes"`
+	Share       float64   `json:"share"`
+	LastCheck   time.Time `json:"last_check,omitzero"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// poolStatuses reports every pool of the current configuration, by name.
+func poolStatuses() []PoolStatus {
+	cfg := liveConfig.get()
+	if cfg == nil {
+		return nil
+	}
+	now := time.Now()
+	var result []PoolStatus
+	for _, pool := range cfg.pools {
+		status := PoolStatus{Name: pool.name, Balance: pool.balance}
+		var total int64
+		for _, member := range pool.members {
+			memberStatus := PoolMemberStatus{
+				Name:        member.name,
+				Route:       member.route.String(),
+				State:       member.status(now),
+				Active:      member.state.active.Load(),
+				Connections: member.state.connections.Load(),
+				Bytes:       member.state.bytes.Load(),
+			}
+			member.state.mutex.Lock()
+			memberStatus.LastCheck = member.state.lastCheck
+			memberStatus.LastError = member.state.lastError
+			member.state.mutex.Unlock()
+			total += memberStatus.Connections
+			status.Members = append(status.Members, memberStatus)
+		}
+		for i := range status.Members {
+			if total > 0 {
+				status.Members[i].Share = float64(status.Members[i].Connections) * 100 / float64(total)
+			}
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
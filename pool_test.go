@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deadAddress returns a local address nothing listens on
+func deadAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener.Close()
+	return listener.Addr().String()
+}
+
+// withPoolStates replaces the pool state registry with an empty one for the duration of a test
+func withPoolStates(t *testing.T) {
+	poolStates.mutex.Lock()
+	saved := poolStates.pools
+	poolStates.pools = make(map[string]*poolState)
+	poolStates.mutex.Unlock()
+	t.Cleanup(func() {
+		poolStates.mutex.Lock()
+		poolStates.pools = saved
+		poolStates.mutex.Unlock()
+	})
+}
+
+// TestUpstreamPoolConfig tests pool validation and that routes can name a pool
+func TestUpstreamPoolConfig(t *testing.T) {
+	withPoolStates(t)
+	config := &Config{
+		Upstreams: []UpstreamConfig{
+			{Name: "a", URL: "http://a.test:3128"},
+			{Name: "b", URL: "http://b.test:3128"},
+		},
+		UpstreamPools: []UpstreamPoolConfig{{Name: "config-pool", Members: []string{"a", "b"}}},
+		Routes:        []RouteRule{{Hosts: []string{"*.example.com"}, Action: "upstream", Upstream: "config-pool"}},
+		Destinations:  DestinationConfig{Upstream: "config-pool"},
+	}
+	cfg, err := newProxyConfig(config)
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	pool := cfg.pools["config-pool"]
+	if pool.balance != balanceRoundRobin || pool.maxFailures != defaultPoolMaxFailures || pool.ejectDuration != defaultPoolEjectDuration {
+		t.Errorf("Expected pool defaults, got %+v", pool)
+	}
+	for _, address := range []string{"www.example.com:443", "other.test:443"} {
+		if decision := cfg.routeConnection("192.0.2.1", "", address); decision.Route != "pool 'config-pool'" || decision.pool != pool {
+			t.Errorf("Expected %s to use the pool, got %+v", address, decision)
+		}
+	}
+
+	for _, pools := range [][]UpstreamPoolConfig{
+		{{Name: "a", Members: []string{"b"}}},
+		{{Name: "direct", Members: []string{"a"}}},
+		{{Name: "p", Members: []string{"missing"}}},
+		{{Name: "p"}},
+		{{Name: "p", Members: []string{"a"}, Balance: "random"}},
+		{{Name: "p", Members: []string{"a"}, HealthCheck: HealthCheckConfig{Type: "connect"}}},
+		{{Name: "p", Members: []string{"a"}, HealthCheck: HealthCheckConfig{Type: "icmp"}}},
+		{{Name: "p", Members: []string{"a"}}, {Name: "p", Members: []string{"b"}}},
+	} {
+		config.UpstreamPools = pools
+		config.Routes, config.Destinations = nil, DestinationConfig{}
+		if _, err := newProxyConfig(config); err == nil {
+			t.Errorf("Expected %+v to be rejected", pools)
+		}
+	}
+}
+
+// TestPoolBalancing tests the order members are tried in for each balancing strategy
+func TestPoolBalancing(t *testing.T) {
+	withPoolStates(t)
+	routes, _ := newUpstreamRoutes([]UpstreamConfig{
+		{Name: "a", URL: "http://a.test:3128"},
+		{Name: "b", URL: "http://b.test:3128"},
+		{Name: "c", URL: "http://c.test:3128"},
+	})
+	pools, err := newUpstreamPools([]UpstreamPoolConfig{
+		{Name: "balance-rr", Members: []string{"a", "b", "c"}},
+		{Name: "balance-least", Members: []string{"a", "b", "c"}, Balance: balanceLeastConnections},
+		{Name: "balance-hash", Members: []string{"a", "b", "c"}, Balance: balanceClientHash},
+	}, routes)
+	if err != nil {
+		t.Fatalf("Failed to build pools: %v", err)
+	}
+
+	var first []string
+	for i := 0; i < 3; i++ {
+		order := pools["balance-rr"].order("192.0.2.1")
+		if len(order) != 3 {
+			t.Fatalf("Expected all members to be available, got %d", len(order))
+		}
+		first = append(first, order[0].name)
+	}
+	if first[0] == first[1] || first[1] == first[2] || first[0] == first[2] {
+		t.Errorf("Expected round-robin to start with each member in turn, got %v", first)
+	}
+
+	least := pools["balance-least"]
+	least.members[0].state.active.Store(2)
+	least.members[2].state.active.Store(1)
+	if order := least.order(""); order[0].name != "b" || order[1].name != "c" || order[2].name != "a" {
+		t.Errorf("Expected members by active connections, got %s %s %s", order[0].name, order[1].name, order[2].name)
+	}
+
+	hash := pools["balance-hash"]
+	chosen := hash.order("192.0.2.7")[0]
+	if again := hash.order("192.0.2.7")[0]; again != chosen {
+		t.Errorf("Expected a client to stay on %s, got %s", chosen.name, again.name)
+	}
+	chosen.state.ejectedUntil = time.Now().Add(time.Minute)
+	order := hash.order("192.0.2.7")
+	if len(order) != 2 || order[0] == chosen {
+		t.Errorf("Expected the client to move off the ejected member %s", chosen.name)
+	}
+}
+
+// TestPoolFailover tests failover, passive ejection and health checks
+func TestPoolFailover(t *testing.T) {
+	withPoolStates(t)
+	echo := serveTest(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	routes, err := newUpstreamRoutes([]UpstreamConfig{
+		{Name: "dead", URL: "http://" + deadAddress(t)},
+		{Name: "live", URL: "http://" + fakeHTTPUpstream(t, "")},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build routes: %v", err)
+	}
+	pools, err := newUpstreamPools([]UpstreamPoolConfig{{
+		Name:        "failover",
+		Members:     []string{"dead", "live"},
+		Balance:     balanceLeastConnections,
+		HealthCheck: HealthCheckConfig{Type: healthCheckTCP},
+		MaxFailures: 1,
+	}}, routes)
+	if err != nil {
+		t.Fatalf("Failed to build pools: %v", err)
+	}
+	pool := pools["failover"]
+	dead, live := pool.members[0], pool.members[1]
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := pool.dial(ctx, "", "192.0.2.1", echo, nil)
+	if err != nil {
+		t.Fatalf("Expected failover to the live member: %v", err)
+	}
+	conn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Errorf("Expected the echo through the live member, got %q, %v", reply, err)
+	}
+	if status := dead.status(time.Now()); status != memberEjected {
+		t.Errorf("Expected the dead member to be ejected, got %s", status)
+	}
+	if live.state.active.Load() != 1 || live.state.connections.Load() != 1 || live.state.bytes.Load() != 8 {
+		t.Errorf("Unexpected live member traffic: active %d, connections %d, bytes %d",
+			live.state.active.Load(), live.state.connections.Load(), live.state.bytes.Load())
+	}
+
+	idle := &upstreamPool{idle: make(map[string][]*upstreamConn)}
+	idle.put(echo, &upstreamConn{conn: conn})
+	if active := live.state.active.Load(); active != 0 {
+		t.Errorf("Expected an idle pooled connection not to be active, got %d", active)
+	}
+	if idle.get(echo) == nil || live.state.active.Load() != 1 {
+		t.Errorf("Expected a connection taken from the pool to be active, got %d", live.state.active.Load())
+	}
+	conn.Close()
+	conn.Close()
+	if active := live.state.active.Load(); active != 0 {
+		t.Errorf("Expected no active connections after close, got %d", active)
+	}
+
+	dead.probe(pool, nil)
+	live.probe(pool, nil)
+	if dead.status(time.Now()) != memberDown || live.status(time.Now()) != memberUp {
+		t.Errorf("Expected health checks to mark dead down and live up, got %s and %s",
+			dead.status(time.Now()), live.status(time.Now()))
+	}
+	live.state.down = true
+	if _, err := pool.dial(ctx, "", "192.0.2.1", echo, nil); err == nil {
+		t.Error("Expected a pool without available members to fail")
+	}
+}
+
+// TestPoolRefusalNoFailover tests that a destination refused by a member is not retried on others
+func TestPoolRefusalNoFailover(t *testing.T) {
+	withPoolStates(t)
+	routes, _ := newUpstreamRoutes([]UpstreamConfig{
+		{Name: "strict", URL: "http://" + fakeHTTPUpstream(t, "Basic secret")},
+		{Name: "other", URL: "http://" + fakeHTTPUpstream(t, "Basic secret")},
+	})
+	pools, err := newUpstreamPools([]UpstreamPoolConfig{{Name: "refusal", Members: []string{"strict", "other"}, MaxFailures: 1}}, routes)
+	if err != nil {
+		t.Fatalf("Failed to build pools: %v", err)
+	}
+	pool := pools["refusal"]
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := pool.dial(ctx, "", "192.0.2.1", "www.example.com:443", nil); !errors.Is(err, errConnectRefused) {
+		t.Errorf("Expected the upstream's refusal, got %v", err)
+	}
+	for _, member := range pool.members {
+		if status := member.status(time.Now()); status != memberUp {
+			t.Errorf("Expected %s to stay up after a refusal, got %s", member.name, status)
+		}
+	}
+}
+
+// TestPoolStateReload tests that member state follows the upstream's URL and is dropped with its
+// pool, and that a member never checked reports no last check
+func TestPoolStateReload(t *testing.T) {
+	withPoolStates(t)
+	build := func(url string, pools ...string) map[string]*proxyPool {
+		routes, _ := newUpstreamRoutes([]UpstreamConfig{{Name: "a", URL: url}})
+		var configs []UpstreamPoolConfig
+		for _, name := range pools {
+			configs = append(configs, UpstreamPoolConfig{Name: name, Members: []string{"a"}})
+		}
+		built, err := newUpstreamPools(configs, routes)
+		if err != nil {
+			t.Fatalf("Failed to build pools: %v", err)
+		}
+		return built
+	}
+
+	first := build("http://a.test:3128", "kept", "removed")
+	retainPoolStates(first)
+	first["kept"].members[0].state.ejectedUntil = time.Now().Add(time.Minute)
+
+	if same := build("http://a.test:3128", "kept"); same["kept"].members[0].state != first["kept"].members[0].state {
+		t.Error("Expected an unchanged member to keep its state")
+	}
+	moved := build("http://a2.test:3128", "kept")
+	if status := moved["kept"].members[0].status(time.Now()); status != memberUp {
+		t.Errorf("Expected a member with a new URL to start up, got %s", status)
+	}
+
+	retainPoolStates(moved)
+	poolStates.mutex.Lock()
+	_, removed := poolStates.pools["removed"]
+	kept := poolStates.pools["kept"]
+	poolStates.mutex.Unlock()
+	if removed || kept == nil || len(kept.members) != 1 {
+		t.Errorf("Expected only the active pool and member to be kept, got removed=%v kept=%+v", removed, kept)
+	}
+
+	if encoded, _ := json.Marshal(PoolMemberStatus{Name: "a"}); strings.Contains(string(encoded), "last_check") {
+		t.Errorf("Expected no last_check for a member never checked, got %s", encoded)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQuotaFlushInterval = 30 * time.Second
+	defaultQuotaWarnPercent   = 80
+	quotaEnforceInterval      = time.Second
+	usageDayFormat            = "2006-01-02"
+	usageMonthFormat          = "2006-01"
+	// Usage older than this is dropped when the store is written.
+	usageRetentionDays   = 62
+	usageRetentionMonths = 24
+)
+
+// Principal kinds that usage is accounted to.
+const (
+	principalUser   = "user"
+	principalClient = "client"
+)
+
+// Quota states reported by the usage API and the dashboard.
+const (
+	quotaOK       = "ok"
+	quotaWarning  = "warning"
+	quotaExceeded = "exceeded"
+)
+
+// errQuotaExceeded is returned when a principal has used up its transfer quota.
+var errQuotaExceeded = errors.New("data transfer quota exceeded")
+
+// QuotaConfig configures daily and monthly data transfer quotas. Bytes in both
+// directions count; a connection counts against its user and its client IP.
+type QuotaConfig struct {
+	// Store is the JSON file usage is kept in across restarts; empty keeps usage
+	// in memory only. It is read at startup.
+	Store string `yaml:"store"`
+	// FlushInterval is how often usage is written to the store (default 30s).
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// CloseActive closes active connections once their quota is exceeded.
+	CloseActive bool       `yaml:"close_active"`
+	PerUser     QuotaLimit `yaml:"per_user"`
+	PerClient   QuotaLimit `yaml:"per_client"`
+}
+
+// QuotaLimit is the hard limit per calendar day and month. Zero means unlimited.
+type QuotaLimit struct {
+	Daily   byteSize `yaml:"daily,omitempty"`
+	Monthly byteSize `yaml:"monthly,omitempty"`
+	// WarnPercent is the soft limit shown as a warning on the dashboard (default 80).
+	WarnPercent int `yaml:"warn_percent,omitempty"`
+}
+
+// QuotaUsage is the usage of one principal in one period.
+type QuotaUsage struct {
+	Kind      string  `json:"kind"`
+	Principal string  `json:"principal"`
+	Period    string  `json:"period"`
+	Bytes     int64   `json:"bytes"`
+	Limit     int64   `json:"limit,omitempty"`
+	Percent   float64 `json:"percent,omitempty"`
+	Status    string  `json:"status"`
+}
+
+// quotaPolicy is the runtime form of the quota settings.
+type quotaPolicy struct {
+	config     QuotaConfig
+	userLimits map[string]QuotaLimit
+}
+
+// newQuotaPolicy builds the quota policy from the quota and user settings.
+func newQuotaPolicy(config *Config) (*quotaPolicy, error) {
+	policy := &quotaPolicy{config: config.Quotas, userLimits: make(map[string]QuotaLimit)}
+	if config.Quotas.FlushInterval < 0 {
+		return nil, fmt.Errorf("quotas flush_interval must not be negative")
+	}
+	limits := []QuotaLimit{config.Quotas.PerUser, config.Quotas.PerClient}
+	for _, user := range config.Users {
+		if user.Quota != (QuotaLimit{}) {
+			policy.userLimits[user.Username] = user.Quota
+			limits = append(limits, user.Quota)
+		}
+	}
+	for _, limit := range limits {
+		if limit.WarnPercent < 0 || limit.WarnPercent > 100 {
+			return nil, fmt.Errorf("quota warn_percent %d is outside 0-100", limit.WarnPercent)
+		}
+	}
+	return policy, nil
+}
+
+// limitFor returns the quota of a principal.
+func (p *quotaPolicy) limitFor(kind, name string) QuotaLimit {
+	if kind == principalClient {
+		return p.config.PerClient
+	}
+	if limit, exists := p.userLimits[name]; exists {
+		return limit
+	}
+	return p.config.PerUser
+}
+
+// status rates the usage of a principal in a day or month period.
+func (p *quotaPolicy) status(kind, name, period string, bytes int64) QuotaUsage {
+	result := QuotaUsage{Kind: kind, Principal: name, Period: period, Bytes: bytes, Status: quotaOK}
+	limit := p.limitFor(kind, name)
+	result.Limit = int64(limit.Monthly)
+	if len(period) == len(usageDayFormat) {
+		result.Limit = int64(limit.Daily)
+	}
+	if result.Limit <= 0 {
+		return result
+	}
+	warnPercent := limit.WarnPercent
+	if warnPercent == 0 {
+		warnPercent = defaultQuotaWarnPercent
+	}
+	result.Percent = float64(bytes) * 100 / float64(result.Limit)
+	switch {
+	case bytes >= result.Limit:
+		result.Status = quotaExceeded
+	case result.Percent >= float64(warnPercent):
+		result.Status = quotaWarning
+	}
+	return result
+}
+
+// principals returns the kinds and names a connection is accounted to.
+func principals(clientIP, username string) [][2]string {
+	result := [][2]string{{principalClient, clientIP}}
+	if username != "" {
+		result = append(result, [2]string{principalUser, username})
+	}
+	return result
+}
+
+// check returns errQuotaExceeded if the client or user has no quota left today or this month.
+func (p *quotaPolicy) check(clientIP, username string) error {
+	if p == nil {
+		return nil
+	}
+	now := time.Now()
+	for _, principal := range principals(clientIP, username) {
+		for _, period := range []string{now.Format(usageDayFormat), now.Format(usageMonthFormat)} {
+			status := p.status(principal[0], principal[1], period, usage.used(principal[0], principal[1], period))
+			if status.Status == quotaExceeded {
+				return fmt.Errorf("%w: %s '%s' used %d of %d bytes in %s",
+					errQuotaExceeded, principal[0], principal[1], status.Bytes, status.Limit, period)
+			}
+		}
+	}
+	return nil
+}
+
+// principalUsage holds the bytes transferred by one principal per day and per month.
+type principalUsage struct {
+	Daily   map[string]int64 `json:"daily"`
+	Monthly map[string]int64 `json:"monthly"`
+}
+
+// usageStore accounts transferred bytes to users and client IPs and keeps
+// the totals in a JSON file across restarts.
+type usageStore struct {
+	mutex   sync.Mutex
+	path    string
+	dirty   bool
+	Users   map[string]*principalUsage `json:"users"`
+	Clients map[string]*principalUsage `json:"clients"`
+}
+
+var usage = &usageStore{
+	Users:   make(map[string]*principalUsage),
+	Clients: make(map[string]*principalUsage),
+}
+
+// open loads the usage saved in path, which is then used by flush. A missing
+// file starts empty; an unreadable one is an error so quotas are not reset by accident.
+func (s *usageStore) open(path string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return fmt.Errorf("could not parse usage store '%s': %v", path, err)
+	}
+	if s.Users == nil {
+		s.Users = make(map[string]*principalUsage)
+	}
+	if s.Clients == nil {
+		s.Clients = make(map[string]*principalUsage)
+	}
+	return nil
+}
+
+// principalsOf returns the usage map for a kind of principal. The caller must hold s.mutex.
+func (s *usageStore) principalsOf(kind string) map[string]*principalUsage {
+	if kind == principalClient {
+		return s.Clients
+	}
+	return s.Users
+}
+
+// record adds n bytes to the current day and month of the client and user.
+func (s *usageStore) record(clientIP, username string, n int64) {
+	if n <= 0 {
+		return
+	}
+	now := time.Now()
+	day, month := now.Format(usageDayFormat), now.Format(usageMonthFormat)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, principal := range principals(clientIP, username) {
+		principals := s.principalsOf(principal[0])
+		entry, exists := principals[principal[1]]
+		if !exists {
+			entry = &principalUsage{Daily: make(map[string]int64), Monthly: make(map[string]int64)}
+			principals[principal[1]] = entry
+		}
+		entry.Daily[day] += n
+		entry.Monthly[month] += n
+	}
+	s.dirty = true
+}
+
+// used returns the bytes a principal transferred in a day or month period.
+func (s *usageStore) used(kind, name, period string) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, exists := s.principalsOf(kind)[name]
+	if !exists {
+		return 0
+	}
+	if len(period) == len(usageDayFormat) {
+		return entry.Daily[period]
+	}
+	return entry.Monthly[period]
+}
+
+// period returns the usage of every principal in a day or month period.
+func (s *usageStore) period(period string) map[[2]string]int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := make(map[[2]string]int64)
+	for _, kind := range []string{principalUser, principalClient} {
+		for name, entry := range s.principalsOf(kind) {
+			totals := entry.Monthly
+			if len(period) == len(usageDayFormat) {
+				totals = entry.Daily
+			}
+			if bytes := totals[period]; bytes > 0 {
+				result[[2]string{kind, name}] = bytes
+			}
+		}
+	}
+	return result
+}
+
+// prune drops usage older than the retention periods. The caller must hold s.mutex.
+func (s *usageStore) prune(now time.Time) {
+	oldestDay := now.AddDate(0, 0, -usageRetentionDays).Format(usageDayFormat)
+	oldestMonth := now.AddDate(0, -usageRetentionMonths, 0).Format(usageMonthFormat)
+	for _, principals := range []map[string]*principalUsage{s.Users, s.Clients} {
+		for name, entry := range principals {
+			for day := range entry.Daily {
+				if day < oldestDay {
+					delete(entry.Daily, day)
+				}
+			}
+			for month := range entry.Monthly {
+				if month < oldestMonth {
+					delete(entry.Monthly, month)
+				}
+			}
+			if len(entry.Monthly) == 0 {
+				delete(principals, name)
+			}
+		}
+	}
+}
+
+// flush writes the usage to the store if it changed. The file is replaced
+// atomically so a crash cannot leave it half written.
+func (s *usageStore) flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.path == "" || !s.dirty {
+		return nil
+	}
+	s.prune(time.Now())
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// startQuotaAccounting opens the usage store and starts writing it
+// periodically; stopQuotaAccounting writes it on shutdown. It also closes active connections over their
+// quota when close_active is set.
+func startQuotaAccounting(cfg *proxyConfig) error {
+	settings := cfg.quotas.config
+	if settings.Store != "" {
+		if err := usage.open(settings.Store); err != nil {
+			return err
+		}
+	}
+	interval := settings.FlushInterval
+	if interval <= 0 {
+		interval = defaultQuotaFlushInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := usage.flush(); err != nil {
+				log.Printf("Failed to save usage store: %v", err)
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(quotaEnforceInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if cfg := liveConfig.get(); cfg.quotas.config.CloseActive {
+				closeOverQuotaConnections(cfg)
+			}
+		}
+	}()
+	return nil
+}
+
+// stopQuotaAccounting writes the usage store a last time before the proxy exits.
+func stopQuotaAccounting() {
+	if err := usage.flush(); err != nil {
+		log.Printf("Failed to save usage store: %v", err)
+	}
+}
+
+// closeOverQuotaConnections closes every active connection whose user or
+// client has exceeded its quota and returns how many were closed.
+func closeOverQuotaConnections(cfg *proxyConfig) int {
+	var closers []io.Closer
+	stats.mutex.RLock()
+	for _, conn := range stats.ActiveConnections {
+		if conn.closer != nil && cfg.quotas.check(conn.ClientIP, conn.Username) != nil {
+			closers = append(closers, conn.closer)
+			if debugMode {
+				log.Printf("Closing %s connection from %s to %s: quota exceeded", conn.Protocol, conn.ClientIP, conn.Destination)
+			}
+		}
+	}
+	stats.mutex.RUnlock()
+
+	for _, closer := range closers {
+		closer.Close()
+	}
+	return len(closers)
+}
+
+// quotaReport rates the usage of every principal in a period, highest first.
+func quotaReport(cfg *proxyConfig, period string) []QuotaUsage {
+	report := []QuotaUsage{}
+	for principal, bytes := range usage.period(period) {
+		report = append(report, cfg.quotas.status(principal[0], principal[1], period, bytes))
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Bytes != report[j].Bytes {
+			return report[i].Bytes > report[j].Bytes
+		}
+		return report[i].Kind+report[i].Principal < report[j].Kind+report[j].Principal
+	})
+	return report
+}
+
+// quotaWarnings lists principals past their soft or hard limit today or this month.
+func quotaWarnings() []QuotaUsage {
+	cfg := liveConfig.get()
+	if cfg == nil || cfg.quotas == nil {
+		return nil
+	}
+	now := time.Now()
+	var warnings []QuotaUsage
+	for _, period := range []string{now.Format(usageDayFormat), now.Format(usageMonthFormat)} {
+		for _, status := range quotaReport(cfg, period) {
+			if status.Status != quotaOK {
+				warnings = append(warnings, status)
+			}
+		}
+	}
+	return warnings
+}
+
+// handleUsageAPI reports usage per user and client for a day (?period=2006-01-02)
+// or month (?period=2006-01, the default being the current month). The
+// results can be narrowed with ?kind=user|client and ?principal=name.
+func handleUsageAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	query := r.URL.Query()
+	period := query.Get("period")
+	if period == "" {
+		period = time.Now().Format(usageMonthFormat)
+	}
+	if _, err := time.Parse(usageDayFormat, period); err != nil {
+		if _, err := time.Parse(usageMonthFormat, period); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "period must be YYYY-MM-DD or YYYY-MM"})
+			return
+		}
+	}
+
+	report := []QuotaUsage{}
+	for _, status := range quotaReport(liveConfig.get(), period) {
+		if kind := query.Get("kind"); kind != "" && kind != status.Kind {
+			continue
+		}
+		if principal := query.Get("principal"); principal != "" && principal != status.Principal {
+			continue
+		}
+		report = append(report, status)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"period": period, "usage": report})
+}
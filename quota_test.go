@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withUsageStore replaces the global usage store with an empty one for the duration of a test
+func withUsageStore(t *testing.T) *usageStore {
+	saved := usage
+	usage = &usageStore{Users: make(map[string]*principalUsage), Clients: make(map[string]*principalUsage)}
+	t.Cleanup(func() { usage = saved })
+	return usage
+}
+
+// TestQuotaPolicy tests quota states and that either principal's quota refuses new connections
+func TestQuotaPolicy(t *testing.T) {
+	withUsageStore(t)
+	policy, err := newQuotaPolicy(&Config{
+		Quotas: QuotaConfig{
+			PerUser:   QuotaLimit{Daily: 1000, WarnPercent: 50},
+			PerClient: QuotaLimit{Monthly: 5000},
+		},
+		Users: []UserConfig{{Username: "big", Quota: QuotaLimit{Daily: 10000}}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build quota policy: %v", err)
+	}
+	today := time.Now().Format(usageDayFormat)
+
+	if status := policy.status(principalUser, "alice", today, 600); status.Status != quotaWarning || status.Limit != 1000 {
+		t.Errorf("Expected a warning at 60%% of 1000 bytes, got %+v", status)
+	}
+	if status := policy.status(principalUser, "big", today, 600); status.Status != quotaOK {
+		t.Errorf("Expected the user's own quota to replace per_user, got %+v", status)
+	}
+	if status := policy.status(principalUser, "alice", "2024-05", 1<<30); status.Status != quotaOK || status.Limit != 0 {
+		t.Errorf("Expected no monthly user limit, got %+v", status)
+	}
+
+	usage.record("192.0.2.1", "alice", 1000)
+	if err := policy.check("192.0.2.2", "alice"); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("Expected alice's daily quota to be exceeded, got %v", err)
+	}
+	if err := policy.check("192.0.2.1", ""); err != nil {
+		t.Errorf("Expected the client to be within its quota: %v", err)
+	}
+	usage.record("192.0.2.1", "big", 4000)
+	if err := policy.check("192.0.2.1", ""); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("Expected the client's monthly quota to be exceeded, got %v", err)
+	}
+
+	if _, err := newQuotaPolicy(&Config{Quotas: QuotaConfig{PerUser: QuotaLimit{WarnPercent: 120}}}); err == nil {
+		t.Error("Expected warn_percent over 100 to be rejected")
+	}
+	var none *quotaPolicy
+	if err := none.check("192.0.2.1", "alice"); err != nil {
+		t.Errorf("Expected no quotas without a policy: %v", err)
+	}
+}
+
+// TestUsageStorePersistence tests that usage survives a flush and reopen and old periods are pruned
+func TestUsageStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	store := withUsageStore(t)
+	if err := store.open(path); err != nil {
+		t.Fatalf("Expected a missing store to start empty: %v", err)
+	}
+	store.record("192.0.2.1", "alice", 300)
+	store.record("192.0.2.1", "alice", 200)
+	store.Users["old"] = &principalUsage{Daily: map[string]int64{"2001-01-01": 1}, Monthly: map[string]int64{"2001-01": 1}}
+	if err := store.flush(); err != nil {
+		t.Fatalf("Failed to flush usage: %v", err)
+	}
+
+	reopened := &usageStore{}
+	if err := reopened.open(path); err != nil {
+		t.Fatalf("Failed to reopen usage: %v", err)
+	}
+	month := time.Now().Format(usageMonthFormat)
+	if used := reopened.used(principalUser, "alice", month); used != 500 {
+		t.Errorf("Expected 500 bytes for alice this month, got %d", used)
+	}
+	if used := reopened.used(principalClient, "192.0.2.1", time.Now().Format(usageDayFormat)); used != 500 {
+		t.Errorf("Expected 500 bytes for the client today, got %d", used)
+	}
+	if _, exists := reopened.Users["old"]; exists {
+		t.Error("Expected usage past the retention period to be pruned")
+	}
+}
+
+// TestUsageAPI tests the usage report and its filters
+func TestUsageAPI(t *testing.T) {
+	withUsageStore(t)
+	saved := liveConfig.get()
+	defer liveConfig.current.Store(saved)
+	quotas, _ := newQuotaPolicy(&Config{Quotas: QuotaConfig{PerUser: QuotaLimit{Monthly: 1000}}})
+	liveConfig.current.Store(&proxyConfig{quotas: quotas})
+
+	usage.record("192.0.2.1", "alice", 900)
+	usage.record("192.0.2.2", "", 100)
+
+	var report struct {
+		Period string       `json:"period"`
+		Usage  []QuotaUsage `json:"usage"`
+	}
+	recorder := httptest.NewRecorder()
+	handleUsageAPI(recorder, httptest.NewRequest("GET", "/api/usage?kind=user", nil))
+	if err := json.NewDecoder(recorder.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode usage report: %v", err)
+	}
+	if report.Period != time.Now().Format(usageMonthFormat) || len(report.Usage) != 1 {
+		t.Fatalf("Expected alice's usage for this month, got %+v", report)
+	}
+	if alice := report.Usage[0]; alice.Principal != "alice" || alice.Bytes != 900 || alice.Status != quotaWarning {
+		t.Errorf("Unexpected usage for alice: %+v", alice)
+	}
+	if warnings := quotaWarnings(); len(warnings) != 1 || warnings[0].Principal != "alice" {
+		t.Errorf("Expected a quota warning for alice, got %+v", warnings)
+	}
+
+	recorder = httptest.NewRecorder()
+	handleUsageAPI(recorder, httptest.NewRequest("GET", "/api/usage?period=May", nil))
+	if recorder.Code != 400 {
+		t.Errorf("Expected an invalid period to be rejected, got %d", recorder.Code)
+	}
+}
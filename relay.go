@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons a tunnel ended, counted in the monitoring stats.
+const (
+	closeIdle      = "idle"       // no bytes in either direction for the idle timeout
+	closeLifetime  = "lifetime"   // open for the maximum lifetime
+	closeClientEOF = "client_eof" // the client finished sending
+	closeServerEOF = "server_eof" // the destination finished sending
+	closeError     = "error"      // reading or writing either side failed
+	closeProxy     = "closed"     // closed by the proxy, e.g. after a config reload
+)
+
+// tunnel relays bytes between a client and a server connection. The idle and
+// lifetime timeouts are enforced with deadlines on both connections.
+type tunnel struct {
+	connID  string
+	client  net.Conn
+	server  net.Conn
+	idle    time.Duration
+	expires time.Time // end of the lifetime, zero if unlimited
+	start   time.Time
+	// lastActivity is when bytes last moved in either direction, in Unix nanoseconds.
+	lastActivity atomic.Int64
+	mutex        sync.Mutex
+	reason       string
+}
+
+// newTunnel prepares a tunnel with cfg's idle and lifetime timeouts.
+func newTunnel(cfg *proxyConfig, connID string, client, server net.Conn) *tunnel {
+	t := &tunnel{
+		connID: connID,
+		client: client,
+		server: server,
+		idle:   cfg.timeouts.Idle,
+		start:  time.Now(),
+	}
+	if cfg.timeouts.Lifetime > 0 {
+		t.expires = t.start.Add(cfg.timeouts.Lifetime)
+	}
+	t.touch()
+	return t
+}
+
+// Close ends the tunnel on behalf of the proxy.
+func (t *tunnel) Close() error {
+	t.finish(closeProxy)
+	t.client.Close()
+	return t.server.Close()
+}
+
+// finish records why a direction of the tunnel ended. The tunnel's reason is
+// the first failure or timeout, or otherwise the first EOF, which tells which
+// side started closing.
+func (t *tunnel) finish(reason string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.reason == "" || (isEOF(t.reason) && !isEOF(reason)) {
+		t.reason = reason
+	}
+}
+
+// isEOF reports whether reason is a side finishing sending.
+func isEOF(reason string) bool {
+	return reason == closeClientEOF || reason == closeServerEOF
+}
+
+// touch records activity.
+func (t *tunnel) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// deadline returns when the tunnel times out unless more bytes move: the idle
+// timeout after the last activity, or the end of its lifetime if sooner.
+func (t *tunnel) deadline() time.Time {
+	var deadline time.Time
+	if t.idle > 0 {
+		deadline = time.Unix(0, t.lastActivity.Load()).Add(t.idle)
+	}
+	if !t.expires.IsZero() && (deadline.IsZero() || t.expires.Before(deadline)) {
+		deadline = t.expires
+	}
+	return deadline
+}
+
+// expired returns why the tunnel has timed out at now, or "" if it has not.
+// A deadline can pass while the other direction kept the tunnel active.
+func (t *tunnel) expired(now time.Time) string {
+	if !t.expires.IsZero() && !now.Before(t.expires) {
+		return closeLifetime
+	}
+	if t.idle > 0 && now.Sub(time.Unix(0, t.lastActivity.Load())) >= t.idle {
+		return closeIdle
+	}
+	return ""
+}
+
+// tunnelTimeout is the error a tunnel's reader or writer returns once the
+// tunnel has timed out.
+type tunnelTimeout struct {
+	reason string
+}
+
+func (e *tunnelTimeout) Error() string {
+	return "tunnel timed out: " + e.reason
+}
+
+// isTimeout reports whether err is a deadline expiring.
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// tunnelReader reads one direction of a tunnel from reader, which may hold
+// bytes already buffered from conn, under the tunnel's deadline.
+type tunnelReader struct {
+	tunnel *tunnel
+	conn   net.Conn
+	reader io.Reader
+}
+
+func (r *tunnelReader) Read(p []byte) (int, error) {
+	for {
+		r.conn.SetReadDeadline(r.tunnel.deadline())
+		n, err := r.reader.Read(p)
+		if n > 0 {
+			r.tunnel.touch()
+		}
+		if n == 0 && isTimeout(err) {
+			if reason := r.tunnel.expired(time.Now()); reason != "" {
+				return 0, &tunnelTimeout{reason}
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// tunnelWriter writes one direction of a tunnel to conn under the tunnel's deadline.
+type tunnelWriter struct {
+	tunnel *tunnel
+	conn   net.Conn
+}
+
+func (w *tunnelWriter) Write(p []byte) (int, error) {
+	written := 0
+	for {
+		w.conn.SetWriteDeadline(w.tunnel.deadline())
+		n, err := w.conn.Write(p[written:])
+		written += n
+		if n > 0 {
+			w.tunnel.touch()
+		}
+		if written < len(p) && isTimeout(err) {
+			if reason := w.tunnel.expired(time.Now()); reason != "" {
+				return written, &tunnelTimeout{reason}
+			}
+			continue
+		}
+		return written, err
+	}
+}
+
+// relay copies bytes in both directions, reading the client through
+// clientReader and the server through serverReader, which may hold bytes
+// already buffered from them. When one side finishes sending, the other side's
+// writing half is shut down and the opposite direction carries on, so
+// protocols relying on half-close work. It returns once both directions have
+// finished and records why the tunnel ended.
+func (t *tunnel) relay(clientReader, serverReader io.Reader, bufferSize int) {
+	if bufferSize <= 0 {
+		bufferSize = defaultRelayBufferSize
+	}
+	outboundDone := make(chan struct{})
+	go func() {
+		t.copy(t.server, t.client, clientReader, true, bufferSize) // Client to server (outbound)
+		close(outboundDone)
+	}()
+	t.copy(t.client, t.server, serverReader, false, bufferSize) // Server to client (inbound)
+	<-outboundDone
+	t.mutex.Lock()
+	reason := t.reason
+	t.mutex.Unlock()
+	recordClose(t.connID, reason, time.Since(t.start))
+}
+
+// copy relays one direction and records how it ended. At EOF the destination's
+// writing half is shut down; after a failure, or if the destination cannot be
+// half-closed, both connections are closed to end the other direction too.
+func (t *tunnel) copy(dst, src net.Conn, srcReader io.Reader, outbound bool, bufferSize int) {
+	_, err := copyWithTracking(&tunnelWriter{t, dst}, &tunnelReader{t, src, srcReader}, t.connID, outbound, bufferSize)
+	var timeout *tunnelTimeout
+	var reason string
+	switch {
+	case errors.As(err, &timeout):
+		reason = timeout.reason
+	case err != nil:
+		reason = closeError
+	case outbound:
+		reason = closeClientEOF
+	default:
+		reason = closeServerEOF
+	}
+	t.finish(reason)
+	attachDirectionClosed(t.connID, outbound, reason)
+	if err == nil && closeWrite(dst) == nil {
+		return
+	}
+	t.client.Close()
+	t.server.Close()
+}
+
+// closeWriter is implemented by connections whose writing half can be shut
+// down on its own, such as *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite shuts down the writing half of conn, which sends a FIN on TCP.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// recordClose counts why a tunnel ended.
+func recordClose(connID, reason string, lifetime time.Duration) {
+	stats.mutex.Lock()
+	if stats.CloseReasons == nil {
+		stats.CloseReasons = make(map[string]int64)
+	}
+	stats.CloseReasons[reason]++
+	stats.mutex.Unlock()
+	if debugMode {
+		log.Printf("Tunnel %s closed after %v: %s", connID, lifetime.Round(time.Millisecond), reason)
+	}
+}
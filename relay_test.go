@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed, accepted
+}
+
+// startTunnel relays the connection connID between two TCP pairs and returns
+// the client's and the server's ends, and a channel that receives the reason
+// once the relay returns
+func startTunnel(t *testing.T, connID string, timeouts TimeoutConfig) (net.Conn, net.Conn, *tunnel, chan string) {
+	client, proxyClient := tcpPair(t)
+	proxyServer, server := tcpPair(t)
+	tun := newTunnel(&proxyConfig{timeouts: timeouts}, connID, proxyClient, proxyServer)
+	done := make(chan string, 1)
+	go func() {
+		tun.relay(proxyClient, proxyServer, defaultRelayBufferSize)
+		proxyClient.Close()
+		proxyServer.Close()
+		done <- tun.reason
+	}()
+	return client, server, tun, done
+}
+
+// waitReason returns the reason a tunnel ended, failing if it is still open after limit
+func waitReason(t *testing.T, done chan string, limit time.Duration) string {
+	select {
+	case reason := <-done:
+		return reason
+	case <-time.After(limit):
+		t.Fatalf("Tunnel still open after %v", limit)
+		return ""
+	}
+}
+
+// TestTunnelIdleTimeout tests that traffic in either direction keeps a tunnel open until it goes idle
+func TestTunnelIdleTimeout(t *testing.T) {
+	client, server, _, done := startTunnel(t, "", TimeoutConfig{Idle: 150 * time.Millisecond})
+	go io.Copy(io.Discard, client)
+
+	// Only the server sends; the client's silent direction must not time out.
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if _, err := server.Write([]byte("tick")); err != nil {
+			t.Fatalf("Tunnel closed while active: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if reason := waitReason(t, done, 2*time.Second); reason != closeIdle {
+		t.Errorf("Expected the tunnel to close idle, got %q", reason)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected activity to extend the idle timeout, closed after %v", elapsed)
+	}
+}
+
+// TestTunnelLifetime tests that a busy tunnel is closed at the end of its lifetime
+func TestTunnelLifetime(t *testing.T) {
+	client, server, _, done := startTunnel(t, "", TimeoutConfig{Idle: time.Minute, Lifetime: 200 * time.Millisecond})
+	go io.Copy(io.Discard, server)
+	go func() {
+		for {
+			if _, err := client.Write([]byte("tock")); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	if reason := waitReason(t, done, 2*time.Second); reason != closeLifetime {
+		t.Errorf("Expected the tunnel to reach its lifetime, got %q", reason)
+	}
+}
+
+// TestTunnelCloseReasons tests the reasons recorded for EOF and for closing by the proxy
+func TestTunnelCloseReasons(t *testing.T) {
+	stats.mutex.RLock()
+	before := stats.CloseReasons[closeServerEOF]
+	stats.mutex.RUnlock()
+
+	client, server, _, done := startTunnel(t, "", TimeoutConfig{})
+	server.Write([]byte("bye"))
+	server.Close()
+	reply, _ := io.ReadAll(client)
+	if string(reply) != "bye" {
+		t.Errorf("Expected the server's data before EOF, got %q", reply)
+	}
+	client.Close()
+	if reason := waitReason(t, done, 2*time.Second); reason != closeServerEOF {
+		t.Errorf("Expected server EOF, got %q", reason)
+	}
+	stats.mutex.RLock()
+	after := stats.CloseReasons[closeServerEOF]
+	stats.mutex.RUnlock()
+	if after != before+1 {
+		t.Errorf("Expected the server EOF to be counted, got %d then %d", before, after)
+	}
+
+	_, _, tun, done := startTunnel(t, "", TimeoutConfig{})
+	tun.Close()
+	if reason := waitReason(t, done, 2*time.Second); reason != closeProxy {
+		t.Errorf("Expected a tunnel closed by the proxy, got %q", reason)
+	}
+}
+
+// TestTunnelHalfClose tests that a client finishing sending still receives the server's reply
+func TestTunnelHalfClose(t *testing.T) {
+	connID := "half-close-test"
+	stats.mutex.Lock()
+	stats.ActiveConnections[connID] = &ConnectionInfo{ID: connID}
+	stats.mutex.Unlock()
+	defer func() {
+		stats.mutex.Lock()
+		delete(stats.ActiveConnections, connID)
+		stats.mutex.Unlock()
+	}()
+
+	client, server, _, done := startTunnel(t, connID, TimeoutConfig{})
+	client.Write([]byte("request"))
+	client.(*net.TCPConn).CloseWrite()
+	request, err := io.ReadAll(server)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("Expected the request followed by EOF, got %q, %v", request, err)
+	}
+
+	stats.mutex.RLock()
+	upload, download := stats.ActiveConnections[connID].UploadClosed, stats.ActiveConnections[connID].DownloadClosed
+	stats.mutex.RUnlock()
+	if upload != closeClientEOF || download != "" {
+		t.Errorf("Expected only the upload to be closed, got %q and %q", upload, download)
+	}
+
+	server.Write([]byte("response"))
+	server.Close()
+	response, _ := io.ReadAll(client)
+	if string(response) != "response" {
+		t.Errorf("Expected the response after half-closing, got %q", response)
+	}
+	if reason := waitReason(t, done, 2*time.Second); reason != closeClientEOF {
+		t.Errorf("Expected the client to have started closing, got %q", reason)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const defaultReloadPollInterval = 2 * time.Second
+
+// ReloadConfig controls how config.yaml changes are picked up at runtime.
+type ReloadConfig struct {
+	// Watch enables polling config.yaml for changes in addition to SIGHUP.
+	Watch bool `yaml:"watch"`
+	// PollInterval is how often the file is checked when Watch is set (default 2s).
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// CloseDenied closes active connections that the reloaded rules no longer allow.
+	CloseDenied bool `yaml:"close_denied"`
+}
+
+// reloadResult describes the outcome of the last reload attempt.
+type reloadResult struct {
+	Time    time.Time `json:"time"`
+	Trigger string    `json:"trigger"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+	// Closed is the number of connections closed because they are now denied.
+	Closed int `json:"closed"`
+}
+
+// configStatus is what the monitoring API reports about the running configuration.
+type configStatus struct {
+	Path       string        `json:"path"`
+	Version    int64         `json:"version"`
+	LoadedAt   time.Time     `json:"loaded_at"`
+	LastReload *reloadResult `json:"last_reload,omitempty"`
+}
+
+// configReloader holds the active configuration and swaps in new versions
+// after they have been loaded and validated. Connections keep the version
+// they were accepted with; new connections get the latest one.
+type configReloader struct {
+	path     string
+	current  atomic.Pointer[proxyConfig]
+	mutex    sync.Mutex // serialises reloads and guards the fields below
+	loadedAt time.Time
+	last     *reloadResult
+	modTime  time.Time
+	size     int64
+}
+
+var liveConfig = &configReloader{path: "config.yaml"}
+
+// load reads the initial configuration. It must be called before start.
+func (r *configReloader) load() (*proxyConfig, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.recordFileState()
+	cfg, err := loadConfig(r.path)
+	if err != nil {
+		return nil, err
+	}
+	cfg.version = 1
+	r.current.Store(cfg)
+	retainPoolStates(cfg.pools)
+	r.loadedAt = time.Now()
+	return cfg, nil
+}
+
+// get returns the active configuration.
+func (r *configReloader) get() *proxyConfig {
+	return r.current.Load()
+}
+
+// start reloads the configuration on SIGHUP and, if enabled, when the file changes.
+func (r *configReloader) start() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			r.reload("SIGHUP")
+		}
+	}()
+	go r.watch()
+}
+
+// watch reloads the configuration when the file changes and watching is enabled.
+// The reload settings are read from the active configuration before every check,
+// so a reload can turn watching on or off and change the interval.
+func (r *configReloader) watch() {
+	for {
+		time.Sleep(r.get().reload.interval())
+		if r.get().reload.Watch && r.fileChanged() {
+			r.reload("file change")
+		}
+	}
+}
+
+// interval returns how often the config file is checked.
+func (c ReloadConfig) interval() time.Duration {
+	if c.PollInterval <= 0 {
+		return defaultReloadPollInterval
+	}
+	return c.PollInterval
+}
+
+// recordFileState remembers the modification time and size of the config file.
+// The caller must hold r.mutex.
+func (r *configReloader) recordFileState() {
+	if info, err := os.Stat(r.path); err == nil {
+		r.modTime = info.ModTime()
+		r.size = info.Size()
+	}
+}
+
+// fileChanged reports whether the config file differs from the last one loaded or rejected.
+func (r *configReloader) fileChanged() bool {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return !info.ModTime().Equal(r.modTime) || info.Size() != r.size
+}
+
+// reload loads and validates the config file and swaps it in if it is valid.
+// An invalid file leaves the running configuration untouched.
+func (r *configReloader) reload(trigger string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.recordFileState()
+	result := &reloadResult{Time: time.Now(), Trigger: trigger}
+	r.last = result
+
+	cfg, err := loadConfig(r.path)
+	if err != nil {
+		result.Error = err.Error()
+		log.Printf("Config reload (%s) failed, keeping version %d: %v", trigger, r.get().version, err)
+		return
+	}
+	if !r.get().sameListeners(cfg) {
+		result.Error = "listeners cannot be added, removed or changed without a restart"
+		log.Printf("Config reload (%s) failed, keeping version %d: %s", trigger, r.get().version, result.Error)
+		return
+	}
+	cfg.version = r.get().version + 1
+	r.current.Store(cfg)
+	retainPoolStates(cfg.pools)
+	r.loadedAt = result.Time
+	result.Success = true
+
+	if cfg.reload.CloseDenied {
+		result.Closed = closeDeniedConnections(cfg)
+	}
+	log.Printf("Config reloaded (%s): version %d, %d connections closed", trigger, cfg.version, result.Closed)
+}
+
+// status returns the current configuration status for the monitoring API.
+func (r *configReloader) status() configStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	status := configStatus{Path: r.path, LoadedAt: r.loadedAt}
+	if cfg := r.get(); cfg != nil {
+		status.Version = cfg.version
+	}
+	if r.last != nil {
+		last := *r.last
+		status.LastReload = &last
+	}
+	return status
+}
+
+// stillAllowed reports whether an active connection is permitted by cfg,
+// using the access policy of the listener it arrived on.
+func stillAllowed(cfg *proxyConfig, conn *ConnectionInfo) bool {
+	policy := cfg.forListener(conn.Listener).access
+	if !policy.mayConnect(conn.ClientIP) {
+		return false
+	}
+	if conn.Username == "" {
+		if !policy.allowsAnonymous(conn.ClientIP) {
+			return false
+		}
+	} else if _, exists := policy.users.users[conn.Username]; !exists {
+		return false
+	}
+	return !cfg.forListener(conn.Listener).routeConnection(conn.ClientIP, conn.Username, conn.Destination).rejected()
+}
+
+// closeDeniedConnections closes every active connection cfg no longer allows
+// and returns how many were closed.
+func closeDeniedConnections(cfg *proxyConfig) int {
+	var denied []*ConnectionInfo
+	stats.mutex.RLock()
+	for _, conn := range stats.ActiveConnections {
+		if conn.closer != nil && !stillAllowed(cfg, conn) {
+			denied = append(denied, conn)
+		}
+	}
+	stats.mutex.RUnlock()
+
+	for _, conn := range denied {
+		if debugMode {
+			log.Printf("Closing %s connection from %s to %s: denied by reloaded config", conn.Protocol, conn.ClientIP, conn.Destination)
+		}
+		conn.closer.Close()
+	}
+	return len(denied)
+}
+
+// handleConfigAPI reports the configuration version and the last reload result.
+func handleConfigAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	json.NewEncoder(w).Encode(liveConfig.status())
+}
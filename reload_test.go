@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// closeRecorder records whether Close was called
+type closeRecorder struct {
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+// TestConfigReload tests that invalid files are rejected and valid ones swapped in
+func TestConfigReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+
+	writeConfig("allowed_ips: [\"127.0.0.1\"]\n")
+	reloader := &configReloader{path: path}
+	first, err := reloader.load()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if first.version != 1 || reloader.fileChanged() {
+		t.Fatalf("Expected version 1 and an unchanged file, got version %d", first.version)
+	}
+
+	writeConfig("allowed_ips: [\"not-an-ip\"]\n")
+	reloader.reload("test")
+	status := reloader.status()
+	if reloader.get() != first || status.Version != 1 || status.LastReload.Success || status.LastReload.Error == "" {
+		t.Errorf("Expected invalid config to be rejected, got %+v", status.LastReload)
+	}
+
+	writeConfig("allowed_ips: [\"127.0.0.1\", \"10.0.0.0/8\"]\n")
+	// Make sure the change is visible even on filesystems with coarse timestamps.
+	os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if !reloader.fileChanged() {
+		t.Error("Expected file change to be detected")
+	}
+	reloader.reload("test")
+	status = reloader.status()
+	if status.Version != 2 || !status.LastReload.Success || !reloader.get().access.allowsAnonymous("10.1.2.3") {
+		t.Errorf("Expected version 2 with the new allow-list, got %+v", status)
+	}
+	if reloader.fileChanged() {
+		t.Error("Expected no change after reload")
+	}
+}
+
+// TestConfigReloadWatchSettings tests that reloading can turn watching the file on
+func TestConfigReloadWatchSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(content string, modified time.Time) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		os.Chtimes(path, modified, modified)
+	}
+
+	writeConfig("reload:\n  poll_interval: 20ms\n", time.Now())
+	reloader := &configReloader{path: path}
+	if _, err := reloader.load(); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	go reloader.watch()
+
+	writeConfig("reload:\n  watch: true\n  poll_interval: 20ms\n", time.Now().Add(time.Minute))
+	time.Sleep(100 * time.Millisecond)
+	if version := reloader.status().Version; version != 1 {
+		t.Fatalf("Expected no reload while watching is disabled, got version %d", version)
+	}
+
+	reloader.reload("test")
+	writeConfig("reload:\n  watch: true\n  poll_interval: 20ms\nallowed_ips: [\"10.0.0.0/8\"]\n", time.Now().Add(2*time.Minute))
+	deadline := time.Now().Add(2 * time.Second)
+	for reloader.status().Version != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := reloader.status(); status.Version != 3 || status.LastReload.Trigger != "file change" {
+		t.Errorf("Expected the reloaded settings to watch the file, got %+v", status)
+	}
+}
+
+// TestCloseDeniedConnections tests that reloaded rules close connections they no longer allow
+func TestCloseDeniedConnections(t *testing.T) {
+	cfg := &proxyConfig{}
+	cfg.access, _ = newAccessPolicy(&Config{AllowedIPs: []string{"192.0.2.1"}})
+	cfg.destinations, _ = newDestinationRules(DestinationConfig{
+		Rules: []DestinationRule{{Action: "deny", Hosts: []string{"blocked.example"}}},
+	})
+
+	recorders := map[string]*closeRecorder{}
+	for _, tt := range []struct {
+		id, clientIP, destination, protocol string
+	}{
+		{"reload-allowed", "192.0.2.1", "ok.example:443", "SOCKS5"},
+		{"reload-client", "192.0.2.2", "ok.example:443", "SOCKS5"},
+		{"reload-destination", "192.0.2.1", "blocked.example:443", "SOCKS5"},
+		{"reload-bind", "192.0.2.1", "blocked.example:20", "SOCKS5-BIND"},
+	} {
+		addConnection(tt.id, "", tt.clientIP, "", tt.protocol, tt.destination)
+		defer removeConnection(tt.id)
+		recorders[tt.id] = &closeRecorder{}
+		attachCloser(tt.id, recorders[tt.id])
+	}
+
+	if closed := closeDeniedConnections(cfg); closed != 3 {
+		t.Errorf("Expected 3 connections to be closed, got %d", closed)
+	}
+	if recorders["reload-allowed"].closed || !recorders["reload-client"].closed || !recorders["reload-destination"].closed || !recorders["reload-bind"].closed {
+		t.Errorf("Unexpected close results: allowed=%v client=%v destination=%v bind=%v",
+			recorders["reload-allowed"].closed, recorders["reload-client"].closed, recorders["reload-destination"].closed, recorders["reload-bind"].closed)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+)
+
+// Route actions.
+const (
+	routeActionDirect   = "direct"
+	routeActionReject   = "reject"
+	routeActionUpstream = "upstream"
+)
+
+// RouteRule decides how connections matching all of its conditions leave the
+// proxy. Empty condition lists match anything.
+type RouteRule struct {
+	// Name identifies the rule in errors and /api/route (default: its position).
+	Name string `yaml:"name,omitempty"`
+	// Hosts and Ports match the destination like destination rules do.
+	Hosts []string `yaml:"hosts,omitempty"`
+	Ports []string `yaml:"ports,omitempty"`
+	// Clients lists client addresses and CIDR ranges.
+	Clients []string `yaml:"clients,omitempty"`
+	// Users lists authenticated usernames; "*" matches any authenticated user.
+	Users []string `yaml:"users,omitempty"`
+	// Listeners lists the names of the listeners the connection arrived on.
+	Listeners []string `yaml:"listeners,omitempty"`
+	// Action is "direct", "reject" or "upstream".
+	Action string `yaml:"action"`
+	// Upstream names the upstream or upstream pool for the upstream action.
+	Upstream string `yaml:"upstream,omitempty"`
+	// Egress replaces the user's and the top-level egress setting.
+	Egress EgressConfig `yaml:"egress,omitempty"`
+}
+
+// routeRule is the compiled form of RouteRule.
+type routeRule struct {
+	name      string // for example "route 2" or "route 'vpn'"
+	dest      destinationRule
+	clients   *prefixSet // nil matches any client
+	users     map[string]bool
+	listeners map[string]bool
+	action    string
+	upstream  string
+	egress    *egressPolicy
+}
+
+// routingTable is the compiled list of route rules, evaluated in order.
+type routingTable struct {
+	rules []routeRule
+}
+
+// stringSet returns the entries as a set, or nil if there are none.
+func stringSet(entries []string) map[string]bool {
+	if len(entries) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		set[entry] = true
+	}
+	return set
+}
+
+// newRoutingTable compiles the routes section of the config. known reports
+// whether an upstream or upstream pool is defined.
+func newRoutingTable(rules []RouteRule, known func(string) bool) (*routingTable, error) {
+	table := &routingTable{}
+	for i, rule := range rules {
+		name := fmt.Sprintf("route %d", i+1)
+		if rule.Name != "" {
+			name = fmt.Sprintf("route '%s'", rule.Name)
+		}
+		dest, err := newDestinationMatch(rule.Hosts, rule.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		entry := routeRule{
+			name:      name,
+			dest:      dest,
+			users:     stringSet(rule.Users),
+			listeners: stringSet(rule.Listeners),
+			action:    rule.Action,
+		}
+		if entry.egress, err = newEgressPolicy(rule.Egress); err != nil {
+			return nil, fmt.Errorf("%s: egress: %v", name, err)
+		}
+		if len(rule.Clients) > 0 {
+			if entry.clients, err = newPrefixSet(rule.Clients); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		switch rule.Action {
+		case routeActionDirect, routeActionReject:
+			if rule.Upstream != "" {
+				return nil, fmt.Errorf("%s: upstream is only used with the upstream action", name)
+			}
+		case routeActionUpstream:
+			if !known(rule.Upstream) {
+				return nil, fmt.Errorf("%s: unknown upstream '%s'", name, rule.Upstream)
+			}
+			entry.upstream = rule.Upstream
+		default:
+			return nil, fmt.Errorf("%s: invalid action '%s', expected direct, reject or upstream", name, rule.Action)
+		}
+		table.rules = append(table.rules, entry)
+	}
+	return table, nil
+}
+
+// matches reports whether a connection satisfies every condition of the rule.
+func (r *routeRule) matches(client netip.Addr, username, listener, host string, port uint16) bool {
+	if !r.dest.matches(host, port) {
+		return false
+	}
+	if r.clients != nil && (!client.IsValid() || !r.clients.contains(client)) {
+		return false
+	}
+	if r.users != nil && !r.users[username] && !(username != "" && r.users["*"]) {
+		return false
+	}
+	return r.listeners == nil || r.listeners[listener]
+}
+
+// match returns the first rule matching a connection, or nil if none does.
+func (t *routingTable) match(client netip.Addr, username, listener, host string, port uint16) *routeRule {
+	if t == nil {
+		return nil
+	}
+	for i := range t.rules {
+		if t.rules[i].matches(client, username, listener, host, port) {
+			return &t.rules[i]
+		}
+	}
+	return nil
+}
+
+// routeDecision is how a connection leaves the proxy and why.
+type routeDecision struct {
+	// Rule names the rule that decided, such as "route 'vpn'" or "destinations default".
+	Rule string `json:"rule"`
+	// Action is "direct", "reject" or "upstream".
+	Action string `json:"action"`
+	// Route is "direct", the chain of upstreams or "pool 'name'"; empty when rejected.
+	Route string `json:"route,omitempty"`
+	// Egress describes the source addresses and interface used, if any are configured.
+	Egress string `json:"egress,omitempty"`
+	route  upstreamRoute
+	pool   *proxyPool
+	egress *egressPolicy
+}
+
+// rejected reports whether the connection must be refused.
+func (d routeDecision) rejected() bool {
+	return d.Action == routeActionReject
+}
+
+// upstreamDecision returns the decision to use the named upstream or upstream
+// pool, or to connect directly if name is empty or "direct".
+func (cfg *proxyConfig) upstreamDecision(rule, name string) routeDecision {
+	if pool, exists := cfg.pools[name]; exists {
+		return routeDecision{Rule: rule, Action: routeActionUpstream, Route: fmt.Sprintf("pool '%s'", name), pool: pool}
+	}
+	route := cfg.routes[name]
+	if len(route) == 0 {
+		return routeDecision{Rule: rule, Action: routeActionDirect, Route: routeDirect}
+	}
+	return routeDecision{Rule: rule, Action: routeActionUpstream, Route: route.String(), route: route}
+}
+
+// routeConnection decides how a connection from clientIP, authenticated as
+// username (if any), on cfg's listener reaches address ("host:port").
+// Destinations denied by the destination rules are rejected first; then the
+// first matching route rule decides. Without one, the upstream named by the
+// matching destination rule or the destinations default is used. The egress
+// setting of the route rule, else of the user, else the top-level one applies.
+func (cfg *proxyConfig) routeConnection(clientIP, username, address string) routeDecision {
+	host, port, ok := splitDestination(address)
+	if !ok {
+		return routeDecision{Rule: "invalid destination", Action: routeActionReject}
+	}
+	index, _ := cfg.destinations.match(address)
+	if !cfg.destinations.allows(address) {
+		if index < 0 {
+			return routeDecision{Rule: "destinations default", Action: routeActionReject}
+		}
+		return routeDecision{Rule: fmt.Sprintf("destination rule %d", index+1), Action: routeActionReject}
+	}
+
+	client, _ := netip.ParseAddr(clientIP)
+	rule := cfg.routing.match(client.Unmap(), username, cfg.listener, host, port)
+	var result routeDecision
+	switch {
+	case rule != nil && rule.action == routeActionReject:
+		return routeDecision{Rule: rule.name, Action: routeActionReject}
+	case rule != nil:
+		result = cfg.upstreamDecision(rule.name, rule.upstream)
+	case index >= 0 && cfg.destinations.rules[index].upstream != "":
+		result = cfg.upstreamDecision(fmt.Sprintf("destination rule %d", index+1), cfg.destinations.rules[index].upstream)
+	default:
+		result = cfg.upstreamDecision("destinations default", cfg.destinations.upstream)
+	}
+
+	result.egress = cfg.egress
+	if policy := cfg.userEgress[username]; username != "" && policy != nil {
+		result.egress = policy
+	}
+	if rule != nil && rule.egress != nil {
+		result.egress = rule.egress
+	}
+	result.Egress = result.egress.String()
+	return result
+}
+
+// handleRouteAPI explains how a connection would be routed under the current
+// configuration: /api/route?dest=host:port&client=ip[&user=name][&listener=name].
+func handleRouteAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	query := r.URL.Query()
+	dest, client := query.Get("dest"), query.Get("client")
+	if _, _, ok := splitDestination(dest); !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "dest must be host:port"})
+		return
+	}
+	if _, err := netip.ParseAddr(client); client != "" && err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "client must be an IP address"})
+		return
+	}
+
+	cfg := liveConfig.get().forListener(query.Get("listener"))
+	json.NewEncoder(w).Encode(struct {
+		Destination string `json:"destination"`
+		Client      string `json:"client"`
+		User        string `json:"user,omitempty"`
+		Listener    string `json:"listener,omitempty"`
+		Version     int64  `json:"config_version"`
+		routeDecision
+	}{dest, client, query.Get("user"), query.Get("listener"), cfg.version, cfg.routeConnection(client, query.Get("user"), dest)})
+}
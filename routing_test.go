@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRoutingTable tests that route rules match on destination, client, user and listener
+func TestRoutingTable(t *testing.T) {
+	config := &Config{
+		Upstreams: []UpstreamConfig{{Name: "corp", URL: "http://parent.test:3128"}},
+		Routes: []RouteRule{
+			{Name: "block-smtp", Ports: []string{"25"}, Action: "reject"},
+			{Name: "office", Clients: []string{"10.1.0.0/16"}, Hosts: []string{"*.example.com"}, Action: "upstream", Upstream: "corp"},
+			{Users: []string{"*"}, Listeners: []string{"vpn"}, Action: "upstream", Upstream: "corp"},
+			{Users: []string{"bob"}, Action: "reject"},
+		},
+		Destinations: DestinationConfig{Rules: []DestinationRule{{Action: "deny", Hosts: []string{"blocked.test"}}}},
+	}
+	cfg, err := newProxyConfig(config)
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	vpn := cfg.forListener("vpn")
+
+	tests := []struct {
+		cfg     *proxyConfig
+		client  string
+		user    string
+		address string
+		rule    string
+		action  string
+		route   string
+	}{
+		{cfg, "10.1.2.3", "", "mail.example.com:25", "route 'block-smtp'", routeActionReject, ""},
+		{cfg, "10.1.2.3", "", "www.example.com:443", "route 'office'", routeActionUpstream, "corp"},
+		{cfg, "10.2.0.1", "", "www.example.com:443", "destinations default", routeActionDirect, "direct"},
+		{vpn, "10.2.0.1", "alice", "other.test:443", "route 3", routeActionUpstream, "corp"},
+		{vpn, "10.2.0.1", "", "other.test:443", "destinations default", routeActionDirect, "direct"},
+		{cfg, "10.2.0.1", "bob", "other.test:443", "route 4", routeActionReject, ""},
+		{cfg, "10.1.2.3", "", "blocked.test:443", "destination rule 1", routeActionReject, ""},
+	}
+	for _, tt := range tests {
+		decision := tt.cfg.routeConnection(tt.client, tt.user, tt.address)
+		if decision.Rule != tt.rule || decision.Action != tt.action || decision.Route != tt.route {
+			t.Errorf("Routing %s for %s/%q: got %+v, want %s %s %q", tt.address, tt.client, tt.user, decision, tt.rule, tt.action, tt.route)
+		}
+	}
+
+	for _, rule := range []RouteRule{
+		{Action: "drop"},
+		{Action: "upstream", Upstream: "missing"},
+		{Action: "direct", Upstream: "corp"},
+		{Action: "direct", Clients: []string{"not-an-ip"}},
+		{Action: "direct", Ports: []string{"0"}},
+	} {
+		config.Routes = []RouteRule{rule}
+		if _, err := newProxyConfig(config); err == nil {
+			t.Errorf("Expected route %+v to be rejected", rule)
+		}
+	}
+}
+
+// TestRouteAPI tests that the route endpoint explains the decision for the current configuration
+func TestRouteAPI(t *testing.T) {
+	cfg, err := newProxyConfig(&Config{
+		Upstreams: []UpstreamConfig{{Name: "corp", URL: "http://parent.test:3128"}},
+		Routes:    []RouteRule{{Name: "via-corp", Hosts: []string{"*.example.com"}, Action: "upstream", Upstream: "corp"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	saved := liveConfig.get()
+	defer liveConfig.current.Store(saved)
+	liveConfig.current.Store(cfg)
+
+	recorder := httptest.NewRecorder()
+	handleRouteAPI(recorder, httptest.NewRequest("GET", "/api/route?dest=www.example.com:443&client=192.0.2.1", nil))
+	var result map[string]interface{}
+	if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode route: %v", err)
+	}
+	if result["rule"] != "route 'via-corp'" || result["action"] != routeActionUpstream || result["route"] != "corp" {
+		t.Errorf("Unexpected route explanation: %v", result)
+	}
+
+	for _, query := range []string{"dest=www.example.com", "dest=www.example.com:443&client=nobody"} {
+		recorder = httptest.NewRecorder()
+		handleRouteAPI(recorder, httptest.NewRequest("GET", "/api/route?"+query, nil))
+		if recorder.Code != 400 {
+			t.Errorf("Expected %q to be rejected, got %d", query, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks4ReplyVersion = 0x00
+	socks4Granted      = 0x5A
+	socks4Rejected     = 0x5B
+	// socks4MaxFieldLen bounds the null-terminated USERID and domain fields.
+	socks4MaxFieldLen = 255
+)
+
+// socks4Request is a parsed SOCKS4 or SOCKS4a request.
+type socks4Request struct {
+	command byte
+	address string
+	userID  string
+	is4a    bool
+}
+
+// readSocks4Request reads a SOCKS4/4a request, including the USERID field and
+// the 4a domain name extension (DSTIP of 0.0.0.x with x != 0).
+func readSocks4Request(reader *bufio.Reader) (*socks4Request, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("failed to read request: %v", err)
+	}
+	if header[0] != socks4Version {
+		return nil, fmt.Errorf("unsupported version: %d", header[0])
+	}
+
+	userID, err := readNullTerminated(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user ID: %v", err)
+	}
+
+	port := binary.BigEndian.Uint16(header[2:4])
+	ip := net.IP(header[4:8])
+	request := &socks4Request{command: header[1], userID: userID}
+
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		domain, err := readNullTerminated(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read domain: %v", err)
+		}
+		host = domain
+		request.is4a = true
+	}
+	request.address = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	return request, nil
+}
+
+// readNullTerminated reads a string terminated by a zero byte.
+func readNullTerminated(reader *bufio.Reader) (string, error) {
+	var value []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0x00 {
+			return string(value), nil
+		}
+		if len(value) >= socks4MaxFieldLen {
+			return "", fmt.Errorf("field longer than %d bytes", socks4MaxFieldLen)
+		}
+		value = append(value, b)
+	}
+}
+
+// socks4Reply builds a SOCKS4 reply with the given status and bound address.
+func socks4Reply(status byte, bindAddr net.Addr) []byte {
+	reply := []byte{socks4ReplyVersion, status, 0, 0, 0, 0, 0, 0}
+	if tcpAddr, ok := bindAddr.(*net.TCPAddr); ok {
+		binary.BigEndian.PutUint16(reply[2:4], uint16(tcpAddr.Port))
+		if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+			copy(reply[4:8], ip4)
+		}
+	}
+	return reply
+}
+
+func handleSocks4(clientConn net.Conn, reader *bufio.Reader, cfg *proxyConfig, debug bool, connID, clientIP string) {
+	request, err := readSocks4Request(reader)
+	if err != nil {
+		if debug {
+			log.Printf("SOCKS4: %v", err)
+		}
+		return
+	}
+	clientConn.SetDeadline(time.Time{})
+
+	protocol := "SOCKS4"
+	if request.is4a {
+		protocol = "SOCKS4a"
+	}
+	if debug {
+		log.Printf("%s: Request from %s (user ID '%s') for %s", protocol, clientIP, request.userID, request.address)
+	}
+
+	release, err := cfg.admit(clientIP, cfg.access.certUser)
+	if err != nil {
+		if debug {
+			log.Printf("%s: %v", protocol, err)
+		}
+		recordRefused(err)
+		clientConn.Write(socks4Reply(socks4Rejected, nil))
+		return
+	}
+	defer release()
+
+	if request.command != connectCmd {
+		if debug {
+			log.Printf("%s: Unsupported command: %d", protocol, request.command)
+		}
+		clientConn.Write(socks4Reply(socks4Rejected, nil))
+		return
+	}
+
+	decision := cfg.routeConnection(clientIP, cfg.access.certUser, request.address)
+	if decision.rejected() {
+		if debug {
+			log.Printf("%s: Destination '%s' blocked for %s by %s", protocol, request.address, clientIP, decision.Rule)
+		}
+		recordBlocked()
+		clientConn.Write(socks4Reply(socks4Rejected, nil))
+		return
+	}
+
+	// Register connection in monitoring system
+	addConnection(connID, cfg.listener, clientIP, cfg.access.certUser, protocol, request.address)
+	attachCloser(connID, clientConn)
+	attachShaper(connID, cfg.shaperFor(clientIP, cfg.access.certUser, request.address))
+	defer removeConnection(connID)
+
+	destConn, err := cfg.dialDestination(connID, clientIP, request.address, decision)
+	if err != nil {
+		if debug {
+			log.Printf("%s: Failed to connect to destination '%s': %v", protocol, request.address, err)
+		}
+		if errors.Is(err, errDestinationBlocked) {
+			recordBlocked()
+		}
+		clientConn.Write(socks4Reply(socks4Rejected, nil))
+		return
+	}
+	defer destConn.Close()
+	tunnel := newTunnel(cfg, connID, clientConn, destConn)
+	attachCloser(connID, tunnel)
+
+	clientConn.Write(socks4Reply(socks4Granted, destConn.LocalAddr()))
+
+	if debug {
+		log.Printf("%s: Relaying data for %s", protocol, request.address)
+	}
+
+	tunnel.relay(reader, destConn, cfg.buffers.Relay)
+}
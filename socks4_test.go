@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// TestReadSocks4Request tests parsing of SOCKS4 and SOCKS4a CONNECT requests
+func TestReadSocks4Request(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		address string
+		userID  string
+		is4a    bool
+	}{
+		{
+			name:    "SOCKS4",
+			request: []byte{0x04, 0x01, 0x1F, 0x91, 192, 0, 2, 1, 'b', 'o', 'b', 0x00},
+			address: "192.0.2.1:8081",
+			userID:  "bob",
+		},
+		{
+			name:    "SOCKS4a",
+			request: append([]byte{0x04, 0x01, 0x00, 0x50, 0, 0, 0, 1, 0x00}, "example.com\x00"...),
+			address: "example.com:80",
+			is4a:    true,
+		},
+	}
+	for _, tt := range tests {
+		request, err := readSocks4Request(bufio.NewReader(bytes.NewReader(tt.request)))
+		if err != nil {
+			t.Fatalf("%s: failed to parse request: %v", tt.name, err)
+		}
+		if request.command != connectCmd || request.address != tt.address || request.userID != tt.userID || request.is4a != tt.is4a {
+			t.Errorf("%s: unexpected request %+v", tt.name, request)
+		}
+	}
+}
+
+// TestReadSocks4RequestRejectsUnterminatedUserID tests that oversized user IDs are refused
+func TestReadSocks4RequestRejectsUnterminatedUserID(t *testing.T) {
+	request := append([]byte{0x04, 0x01, 0x00, 0x50, 192, 0, 2, 1}, bytes.Repeat([]byte{'a'}, 300)...)
+	if _, err := readSocks4Request(bufio.NewReader(bytes.NewReader(request))); err == nil {
+		t.Error("Expected an error for an unterminated user ID")
+	}
+}
+
+// TestSocks4AdmissionBeforeRules tests that a refused client is not also counted as blocked
+func TestSocks4AdmissionBeforeRules(t *testing.T) {
+	withUsageStore(t)
+	cfg, err := newProxyConfig(&Config{
+		Quotas:       QuotaConfig{PerClient: QuotaLimit{Monthly: 100}},
+		Destinations: DestinationConfig{Rules: []DestinationRule{{Action: "deny", Hosts: []string{"10.0.0.0/8"}}}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	usage.record("192.0.2.1", "", 100)
+
+	stats.mutex.RLock()
+	blocked, exceeded := stats.BlockedConnections, stats.QuotaExceededConnections
+	stats.mutex.RUnlock()
+
+	client, proxy := tcpPair(t)
+	go handleSocks4(proxy, bufio.NewReader(proxy), cfg, false, "", "192.0.2.1")
+	client.Write([]byte{0x04, 0x01, 0x00, 0x50, 10, 0, 0, 1, 0x00})
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(client, reply); err != nil || reply[1] != socks4Rejected {
+		t.Fatalf("Expected the request to be rejected, got %v, %v", reply, err)
+	}
+
+	stats.mutex.RLock()
+	defer stats.mutex.RUnlock()
+	if stats.BlockedConnections != blocked || stats.QuotaExceededConnections != exceeded+1 {
+		t.Errorf("Expected only the quota refusal to be counted, got %d blocked and %d refused",
+			stats.BlockedConnections-blocked, stats.QuotaExceededConnections-exceeded)
+	}
+}
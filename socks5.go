@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// SOCKS5 reply codes (RFC 1928 section 6).
+const (
+	socks5Succeeded            = 0x00
+	socks5GeneralFailure       = 0x01
+	socks5RulesetDenied        = 0x02
+	socks5NetworkUnreachable   = 0x03
+	socks5HostUnreachable      = 0x04
+	socks5ConnectionRefused    = 0x05
+	socks5TTLExpired           = 0x06
+	socks5CommandNotSupported  = 0x07
+	socks5AddrTypeNotSupported = 0x08
+)
+
+// errUnsupportedAddrType is returned when a SOCKS5 request uses an unknown ATYP.
+var errUnsupportedAddrType = errors.New("unsupported address type")
+
+// readSocks5Address reads DST.ADDR and DST.PORT for the given address type and
+// returns them as a "host:port" string.
+func readSocks5Address(reader io.Reader, addrType byte) (string, error) {
+	var host string
+	switch addrType {
+	case ipv4Addr:
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(reader, addr); err != nil {
+			return "", fmt.Errorf("failed to read IPv4 address: %v", err)
+		}
+		host = net.IP(addr).String()
+	case domainAddr:
+		lenByte := make([]byte, 1)
+		if _, err := io.ReadFull(reader, lenByte); err != nil {
+			return "", fmt.Errorf("failed to read domain length: %v", err)
+		}
+		domain := make([]byte, lenByte[0])
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return "", fmt.Errorf("failed to read domain: %v", err)
+		}
+		host = string(domain)
+	case ipv6Addr:
+		addr := make([]byte, 16)
+		if _, err := io.ReadFull(reader, addr); err != nil {
+			return "", fmt.Errorf("failed to read IPv6 address: %v", err)
+		}
+		host = net.IP(addr).String()
+	default:
+		return "", fmt.Errorf("%w: %d", errUnsupportedAddrType, addrType)
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(reader, portBytes); err != nil {
+		return "", fmt.Errorf("failed to read port: %v", err)
+	}
+	port := binary.BigEndian.Uint16(portBytes)
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// appendSocks5Address appends ATYP, address and port for addr to buf.
+// A nil or non-IP address is encoded as 0.0.0.0:0.
+func appendSocks5Address(buf []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		buf = append(buf, ipv4Addr)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, ipv6Addr)
+		buf = append(buf, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(port))
+}
+
+// socks5ReplyCode maps a dial error to the matching RFC 1928 reply code.
+func socks5ReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errDestinationBlocked):
+		return socks5RulesetDenied
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5NetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socks5HostUnreachable
+	case errors.Is(err, syscall.ETIMEDOUT), errors.As(err, &netErr) && netErr.Timeout():
+		return socks5TTLExpired
+	default:
+		return socks5GeneralFailure
+	}
+}
+
+// socks5Reply builds a SOCKS5 reply with the given REP code and bound address.
+func socks5Reply(rep byte, bindAddr net.Addr) []byte {
+	return appendSocks5Address([]byte{socks5Version, rep, 0x00}, bindAddr)
+}
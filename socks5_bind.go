@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// bindAcceptTimeout bounds how long a BIND listener waits for the expected peer.
+const bindAcceptTimeout = 2 * time.Minute
+
+// handleSocks5Bind implements the BIND command: it listens for a single inbound
+// connection from the peer the client declared and relays it to the client.
+// The declared peer is subject to the destination rules, routing rules and
+// SSRF guard like a CONNECT destination.
+func handleSocks5Bind(clientConn net.Conn, reader *bufio.Reader, cfg *proxyConfig, debug bool, connID, clientIP, username, declared string) {
+	decision := cfg.routeConnection(clientIP, username, declared)
+	if decision.rejected() {
+		if debug {
+			log.Printf("SOCKS5-BIND: Peer '%s' blocked for %s by %s", declared, clientIP, decision.Rule)
+		}
+		recordBlocked()
+		clientConn.Write(socks5Reply(socks5RulesetDenied, nil))
+		return
+	}
+
+	allowedPeers, err := cfg.resolveBindPeer(clientIP, declared)
+	if err != nil {
+		if debug {
+			log.Printf("SOCKS5-BIND: Failed to resolve declared peer '%s': %v", declared, err)
+		}
+		if errors.Is(err, errDestinationBlocked) {
+			recordBlocked()
+		}
+		clientConn.Write(socks5Reply(socks5ReplyCode(err), nil))
+		return
+	}
+
+	listener, err := listenBind(clientConn, allowedPeers[0], decision.egress)
+	if err != nil {
+		if debug {
+			log.Printf("SOCKS5-BIND: Failed to open listener: %v", err)
+		}
+		clientConn.Write(socks5Reply(socks5GeneralFailure, nil))
+		return
+	}
+	defer listener.Close()
+
+	bindAddr := listener.Addr()
+
+	// Register connection in monitoring system
+	addConnection(connID, cfg.listener, clientIP, username, "SOCKS5-BIND", declared)
+	attachCloser(connID, listener)
+	attachShaper(connID, cfg.shaperFor(clientIP, username, declared))
+	defer removeConnection(connID)
+
+	// First reply: tell the client where the peer should connect.
+	clientConn.Write(socks5Reply(socks5Succeeded, bindAddr))
+	if debug {
+		log.Printf("SOCKS5-BIND: Listening on %s for peer %s", bindAddr, declared)
+	}
+
+	// The client sends nothing until the second reply; if its connection
+	// ends, stop waiting for the peer. If the wait ends first, the watch is
+	// interrupted with a deadline so that the relay can take over the reader.
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		if _, err := reader.Peek(1); err != nil && !isTimeout(err) {
+			listener.Close()
+		}
+	}()
+
+	listener.SetDeadline(time.Now().Add(bindAcceptTimeout))
+	var peerConn net.Conn
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if debug {
+				log.Printf("SOCKS5-BIND: No peer connected for %s: %v", declared, err)
+			}
+			clientConn.Write(socks5Reply(socks5ReplyCode(err), nil))
+			return
+		}
+		if bindPeerAllowed(conn.RemoteAddr(), allowedPeers) {
+			peerConn = conn
+			break
+		}
+		if debug {
+			log.Printf("SOCKS5-BIND: Rejected unexpected peer %s (expected %s)", conn.RemoteAddr(), declared)
+		}
+		conn.Close()
+	}
+	defer peerConn.Close()
+	listener.Close()
+	clientConn.SetReadDeadline(time.Now())
+	<-watchDone
+	clientConn.SetReadDeadline(time.Time{})
+	tunnel := newTunnel(cfg, connID, clientConn, peerConn)
+	attachCloser(connID, tunnel)
+
+	// Second reply: tell the client who connected.
+	clientConn.Write(socks5Reply(socks5Succeeded, peerConn.RemoteAddr()))
+
+	if debug {
+		log.Printf("SOCKS5-BIND: Relaying data between %s and %s", clientIP, peerConn.RemoteAddr())
+	}
+
+	tunnel.relay(reader, peerConn, cfg.buffers.Relay)
+}
+
+// resolveBindPeer returns the IPs allowed to connect to a BIND listener for
+// the client at clientIP: the addresses the declared peer resolves to that the
+// SSRF guard and destination rules permit. An unspecified declared address is
+// refused, as it would let any host connect to the client.
+func (cfg *proxyConfig) resolveBindPeer(clientIP, declared string) ([]net.IP, error) {
+	host, _, err := net.SplitHostPort(declared)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return nil, fmt.Errorf("%w: BIND requires the address of the expected peer", errDestinationBlocked)
+	}
+	ctx, cancel := cfg.dialContext()
+	defer cancel()
+	addrs, err := cfg.resolveDestination(ctx, "tcp", clientIP, declared)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		peers = append(peers, addr.Addr().AsSlice())
+	}
+	return peers, nil
+}
+
+// bindPeerAllowed reports whether addr is one of the allowed peers.
+func bindPeerAllowed(addr net.Addr, allowedPeers []net.IP) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ip := range allowedPeers {
+		if ip.Equal(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenBind opens the listener the peer should connect to on a local
+// address it can reach: the egress policy's source address for the peer, or
+// else the address the host would send from to reach it, on the egress
+// interface if there is one. The listener's address is what the client is told.
+func listenBind(clientConn net.Conn, peer net.IP, egress *egressPolicy) (*net.TCPListener, error) {
+	var config net.ListenConfig
+	if egress != nil && egress.iface != "" {
+		config.Control = bindToDevice(egress.iface)
+	}
+	local := &net.TCPAddr{IP: bindLocalIP(clientConn, peer, egress)}
+	listener, err := config.Listen(context.Background(), "tcp", local.String())
+	if err != nil {
+		return nil, err
+	}
+	return listener.(*net.TCPListener), nil
+}
+
+// bindLocalIP picks the local address to listen on for peer, falling back to
+// the address the client used to reach the proxy.
+func bindLocalIP(clientConn net.Conn, peer net.IP, egress *egressPolicy) net.IP {
+	peerAddr := net.JoinHostPort(peer.String(), "9")
+	var dialer net.Dialer
+	if egress != nil {
+		if source, err := egress.source(peerAddr); err == nil && source.IsValid() {
+			return source.AsSlice()
+		}
+		if egress.iface != "" {
+			dialer.Control = bindToDevice(egress.iface)
+		}
+	}
+	// Connecting a UDP socket sends nothing but selects the outbound source address.
+	if probe, err := dialer.Dial("udp", peerAddr); err == nil {
+		defer probe.Close()
+		if udpAddr, ok := probe.LocalAddr().(*net.UDPAddr); ok && !udpAddr.IP.IsUnspecified() {
+			return udpAddr.IP
+		}
+	}
+	if tcpAddr, ok := clientConn.LocalAddr().(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestSocks5AddressRoundTrip tests that encoded addresses decode to the same host and port
+func TestSocks5AddressRoundTrip(t *testing.T) {
+	tests := []struct {
+		addr     net.Addr
+		expected string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 8080}, "192.0.2.1:8080"},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, "[2001:db8::1]:53"},
+		{nil, "0.0.0.0:0"},
+	}
+	for _, tt := range tests {
+		encoded := appendSocks5Address(nil, tt.addr)
+		decoded, err := readSocks5Address(bytes.NewReader(encoded[1:]), encoded[0])
+		if err != nil {
+			t.Fatalf("Failed to decode %v: %v", tt.addr, err)
+		}
+		if decoded != tt.expected {
+			t.Errorf("Expected %s, got %s", tt.expected, decoded)
+		}
+	}
+}
+
+// TestReadSocks5DomainAddress tests decoding of the domain name address type
+func TestReadSocks5DomainAddress(t *testing.T) {
+	encoded := append([]byte{byte(len("example.com"))}, "example.com"...)
+	encoded = append(encoded, 0x01, 0xBB)
+	decoded, err := readSocks5Address(bytes.NewReader(encoded), domainAddr)
+	if err != nil {
+		t.Fatalf("Failed to decode domain address: %v", err)
+	}
+	if decoded != "example.com:443" {
+		t.Errorf("Expected example.com:443, got %s", decoded)
+	}
+
+	if _, err := readSocks5Address(bytes.NewReader(encoded), 0x07); !errors.Is(err, errUnsupportedAddrType) {
+		t.Errorf("Expected errUnsupportedAddrType, got %v", err)
+	}
+}
+
+// TestBindPeerAllowed tests that BIND listeners only accept the declared peer
+func TestBindPeerAllowed(t *testing.T) {
+	cfg, err := newProxyConfig(&Config{})
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	allowed, err := cfg.resolveBindPeer("192.0.2.1", "192.0.2.10:21")
+	if err != nil {
+		t.Fatalf("Failed to resolve declared peer: %v", err)
+	}
+	if !bindPeerAllowed(&net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 20}, allowed) {
+		t.Error("Expected declared peer to be allowed")
+	}
+	if bindPeerAllowed(&net.TCPAddr{IP: net.ParseIP("192.0.2.11"), Port: 20}, allowed) {
+		t.Error("Expected other peer to be rejected")
+	}
+
+	for _, declared := range []string{"0.0.0.0:0", "[::]:0", "127.0.0.1:0"} {
+		if _, err := cfg.resolveBindPeer("192.0.2.1", declared); !errors.Is(err, errDestinationBlocked) {
+			t.Errorf("Expected declared peer %s to be refused, got %v", declared, err)
+		}
+	}
+}
+
+// socks5BindRequest connects to a SOCKS5 proxy running cfg, sends a BIND
+// request for the IPv4 peer and returns the connection and the first reply.
+func socks5BindRequest(t *testing.T, cfg *proxyConfig, peer [4]byte) (net.Conn, []byte) {
+	client, proxySide := tcpPair(t)
+	go handleConnection(proxySide, cfg, &proxyListener{name: "bind", protocols: map[string]bool{protocolSOCKS5: true}}, false)
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte{socks5Version, 1, 0x00})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(client, method); err != nil || method[1] != 0x00 {
+		t.Fatalf("Failed to negotiate: %v %v", method, err)
+	}
+	client.Write(append([]byte{socks5Version, bindCmd, 0x00, ipv4Addr}, peer[0], peer[1], peer[2], peer[3], 0, 0))
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("Failed to read the first reply: %v", err)
+	}
+	return client, reply
+}
+
+// TestSocks5Bind tests both BIND replies and relaying between the client and the peer
+func TestSocks5Bind(t *testing.T) {
+	cfg, err := newProxyConfig(&Config{
+		AllowedIPs: []string{"127.0.0.1"},
+		SSRFGuard:  SSRFGuardConfig{AllowedDestinations: []string{"127.0.0.1"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	client, reply := socks5BindRequest(t, cfg, [4]byte{127, 0, 0, 1})
+	if reply[1] != socks5Succeeded {
+		t.Fatalf("Expected the first reply to succeed, got %#x", reply[1])
+	}
+	port := binary.BigEndian.Uint16(reply[8:10])
+
+	peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	if err != nil {
+		t.Fatalf("Failed to connect to the BIND address: %v", err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(client, reply); err != nil || reply[1] != socks5Succeeded {
+		t.Fatalf("Expected the second reply to succeed, got %v %v", reply, err)
+	}
+	if got := binary.BigEndian.Uint16(reply[8:10]); int(got) != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Errorf("Expected the second reply to name the peer's port %d, got %d", peer.LocalAddr().(*net.TCPAddr).Port, got)
+	}
+
+	peer.Write([]byte("from peer"))
+	buf := make([]byte, len("from peer"))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "from peer" {
+		t.Errorf("Expected the peer's data at the client, got %q %v", buf, err)
+	}
+	client.Write([]byte("from client"))
+	buf = make([]byte, len("from client"))
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "from client" {
+		t.Errorf("Expected the client's data at the peer, got %q %v", buf, err)
+	}
+}
+
+// TestSocks5BindEgress tests that BIND listens on and advertises the egress source address
+func TestSocks5BindEgress(t *testing.T) {
+	cfg, err := newProxyConfig(&Config{
+		AllowedIPs: []string{"127.0.0.1"},
+		SSRFGuard:  SSRFGuardConfig{AllowedDestinations: []string{"127.0.0.1"}},
+		Egress:     EgressConfig{Addresses: []string{"127.0.0.2"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	client, reply := socks5BindRequest(t, cfg, [4]byte{127, 0, 0, 1})
+	if reply[1] != socks5Succeeded || !net.IP(reply[4:8]).Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("Expected the egress address to be advertised, got %v", reply)
+	}
+	port := binary.BigEndian.Uint16(reply[8:10])
+
+	peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.2", strconv.Itoa(int(port))))
+	if err != nil {
+		t.Fatalf("Failed to connect to the advertised address: %v", err)
+	}
+	defer peer.Close()
+	if _, err := io.ReadFull(client, reply); err != nil || reply[1] != socks5Succeeded {
+		t.Errorf("Expected the second reply to succeed, got %v %v", reply, err)
+	}
+}
+
+// TestSocks5BindRefused tests that BIND refuses unspecified and blocked peers
+// and stops listening when the client hangs up
+func TestSocks5BindRefused(t *testing.T) {
+	cfg, err := newProxyConfig(&Config{
+		AllowedIPs:   []string{"127.0.0.1"},
+		SSRFGuard:    SSRFGuardConfig{AllowedDestinations: []string{"127.0.0.1"}},
+		Destinations: DestinationConfig{Rules: []DestinationRule{{Action: "deny", Hosts: []string{"192.0.2.0/24"}}}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	for _, peer := range [][4]byte{{0, 0, 0, 0}, {192, 0, 2, 1}, {10, 0, 0, 1}} {
+		if _, reply := socks5BindRequest(t, cfg, peer); reply[1] != socks5RulesetDenied {
+			t.Errorf("Expected BIND for %v to be refused, got %#x", peer, reply[1])
+		}
+	}
+
+	client, reply := socks5BindRequest(t, cfg, [4]byte{127, 0, 0, 1})
+	if reply[1] != socks5Succeeded {
+		t.Fatalf("Expected the first reply to succeed, got %#x", reply[1])
+	}
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(binary.BigEndian.Uint16(reply[8:10]))))
+	client.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the BIND listener to close when the client hung up")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestSocks5ReplyCode tests the mapping of dial errors to RFC 1928 reply codes
+func TestSocks5ReplyCode(t *testing.T) {
+	dialError := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	tests := []struct {
+		err      error
+		expected byte
+	}{
+		{dialError(syscall.ECONNREFUSED), socks5ConnectionRefused},
+		{dialError(syscall.ENETUNREACH), socks5NetworkUnreachable},
+		{dialError(syscall.EHOSTUNREACH), socks5HostUnreachable},
+		{dialError(syscall.ETIMEDOUT), socks5TTLExpired},
+		{&net.DNSError{Err: "no such host", Name: "invalid.example", IsNotFound: true}, socks5HostUnreachable},
+		{os.ErrDeadlineExceeded, socks5TTLExpired},
+		{errors.New("boom"), socks5GeneralFailure},
+	}
+	for _, tt := range tests {
+		if got := socks5ReplyCode(tt.err); got != tt.expected {
+			t.Errorf("socks5ReplyCode(%v) = %#x, want %#x", tt.err, got, tt.expected)
+		}
+	}
+}
+
+// udpEcho is a UDP server that echoes datagrams and counts them.
+type udpEcho struct {
+	conn     *net.UDPConn
+	received atomic.Int64
+}
+
+// startUDPEcho starts an echo server on the loopback address.
+func startUDPEcho(t *testing.T) *udpEcho {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	echo := &udpEcho{conn: conn}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			echo.received.Add(1)
+			conn.WriteToUDP(buffer[:n], from)
+		}
+	}()
+	return echo
+}
+
+// addr returns the address the echo server listens on.
+func (e *udpEcho) addr() *net.UDPAddr {
+	return e.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// socks5UDPAssociate opens a UDP association through a SOCKS5 proxy running
+// cfg and returns the controlling connection and the relay address.
+func socks5UDPAssociate(t *testing.T, cfg *proxyConfig) (net.Conn, *net.UDPAddr) {
+	control, proxySide := tcpPair(t)
+	go handleConnection(proxySide, cfg, &proxyListener{name: "udp", protocols: map[string]bool{protocolSOCKS5: true}}, false)
+
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+	control.Write([]byte{socks5Version, 1, 0x00})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(control, method); err != nil || method[1] != 0x00 {
+		t.Fatalf("Failed to negotiate: %v %v", method, err)
+	}
+	control.Write([]byte{socks5Version, udpAssociateCmd, 0x00, ipv4Addr, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(control, reply); err != nil || reply[1] != socks5Succeeded {
+		t.Fatalf("Expected the association to succeed, got %v %v", reply, err)
+	}
+	control.SetDeadline(time.Time{})
+	return control, &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:10]))}
+}
+
+// udpClient returns a UDP socket on the loopback address.
+func udpClient(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sendUDP encapsulates payload for destination and sends it to the relay.
+func sendUDP(conn *net.UDPConn, relay, destination *net.UDPAddr, frag byte, payload string) {
+	packet := appendSocks5Address([]byte{0x00, 0x00, frag}, destination)
+	conn.WriteToUDP(append(packet, payload...), relay)
+}
+
+// receiveUDP returns the source and payload of the next datagram from the
+// relay, or ok false if none arrives within wait.
+func receiveUDP(t *testing.T, conn *net.UDPConn, wait time.Duration) (source, payload string, ok bool) {
+	buffer := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(wait))
+	n, _, err := conn.ReadFromUDP(buffer)
+	if err != nil {
+		return "", "", false
+	}
+	if n < 4 || buffer[2] != 0x00 {
+		t.Fatalf("Malformed datagram from the relay: %v", buffer[:n])
+	}
+	reader := bytes.NewReader(buffer[4:n])
+	source, err = readSocks5Address(reader, buffer[3])
+	if err != nil {
+		t.Fatalf("Malformed address from the relay: %v", err)
+	}
+	return source, string(buffer[n-reader.Len() : n]), true
+}
+
+// udpFlowCount returns the number of SOCKS5-UDP flows to destination in monitoring.
+func udpFlowCount(destination string) int {
+	stats.mutex.RLock()
+	defer stats.mutex.RUnlock()
+	count := 0
+	for _, conn := range stats.ActiveConnections {
+		if conn.Protocol == "SOCKS5-UDP" && conn.Destination == destination {
+			count++
+		}
+	}
+	return count
+}
+
+// TestSocks5UDPAssociate tests encapsulation, the datagrams the relay drops and teardown
+func TestSocks5UDPAssociate(t *testing.T) {
+	cfg, err := newProxyConfig(&Config{
+		AllowedIPs: []string{"127.0.0.1"},
+		SSRFGuard:  SSRFGuardConfig{AllowedDestinations: []string{"127.0.0.1"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	echo := startUDPEcho(t)
+	control, relay := socks5UDPAssociate(t, cfg)
+	client := udpClient(t)
+
+	sendUDP(client, relay, echo.addr(), 0x00, "ping")
+	source, payload, ok := receiveUDP(t, client, 2*time.Second)
+	if !ok || source != echo.addr().String() || payload != "ping" {
+		t.Fatalf("Expected the echo from %s, got %q from %q (%v)", echo.addr(), payload, source, ok)
+	}
+	if count := udpFlowCount(echo.addr().String()); count != 1 {
+		t.Errorf("Expected one flow in monitoring, got %d", count)
+	}
+
+	// Fragments are dropped.
+	sendUDP(client, relay, echo.addr(), 0x01, "fragment")
+	if _, payload, ok := receiveUDP(t, client, 200*time.Millisecond); ok {
+		t.Errorf("Expected a fragmented datagram to be dropped, got %q", payload)
+	}
+
+	// The association is locked to the client's first source port: datagrams
+	// from another port are treated as coming from a destination the client
+	// never contacted, and dropped.
+	other := udpClient(t)
+	sendUDP(other, relay, echo.addr(), 0x00, "other port")
+	stranger := udpClient(t)
+	stranger.WriteToUDP([]byte("unsolicited"), relay)
+	if _, payload, ok := receiveUDP(t, other, 200*time.Millisecond); ok {
+		t.Errorf("Expected a datagram from another port to be dropped, got %q", payload)
+	}
+	if _, payload, ok := receiveUDP(t, client, 200*time.Millisecond); ok {
+		t.Errorf("Expected datagrams from unknown senders to be dropped, got %q", payload)
+	}
+	if received := echo.received.Load(); received != 1 {
+		t.Errorf("Expected only the first datagram to reach the destination, got %d", received)
+	}
+
+	// Closing the control connection ends the association.
+	control.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for udpFlowCount(echo.addr().String()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the flow to be removed when the control connection closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sendUDP(client, relay, echo.addr(), 0x00, "after close")
+	if _, payload, ok := receiveUDP(t, client, 200*time.Millisecond); ok {
+		t.Errorf("Expected no relaying after the association ended, got %q", payload)
+	}
+}
+
+// TestSocks5UDPSharedAddress tests that destinations resolving to the same address get their own
+// flows and that replies carry the destination each was sent to
+func TestSocks5UDPSharedAddress(t *testing.T) {
+	cfg, err := newProxyConfig(&Config{
+		AllowedIPs: []string{"127.0.0.1"},
+		SSRFGuard:  SSRFGuardConfig{AllowedDestinations: []string{"127.0.0.1"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	echo := startUDPEcho(t)
+	_, relay := socks5UDPAssociate(t, cfg)
+	client := udpClient(t)
+
+	// The same address by name; the guard only lets it resolve to 127.0.0.1.
+	named := append([]byte{0x00, 0x00, 0x00, domainAddr, byte(len("localhost"))}, "localhost"...)
+	named = binary.BigEndian.AppendUint16(named, uint16(echo.addr().Port))
+	namedDestination := net.JoinHostPort("localhost", strconv.Itoa(echo.addr().Port))
+
+	sendUDP(client, relay, echo.addr(), 0x00, "v4")
+	if source, payload, ok := receiveUDP(t, client, 2*time.Second); !ok || source != echo.addr().String() || payload != "v4" {
+		t.Fatalf("Expected the IPv4 reply from %s, got %q from %q (%v)", echo.addr(), payload, source, ok)
+	}
+	client.WriteToUDP(append(named, "name"...), relay)
+	if source, payload, ok := receiveUDP(t, client, 2*time.Second); !ok || source != namedDestination || payload != "name" {
+		t.Fatalf("Expected the reply from %s, got %q from %q (%v)", namedDestination, payload, source, ok)
+	}
+	sendUDP(client, relay, echo.addr(), 0x00, "v4 again")
+	if source, payload, ok := receiveUDP(t, client, 2*time.Second); !ok || source != echo.addr().String() || payload != "v4 again" {
+		t.Errorf("Expected the IPv4 reply again, got %q from %q (%v)", payload, source, ok)
+	}
+	if count := udpFlowCount(echo.addr().String()) + udpFlowCount(namedDestination); count != 2 {
+		t.Errorf("Expected a flow per destination, got %d", count)
+	}
+}
+
+// TestSocks5UDPShapedFlow tests that a shaped flow does not hold up the other flows
+func TestSocks5UDPShapedFlow(t *testing.T) {
+	slow, fast := startUDPEcho(t), startUDPEcho(t)
+	cfg, err := newProxyConfig(&Config{
+		AllowedIPs: []string{"127.0.0.1"},
+		SSRFGuard:  SSRFGuardConfig{AllowedDestinations: []string{"127.0.0.1"}},
+		Destinations: DestinationConfig{Rules: []DestinationRule{{
+			Action:    "allow",
+			Hosts:     []string{"127.0.0.1"},
+			Ports:     []string{strconv.Itoa(slow.addr().Port)},
+			Bandwidth: BandwidthLimit{Upload: 1000},
+		}}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	_, relay := socks5UDPAssociate(t, cfg)
+	client := udpClient(t)
+
+	for i := 0; i < 3; i++ {
+		sendUDP(client, relay, slow.addr(), 0x00, strings.Repeat("s", 800))
+	}
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	sendUDP(client, relay, fast.addr(), 0x00, "fast")
+	for {
+		source, _, ok := receiveUDP(t, client, 2*time.Second)
+		if !ok {
+			t.Fatal("Expected the unshaped flow's reply")
+		}
+		if source == fast.addr().String() {
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("Expected the unshaped flow not to wait for the shaped one, took %v", elapsed)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for slow.received.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the shaped datagrams to be delayed, not dropped; %d arrived", slow.received.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSocks5UDPFlowLimit tests that an association reaches a bounded number of destinations
+func TestSocks5UDPFlowLimit(t *testing.T) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	cfg, err := newProxyConfig(&Config{SSRFGuard: SSRFGuardConfig{Disabled: true}})
+	if err != nil {
+		t.Fatalf("Failed to build config: %v", err)
+	}
+	association := &udpAssociation{
+		relay:    relay,
+		cfg:      cfg,
+		connID:   "udp-flow-limit",
+		clientIP: "127.0.0.1",
+		flows:    make(map[string]*udpFlow),
+		blocked:  make(map[string]bool),
+	}
+	defer func() {
+		relay.Close()
+		association.close()
+	}()
+
+	for port := 1; port <= udpMaxFlows+10; port++ {
+		packet := appendSocks5Address([]byte{0x00, 0x00, 0x00}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000 + port})
+		association.forwardToDestination(append(packet, "x"...))
+	}
+	if len(association.flows) != udpMaxFlows {
+		t.Errorf("Expected the flows to be capped at %d, got %d", udpMaxFlows, len(association.flows))
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+const (
+	// udpMaxFlows caps the destinations one association may reach, and so
+	// the monitoring entries it creates.
+	udpMaxFlows = 256
+	// udpFlowQueue is how many datagrams may wait in each direction of a flow
+	// while it is shaped; further datagrams are dropped.
+	udpFlowQueue = 64
+)
+
+// udpFlow is one destination reached through a UDP association, as the
+// client addressed it. Each flow is registered as its own entry in the
+// monitoring system and has its own socket connected to the destination, so
+// that replies belong to it even if other names resolve to the same address.
+// Datagrams are sent from a queue per direction, so that shaping one flow does
+// not hold up the others or the relay socket.
+type udpFlow struct {
+	id          string
+	destination string
+	conn        *net.UDPConn
+	header      []byte           // SOCKS5 UDP header the client used, repeated on replies
+	outbound    chan udpDatagram // to the destination
+	inbound     chan udpDatagram // to the client
+	received    chan struct{}    // closed once receive has returned
+}
+
+// udpDatagram is a datagram waiting to be sent.
+type udpDatagram struct {
+	packet  []byte
+	payload int // bytes of payload, as counted in monitoring
+}
+
+// udpAssociation relays datagrams between one SOCKS5 client and its destinations.
+type udpAssociation struct {
+	relay        *net.UDPConn
+	cfg          *proxyConfig
+	debug        bool
+	connID       string
+	clientIP     string
+	username     string
+	clientAddr   netip.Addr     // IP the client must send from
+	declaredPort uint16         // port the client declared in its request, 0 if unknown
+	clientPort   netip.AddrPort // full client address once the first datagram arrives
+	flows        map[string]*udpFlow
+	blocked      map[string]bool // destinations refused by the rules, counted once
+}
+
+// handleSocks5UDPAssociate implements the UDP ASSOCIATE command. The relay
+// socket stays open for as long as the controlling TCP connection does.
+func handleSocks5UDPAssociate(clientConn net.Conn, reader *bufio.Reader, cfg *proxyConfig, debug bool, connID, clientIP, username, declared string) {
+	clientAddr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		if debug {
+			log.Printf("SOCKS5-UDP: Invalid client IP '%s': %v", clientIP, err)
+		}
+		clientConn.Write(socks5Reply(socks5GeneralFailure, nil))
+		return
+	}
+
+	var declaredPort uint16
+	if _, portStr, err := net.SplitHostPort(declared); err == nil {
+		if port, err := strconv.ParseUint(portStr, 10, 16); err == nil {
+			declaredPort = uint16(port)
+		}
+	}
+
+	// The relay socket only talks to the client; advertise the address the
+	// client already used to reach us.
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		if debug {
+			log.Printf("SOCKS5-UDP: Failed to open relay socket: %v", err)
+		}
+		clientConn.Write(socks5Reply(socks5GeneralFailure, nil))
+		return
+	}
+	defer relay.Close()
+
+	bindAddr := &net.UDPAddr{Port: relay.LocalAddr().(*net.UDPAddr).Port}
+	if tcpAddr, ok := clientConn.LocalAddr().(*net.TCPAddr); ok {
+		bindAddr.IP = tcpAddr.IP
+	}
+	clientConn.Write(socks5Reply(socks5Succeeded, bindAddr))
+
+	if debug {
+		log.Printf("SOCKS5-UDP: Relay for %s listening on %s", clientIP, bindAddr)
+	}
+
+	// The association terminates when the controlling TCP connection closes.
+	go func() {
+		io.Copy(io.Discard, reader)
+		relay.Close()
+	}()
+
+	association := &udpAssociation{
+		relay:        relay,
+		cfg:          cfg,
+		debug:        debug,
+		connID:       connID,
+		clientIP:     clientIP,
+		username:     username,
+		clientAddr:   clientAddr.Unmap(),
+		declaredPort: declaredPort,
+		flows:        make(map[string]*udpFlow),
+		blocked:      make(map[string]bool),
+	}
+	defer association.close()
+	association.serve()
+}
+
+// serve reads datagrams from the relay socket until it is closed.
+func (a *udpAssociation) serve() {
+	size := a.cfg.buffers.UDP
+	if size <= 0 {
+		size = defaultUDPBufferSize
+	}
+	buffer := make([]byte, size)
+	for {
+		n, from, err := a.relay.ReadFromUDPAddrPort(buffer)
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+		// Replies arrive on the flows' own sockets; anything else is dropped.
+		if a.isClient(from) {
+			a.forwardToDestination(buffer[:n])
+		}
+	}
+}
+
+// isClient reports whether a datagram from addr was sent by the associated
+// client, locking onto the client's source port on first use.
+func (a *udpAssociation) isClient(addr netip.AddrPort) bool {
+	if a.clientPort.IsValid() {
+		return addr == a.clientPort
+	}
+	if addr.Addr() != a.clientAddr {
+		return false
+	}
+	if a.declaredPort != 0 && addr.Port() != a.declaredPort {
+		return false
+	}
+	a.clientPort = addr
+	return true
+}
+
+// forwardToDestination decapsulates a client datagram and sends its payload on.
+func (a *udpAssociation) forwardToDestination(packet []byte) {
+	if len(packet) < 4 {
+		return
+	}
+	// Fragmentation is not supported: drop any datagram with FRAG != 0.
+	if packet[2] != 0x00 {
+		if a.debug {
+			log.Printf("SOCKS5-UDP: Dropping fragmented datagram (FRAG=%d)", packet[2])
+		}
+		return
+	}
+
+	headerReader := bytes.NewReader(packet[4:])
+	destination, err := readSocks5Address(headerReader, packet[3])
+	if err != nil {
+		if a.debug {
+			log.Printf("SOCKS5-UDP: Dropping datagram: %v", err)
+		}
+		return
+	}
+	header := packet[:len(packet)-headerReader.Len()]
+	payload := packet[len(header):]
+
+	if a.blocked[destination] {
+		return
+	}
+	// Datagrams are always relayed directly, but reject routes apply to them.
+	if decision := a.cfg.routeConnection(a.clientIP, a.username, destination); decision.rejected() {
+		if a.debug {
+			log.Printf("SOCKS5-UDP: Destination '%s' blocked for %s by %s", destination, a.clientIP, decision.Rule)
+		}
+		a.blocked[destination] = true
+		recordBlocked()
+		return
+	}
+
+	flow, err := a.flow(destination, header)
+	if err != nil {
+		if a.debug {
+			log.Printf("SOCKS5-UDP: Dropping datagram for '%s': %v", destination, err)
+		}
+		if errors.Is(err, errDestinationBlocked) {
+			a.blocked[destination] = true
+			recordBlocked()
+		}
+		return
+	}
+
+	a.enqueue(flow, true, udpDatagram{packet: bytes.Clone(payload), payload: len(payload)})
+}
+
+// receive encapsulates the datagrams flow's destination sends, with the
+// header the client addressed it by, and queues them for the client until
+// the flow's socket is closed.
+func (a *udpAssociation) receive(flow *udpFlow) {
+	defer close(flow.received)
+	size := a.cfg.buffers.UDP
+	if size <= 0 {
+		size = defaultUDPBufferSize
+	}
+	buffer := make([]byte, size)
+	for {
+		n, err := flow.conn.Read(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// A connected UDP socket reports ICMP errors from earlier sends.
+			continue
+		}
+		packet := append(bytes.Clone(flow.header), buffer[:n]...)
+		a.enqueue(flow, false, udpDatagram{packet: packet, payload: n})
+	}
+}
+
+// enqueue queues a datagram in one direction of flow, dropping it if the
+// queue is full.
+func (a *udpAssociation) enqueue(flow *udpFlow, outbound bool, datagram udpDatagram) {
+	queue := flow.inbound
+	if outbound {
+		queue = flow.outbound
+	}
+	select {
+	case queue <- datagram:
+	default:
+		if a.debug {
+			log.Printf("SOCKS5-UDP: Dropping datagram for flow %s, queue full", flow.destination)
+		}
+	}
+}
+
+// send sends the datagrams queued in one direction of flow, paced by the
+// flow's shaper, until the queue is closed.
+func (a *udpAssociation) send(flow *udpFlow, outbound bool) {
+	queue := flow.inbound
+	if outbound {
+		queue = flow.outbound
+	}
+	for datagram := range queue {
+		var err error
+		if outbound {
+			_, err = flow.conn.Write(datagram.packet)
+		} else {
+			// The client port is set before the first flow is created.
+			_, err = a.relay.WriteToUDPAddrPort(datagram.packet, a.clientPort)
+		}
+		if err != nil {
+			if a.debug {
+				log.Printf("SOCKS5-UDP: Failed to send datagram for flow %s: %v", flow.destination, err)
+			}
+			continue
+		}
+		if outbound {
+			updateBandwidth(flow.id, 0, int64(datagram.payload))
+		} else {
+			updateBandwidth(flow.id, int64(datagram.payload), 0)
+		}
+		throttle(flow.id, outbound, datagram.payload)
+	}
+}
+
+// flow returns the flow for destination, resolving, connecting and registering
+// it on first use. header is the SOCKS5 UDP header the client addressed it by.
+func (a *udpAssociation) flow(destination string, header []byte) (*udpFlow, error) {
+	if flow, exists := a.flows[destination]; exists {
+		return flow, nil
+	}
+	if len(a.flows) >= udpMaxFlows {
+		return nil, fmt.Errorf("association already has %d flows", len(a.flows))
+	}
+
+	ctx, cancel := a.cfg.dialContext()
+	defer cancel()
+	addrs, err := a.cfg.resolveDestination(ctx, "udp", a.clientIP, destination)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(addrs[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	flow := &udpFlow{
+		id:          fmt.Sprintf("%s_udp_%d", a.connID, len(a.flows)),
+		destination: destination,
+		conn:        conn,
+		header:      bytes.Clone(header),
+		outbound:    make(chan udpDatagram, udpFlowQueue),
+		inbound:     make(chan udpDatagram, udpFlowQueue),
+		received:    make(chan struct{}),
+	}
+	a.flows[destination] = flow
+	addConnection(flow.id, a.cfg.listener, a.clientIP, a.username, "SOCKS5-UDP", destination)
+	attachCloser(flow.id, a.relay)
+	attachShaper(flow.id, a.cfg.shaperFor(a.clientIP, a.username, destination))
+	go a.send(flow, true)
+	go a.send(flow, false)
+	go a.receive(flow)
+
+	if a.debug {
+		log.Printf("SOCKS5-UDP: New flow from %s to %s", a.clientIP, destination)
+	}
+	return flow, nil
+}
+
+// close stops sending and unregisters every flow of the association from monitoring.
+func (a *udpAssociation) close() {
+	for _, flow := range a.flows {
+		flow.conn.Close()
+		<-flow.received
+		close(flow.outbound)
+		close(flow.inbound)
+		removeConnection(flow.id)
+	}
+	if a.debug {
+		log.Printf("SOCKS5-UDP: Association for %s closed after %d flows", a.clientIP, len(a.flows))
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// errDestinationBlocked is returned when every address a destination resolves
+// to is refused by the SSRF guard.
+var errDestinationBlocked = errors.New("destination not allowed")
+
+// internalRanges lists special-purpose ranges not covered by the netip
+// predicates used in isInternalAddr.
+var internalRanges = mustPrefixSet(
+	"0.0.0.0/8",      // "this network"
+	"100.64.0.0/10",  // carrier-grade NAT, also used for some cloud metadata services
+	"192.0.0.0/24",   // IETF protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved and limited broadcast
+	"64:ff9b:1::/48", // local-use NAT64
+)
+
+// SSRFGuardConfig configures which internal destinations clients may reach.
+type SSRFGuardConfig struct {
+	// Disabled turns the guard off so that any resolved address may be dialed.
+	Disabled bool `yaml:"disabled"`
+	// AllowedDestinations lists internal addresses and CIDR ranges every client may reach.
+	AllowedDestinations []string          `yaml:"allowed_destinations"`
+	ClientGroups        []SSRFClientGroup `yaml:"client_groups"`
+}
+
+// SSRFClientGroup grants extra internal destinations to the listed clients.
+type SSRFClientGroup struct {
+	Clients             []string `yaml:"clients"`
+	AllowedDestinations []string `yaml:"allowed_destinations"`
+}
+
+type ssrfClientGroup struct {
+	clients *prefixSet
+	allowed *prefixSet
+}
+
+// ssrfGuard keeps clients from reaching loopback, private, link-local and
+// multicast addresses unless they are explicitly allowed.
+type ssrfGuard struct {
+	disabled bool
+	allowed  *prefixSet
+	groups   []ssrfClientGroup
+}
+
+// mustPrefixSet builds a prefixSet from entries known to be valid.
+func mustPrefixSet(entries ...string) *prefixSet {
+	set, err := newPrefixSet(entries)
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+// newSSRFGuard compiles the ssrf_guard section of the config.
+func newSSRFGuard(config SSRFGuardConfig) (*ssrfGuard, error) {
+	allowed, err := newPrefixSet(config.AllowedDestinations)
+	if err != nil {
+		return nil, fmt.Errorf("ssrf_guard allowed_destinations: %v", err)
+	}
+	guard := &ssrfGuard{disabled: config.Disabled, allowed: allowed}
+	for i, group := range config.ClientGroups {
+		clients, err := newPrefixSet(group.Clients)
+		if err != nil {
+			return nil, fmt.Errorf("ssrf_guard client group %d: %v", i+1, err)
+		}
+		groupAllowed, err := newPrefixSet(group.AllowedDestinations)
+		if err != nil {
+			return nil, fmt.Errorf("ssrf_guard client group %d: %v", i+1, err)
+		}
+		guard.groups = append(guard.groups, ssrfClientGroup{clients: clients, allowed: groupAllowed})
+	}
+	return guard, nil
+}
+
+// isInternalAddr reports whether addr is not a public unicast address.
+func isInternalAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsMulticast() || internalRanges.contains(addr)
+}
+
+// permits reports whether the client at clientIP may connect to addr.
+func (g *ssrfGuard) permits(clientIP string, addr netip.Addr) bool {
+	if g.disabled || !isInternalAddr(addr) || g.allowed.contains(addr) {
+		return true
+	}
+	client, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return false
+	}
+	for _, group := range g.groups {
+		if group.clients.contains(client) && group.allowed.contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLiteral refuses address if its host is an IP literal the client may not reach.
+func (g *ssrfGuard) checkLiteral(clientIP, address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && !g.permits(clientIP, addr.Unmap()) {
+		return fmt.Errorf("%w: %s is an internal address", errDestinationBlocked, address)
+	}
+	return nil
+}
+
+// resolve looks up address once and returns the resolved addresses the client
+// may connect to. Callers dial these exact addresses rather than the name, so
+// a second lookup cannot be used to rebind the name to an internal address.
+func (g *ssrfGuard) resolve(ctx context.Context, network, clientIP, address string) ([]netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort(network, portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else {
+		addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var permitted []netip.AddrPort
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if g.permits(clientIP, addr) {
+			permitted = append(permitted, netip.AddrPortFrom(addr, uint16(port)))
+		}
+	}
+	if len(permitted) == 0 {
+		return nil, fmt.Errorf("%w: %s resolves only to internal addresses", errDestinationBlocked, address)
+	}
+	return permitted, nil
+}
+
+// resolveDestination resolves address for the client at clientIP and returns
+// the addresses both the SSRF guard and the destination rules permit.
+func (cfg *proxyConfig) resolveDestination(ctx context.Context, network, clientIP, address string) ([]netip.AddrPort, error) {
+	resolved, err := cfg.guard.resolve(ctx, network, clientIP, address)
+	if err != nil {
+		return nil, err
+	}
+	var permitted []netip.AddrPort
+	for _, addr := range resolved {
+		if cfg.destinations.permitsResolved(address, addr) {
+			permitted = append(permitted, addr)
+		}
+	}
+	if len(permitted) == 0 {
+		return nil, fmt.Errorf("%w: %s resolves only to denied addresses", errDestinationBlocked, address)
+	}
+	return permitted, nil
+}
+
+// dialContext returns a context bounded by the configured dial timeout.
+func (cfg *proxyConfig) dialContext() (context.Context, context.CancelFunc) {
+	if cfg.timeouts.Dial <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), cfg.timeouts.Dial)
+}
+
+// dialDestination connects to address on behalf of the client at clientIP,
+// directly or through the upstreams or upstream pool the decision names, from
+// the decision's egress, and records the route, local address and dial time
+// on the connection connID. Resolution and all connection attempts together are
+// bounded by the dial timeout.
+func (cfg *proxyConfig) dialDestination(connID, clientIP, address string, decision routeDecision) (net.Conn, error) {
+	ctx, cancel := cfg.dialContext()
+	defer cancel()
+
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	switch {
+	case decision.pool != nil || len(decision.route) > 0:
+		// The last upstream resolves names itself; only IP literals can be checked here.
+		if err := cfg.guard.checkLiteral(clientIP, address); err != nil {
+			return nil, err
+		}
+		if decision.pool != nil {
+			conn, err = decision.pool.dial(ctx, connID, clientIP, address, decision.egress)
+		} else {
+			attachRoute(connID, decision.route.String())
+			conn, err = decision.route.dial(ctx, decision.egress, address)
+		}
+	default:
+		attachRoute(connID, routeDirect)
+		conn, err = cfg.dialDirect(ctx, clientIP, address, decision.egress)
+	}
+	elapsed := time.Since(start)
+	dialLatencies.record(elapsed, err)
+	if err != nil {
+		return nil, err
+	}
+	attachDial(connID, localIP(conn), elapsed)
+	return conn, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+// TestSSRFGuardPermits tests the internal address categories and client group exceptions
+func TestSSRFGuardPermits(t *testing.T) {
+	guard, err := newSSRFGuard(SSRFGuardConfig{
+		AllowedDestinations: []string{"10.20.0.0/16"},
+		ClientGroups: []SSRFClientGroup{
+			{Clients: []string{"127.0.0.1", "::1"}, AllowedDestinations: []string{"127.0.0.0/8", "::1"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build guard: %v", err)
+	}
+
+	tests := []struct {
+		clientIP string
+		dest     string
+		allowed  bool
+	}{
+		{"192.0.2.10", "93.184.216.34", true},
+		{"192.0.2.10", "2606:2800:220:1::1", true},
+		{"192.0.2.10", "127.0.0.1", false},
+		{"192.0.2.10", "::ffff:127.0.0.1", false},
+		{"192.0.2.10", "::1", false},
+		{"192.0.2.10", "10.1.2.3", false},
+		{"192.0.2.10", "172.16.0.1", false},
+		{"192.0.2.10", "192.168.1.1", false},
+		{"192.0.2.10", "169.254.169.254", false},
+		{"192.0.2.10", "100.100.100.200", false},
+		{"192.0.2.10", "fe80::1", false},
+		{"192.0.2.10", "fd00:ec2::254", false},
+		{"192.0.2.10", "224.0.0.1", false},
+		{"192.0.2.10", "0.0.0.0", false},
+		{"192.0.2.10", "10.20.1.1", true},
+		{"127.0.0.1", "127.0.0.1", true},
+		{"::ffff:127.0.0.1", "127.0.0.53", true},
+		{"::1", "::1", true},
+		{"127.0.0.1", "192.168.1.1", false},
+	}
+	for _, tt := range tests {
+		if got := guard.permits(tt.clientIP, netip.MustParseAddr(tt.dest)); got != tt.allowed {
+			t.Errorf("permits(%s, %s) = %v, want %v", tt.clientIP, tt.dest, got, tt.allowed)
+		}
+	}
+
+	disabled, _ := newSSRFGuard(SSRFGuardConfig{Disabled: true})
+	if !disabled.permits("192.0.2.10", netip.MustParseAddr("127.0.0.1")) {
+		t.Error("Expected a disabled guard to permit everything")
+	}
+}
+
+// TestSSRFGuardResolve tests that names are resolved and filtered before dialing
+func TestSSRFGuardResolve(t *testing.T) {
+	guard, _ := newSSRFGuard(SSRFGuardConfig{})
+
+	if _, err := guard.resolve(context.Background(), "tcp", "192.0.2.10", "localhost:8082"); !errors.Is(err, errDestinationBlocked) {
+		t.Errorf("Expected localhost to be blocked, got %v", err)
+	}
+	if _, err := guard.resolve(context.Background(), "tcp", "192.0.2.10", "[::ffff:169.254.169.254]:80"); !errors.Is(err, errDestinationBlocked) {
+		t.Errorf("Expected mapped metadata address to be blocked, got %v", err)
+	}
+
+	addrs, err := guard.resolve(context.Background(), "tcp", "192.0.2.10", "93.184.216.34:http")
+	if err != nil {
+		t.Fatalf("Expected public address to resolve: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != "93.184.216.34:80" {
+		t.Errorf("Unexpected resolved addresses: %v", addrs)
+	}
+	if socks5ReplyCode(errDestinationBlocked) != socks5RulesetDenied {
+		t.Error("Expected blocked destinations to map to reply 0x02")
+	}
+}
@@ -185,6 +185,82 @@ function restoreExpandedDomains() {
     }
 }
 
+function clientLabel(conn) {
+    // Show the authenticated user alongside the client IP when known
+    const client = conn.username ? conn.username + '@' + conn.client_ip : conn.client_ip;
+    return client + limitBadge(conn) + halfCloseBadge(conn);
+}
+
+function halfCloseBadge(conn) {
+    // Mark tunnels where one side has finished sending while the other still is
+    if (!conn.upload_closed === !conn.download_closed) {
+        return '';
+    }
+    const closed = conn.upload_closed ? '↑ ' + conn.upload_closed : '↓ ' + conn.download_closed;
+    return ' <span class="limit-badge half-closed">' + closed + '</span>';
+}
+
+function limitBadge(conn) {
+    // Show configured bandwidth limits, highlighted while the connection is being slowed down
+    const limits = [];
+    if (conn.download_limit) {
+        limits.push('↓ ' + formatBytes(conn.download_limit));
+    }
+    if (conn.upload_limit) {
+        limits.push('↑ ' + formatBytes(conn.upload_limit));
+    }
+    if (limits.length === 0) {
+        return '';
+    }
+    const throttled = conn.upload_throttled || conn.download_throttled;
+    return ' <span class="limit-badge' + (throttled ? ' throttled' : '') + '">' + limits.join(' ') + '</span>';
+}
+
+function formatSize(bytes) {
+    // Like formatBytes, for amounts of data rather than rates
+    return formatBytes(bytes).replace('/s', '');
+}
+
+function updateQuotaWarnings(warnings) {
+    // List users and clients past their soft or hard transfer quota
+    const box = document.getElementById('quota-warnings');
+    if (!warnings || warnings.length === 0) {
+        box.style.display = 'none';
+        return;
+    }
+    box.innerHTML = '<strong>Transfer quotas</strong>' + warnings.map(w =>
+        '<div class="quota-' + w.status + '">' + w.kind + ' ' + w.principal + ': ' +
+        formatSize(w.bytes) + ' of ' + formatSize(w.limit) + ' in ' + w.period +
+        ' (' + Math.floor(w.percent) + '%)</div>').join('');
+    box.style.display = 'block';
+}
+
+function updateUpstreamPools(pools) {
+    // Show each pool member's health and share of the pool's connections
+    const section = document.getElementById('upstream-pools');
+    if (!pools || pools.length === 0) {
+        section.style.display = 'none';
+        return;
+    }
+    let tableHTML = '<table><thead><tr><th>Pool</th><th>Member</th><th>State</th><th>Active</th><th>Connections</th><th>Share</th><th>Transferred</th><th>Last Error</th></tr></thead><tbody>';
+    pools.forEach(pool => {
+        pool.members.forEach((member, i) => {
+            tableHTML += '<tr>' +
+                '<td>' + (i === 0 ? pool.name + ' (' + pool.balance + ')' : '') + '</td>' +
+                '<td>' + member.name + (member.route !== member.name ? ' (' + member.route + ')' : '') + '</td>' +
+                '<td class="member-' + member.state + '">' + member.state + '</td>' +
+                '<td>' + member.active + '</td>' +
+                '<td>' + formatNumber(member.connections) + '</td>' +
+                '<td>' + member.share.toFixed(1) + '%</td>' +
+                '<td>' + formatSize(member.bytes) + '</td>' +
+                '<td>' + (member.last_error || '') + '</td>' +
+                '</tr>';
+        });
+    });
+    document.getElementById('upstream-pools-content').innerHTML = tableHTML + '</tbody></table>';
+    section.style.display = 'block';
+}
+
 function formatNumber(num) {
     if (num >= 1000000) {
         return (num / 1000000).toFixed(1) + 'M';
@@ -197,6 +273,17 @@ function formatNumber(num) {
 function updateDashboard(data) {
     document.getElementById('total-connections').textContent = formatNumber(data.total_connections || 0);
     document.getElementById('active-connections').textContent = formatNumber(Object.keys(data.active_connections || {}).length);
+    document.getElementById('blocked-connections').textContent = formatNumber(data.blocked_connections || 0);
+    document.getElementById('rate-limited-connections').textContent = formatNumber(data.rate_limited_connections || 0);
+    document.getElementById('quota-exceeded-connections').textContent = formatNumber(data.quota_exceeded_connections || 0);
+    updateQuotaWarnings(data.quota_warnings);
+    updateUpstreamPools(data.upstream_pools);
+    const dial = data.dial_latency || {};
+    document.getElementById('dial-latency').textContent =
+        Math.round(dial.p50_ms || 0) + ' / ' + Math.round(dial.p95_ms || 0) + ' ms';
+    const throttledCount = Object.values(data.active_connections || {})
+        .filter(conn => conn.upload_throttled || conn.download_throttled).length;
+    document.getElementById('throttled-connections').textContent = formatNumber(throttledCount);
     
     // Update bandwidth display
     const bandwidthIn = data.current_bandwidth_in || 0;
@@ -257,11 +344,11 @@ function updateDashboard(data) {
             
             domainGroups[mainDomain].subdomains[subdomainKey].count++;
             domainGroups[mainDomain].subdomains[subdomainKey].protocols.add(conn.protocol);
-            domainGroups[mainDomain].subdomains[subdomainKey].client_ips.add(conn.client_ip);
+            domainGroups[mainDomain].subdomains[subdomainKey].client_ips.add(clientLabel(conn));
             
             domainGroups[mainDomain].totalCount++;
             domainGroups[mainDomain].allProtocols.add(conn.protocol);
-            domainGroups[mainDomain].allClientIps.add(conn.client_ip);
+            domainGroups[mainDomain].allClientIps.add(clientLabel(conn));
             
             if (conn.start_time < domainGroups[mainDomain].earliestStart) {
                 domainGroups[mainDomain].earliestStart = conn.start_time;
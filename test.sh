@@ -176,7 +176,7 @@ print_header "Setup & Prerequisite Checks"
 free_port $PROXY_PORT
 free_port $TEST_SERVER_PORT
 
-compile_if_needed "$PROXY_APP_NAME" "main.go" "Proxy Server"
+compile_if_needed "$PROXY_APP_NAME" "." "Proxy Server"
 compile_if_needed "$TEST_SERVER_DIR/$TEST_SERVER_APP_NAME" "$TEST_SERVER_DIR/main.go" "Test Server"
 
 start_server "Proxy Server" "$PROXY_APP_NAME" "." "$PROXY_PID_FILE"
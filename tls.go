@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Values accepted for a listener's tls client_auth setting.
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional"
+	clientAuthRequire  = "require"
+)
+
+// ListenerTLSConfig makes a listener terminate TLS before detecting the proxy
+// protocol. Certificate, key and client CA files are reloaded when they change.
+type ListenerTLSConfig struct {
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+	// ClientCAFile holds the PEM CA certificates that client certificates are verified against.
+	ClientCAFile string `yaml:"client_ca_file,omitempty"`
+	// ClientAuth is none, optional or require (default: optional if a client CA is set).
+	ClientAuth string `yaml:"client_auth,omitempty"`
+}
+
+// enabled reports whether the listener terminates TLS.
+func (c ListenerTLSConfig) enabled() bool {
+	return c.CertFile != ""
+}
+
+// validate checks that the TLS settings are complete and consistent.
+func (c ListenerTLSConfig) validate() error {
+	if !c.enabled() {
+		if c.KeyFile != "" || c.ClientCAFile != "" || c.ClientAuth != "" {
+			return fmt.Errorf("tls cert_file is required")
+		}
+		return nil
+	}
+	if c.KeyFile == "" {
+		return fmt.Errorf("tls key_file is required")
+	}
+	switch c.ClientAuth {
+	case "", clientAuthNone, clientAuthOptional, clientAuthRequire:
+	default:
+		return fmt.Errorf("tls client_auth '%s' must be none, optional or require", c.ClientAuth)
+	}
+	if c.ClientCAFile == "" && (c.ClientAuth == clientAuthOptional || c.ClientAuth == clientAuthRequire) {
+		return fmt.Errorf("tls client_auth '%s' needs a client_ca_file", c.ClientAuth)
+	}
+	return nil
+}
+
+// clientAuthType maps the client_auth setting to the crypto/tls policy.
+func (c ListenerTLSConfig) clientAuthType() tls.ClientAuthType {
+	switch {
+	case c.ClientCAFile == "" || c.ClientAuth == clientAuthNone:
+		return tls.NoClientCert
+	case c.ClientAuth == clientAuthRequire:
+		return tls.RequireAndVerifyClientCert
+	default:
+		return tls.VerifyClientCertIfGiven
+	}
+}
+
+// tlsFiles serves a listener's TLS configuration, rebuilding it whenever one
+// of its files changes on disk so certificates can be rotated without a restart.
+type tlsFiles struct {
+	config   ListenerTLSConfig
+	mutex    sync.Mutex // guards the fields below
+	current  *tls.Config
+	modTimes map[string]time.Time
+	checked  time.Time
+}
+
+// tlsCheckInterval limits how often the files are checked for changes.
+const tlsCheckInterval = time.Second
+
+// newTLSFiles loads the TLS files of a listener. They must be valid at startup.
+func newTLSFiles(config ListenerTLSConfig) (*tlsFiles, error) {
+	files := &tlsFiles{config: config}
+	if err := files.load(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// paths lists the files the TLS configuration is built from.
+func (f *tlsFiles) paths() []string {
+	paths := []string{f.config.CertFile, f.config.KeyFile}
+	if f.config.ClientCAFile != "" {
+		paths = append(paths, f.config.ClientCAFile)
+	}
+	return paths
+}
+
+// load reads the files and builds a new TLS configuration. The caller must
+// hold f.mutex unless f is not shared yet.
+func (f *tlsFiles) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, path := range f.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTimes[path] = info.ModTime()
+	}
+	// Remember these versions even if they turn out to be invalid, so that
+	// broken files are only tried again once they change.
+	f.modTimes = modTimes
+
+	cert, err := tls.LoadX509KeyPair(f.config.CertFile, f.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("could not load certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   f.config.clientAuthType(),
+		MinVersion:   tls.VersionTLS12,
+	}
+	if f.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(f.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("could not read client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file '%s'", f.config.ClientCAFile)
+		}
+		config.ClientCAs = pool
+	}
+
+	f.current = config
+	return nil
+}
+
+// changed reports whether any file differs from the version last loaded.
+// The caller must hold f.mutex.
+func (f *tlsFiles) changed() bool {
+	for _, path := range f.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false
+		}
+		if !info.ModTime().Equal(f.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverConfig returns the TLS configuration for a new client, reloading the
+// files first if they have changed. If the new files are invalid, the previous
+// configuration stays in use.
+func (f *tlsFiles) serverConfig() *tls.Config {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if time.Since(f.checked) >= tlsCheckInterval {
+		f.checked = time.Now()
+		if f.changed() {
+			if err := f.load(); err != nil {
+				log.Printf("TLS: Keeping previous certificate for %s: %v", f.config.CertFile, err)
+			} else {
+				log.Printf("TLS: Reloaded certificate %s", f.config.CertFile)
+			}
+		}
+	}
+	return f.current
+}
+
+// tlsConfig returns a crypto/tls configuration that always uses the latest files.
+func (f *tlsFiles) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return f.serverConfig(), nil
+		},
+	}
+}
+
+// clientCertUser returns the user a verified client certificate identifies,
+// taken from its subject common name, or "" if there is none.
+func clientCertUser(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a generated certificate and key, optionally signed by a CA
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert generates a certificate for commonName, self-signed if parent is nil
+func newTestCert(t *testing.T, commonName string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writePEM writes the certificate and key to cert.pem and key.pem in dir
+func (c *testCert) writePEM(t *testing.T, dir string) (certFile, keyFile string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+// tlsClient returns a client config trusting ca and presenting client, if set
+func (c *testCert) tlsClient(client *testCert) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	config := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	if client != nil {
+		// Always present the certificate, even if the server's CA list does not match it.
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &tls.Certificate{Certificate: [][]byte{client.der}, PrivateKey: client.key}, nil
+		}
+	}
+	return config
+}
+
+// handshake runs a TLS handshake over a pipe and returns the server's view of it
+func handshake(t *testing.T, server, client *tls.Config) (tls.ConnectionState, error) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+	go func() {
+		// Keep reading so that the server can send its alerts over the unbuffered pipe.
+		client := tls.Client(clientSide, client)
+		if client.Handshake() == nil {
+			io.Copy(io.Discard, client)
+		}
+	}()
+	conn := tls.Server(serverSide, server)
+	err := conn.Handshake()
+	return conn.ConnectionState(), err
+}
+
+// TestTLSFilesClientCertificates tests server certificates and client certificate identities
+func TestTLSFilesClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil, true)
+	server := newTestCert(t, "proxy", ca, false)
+	certFile, keyFile := server.writePEM(t, dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der}), 0644)
+
+	files, err := newTLSFiles(ListenerTLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile})
+	if err != nil {
+		t.Fatalf("Failed to load TLS files: %v", err)
+	}
+
+	state, err := handshake(t, files.tlsConfig(), ca.tlsClient(newTestCert(t, "alice", ca, false)))
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if user := clientCertUser(state); user != "alice" {
+		t.Errorf("Expected client certificate user 'alice', got %q", user)
+	}
+
+	state, err = handshake(t, files.tlsConfig(), ca.tlsClient(nil))
+	if err != nil || clientCertUser(state) != "" {
+		t.Errorf("Expected an optional client certificate to be skippable, got %v", err)
+	}
+
+	if _, err := handshake(t, files.tlsConfig(), ca.tlsClient(newTestCert(t, "mallory", nil, false))); err == nil {
+		t.Error("Expected a certificate from an unknown CA to be rejected")
+	}
+}
+
+// TestTLSFilesReload tests that a changed certificate is picked up and an invalid one is ignored
+func TestTLSFilesReload(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCert(t, "first", nil, false)
+	certFile, keyFile := first.writePEM(t, dir)
+	files, err := newTLSFiles(ListenerTLSConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("Failed to load TLS files: %v", err)
+	}
+
+	second := newTestCert(t, "second", nil, false)
+	second.writePEM(t, dir)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	files.checked = time.Time{}
+	if _, err := handshake(t, files.tlsConfig(), second.tlsClient(nil)); err != nil {
+		t.Errorf("Expected the rotated certificate to be served: %v", err)
+	}
+
+	os.WriteFile(certFile, []byte("not a certificate"), 0644)
+	os.Chtimes(certFile, later.Add(time.Minute), later.Add(time.Minute))
+	files.checked = time.Time{}
+	if _, err := handshake(t, files.tlsConfig(), second.tlsClient(nil)); err != nil {
+		t.Errorf("Expected the previous certificate to stay in use: %v", err)
+	}
+}
+
+// TestTLSFilesReloadInvalidOnce tests that invalid files are only tried again once they change
+func TestTLSFilesReloadInvalidOnce(t *testing.T) {
+	dir := t.TempDir()
+	cert := newTestCert(t, "proxy", nil, false)
+	certFile, keyFile := cert.writePEM(t, dir)
+	files, err := newTLSFiles(ListenerTLSConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("Failed to load TLS files: %v", err)
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	os.WriteFile(keyFile, []byte("not a key"), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	for i := 0; i < 3; i++ {
+		files.checked = time.Time{}
+		files.serverConfig()
+	}
+	if attempts := strings.Count(logged.String(), "Keeping previous certificate"); attempts != 1 {
+		t.Errorf("Expected the invalid key to be loaded once, got %d attempts", attempts)
+	}
+
+	cert.writePEM(t, dir)
+	os.Chtimes(keyFile, later.Add(time.Minute), later.Add(time.Minute))
+	files.checked = time.Time{}
+	files.serverConfig()
+	if !strings.Contains(logged.String(), "Reloaded certificate") {
+		t.Errorf("Expected the fixed key to be loaded, got log %q", logged.String())
+	}
+}
+
+// TestListenerTLSValidation tests that incomplete TLS settings are rejected
+func TestListenerTLSValidation(t *testing.T) {
+	for _, config := range []ListenerTLSConfig{
+		{KeyFile: "key.pem"},
+		{CertFile: "cert.pem"},
+		{CertFile: "cert.pem", KeyFile: "key.pem", ClientAuth: "always"},
+		{CertFile: "cert.pem", KeyFile: "key.pem", ClientAuth: clientAuthRequire},
+	} {
+		if err := config.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+	if err := (ListenerTLSConfig{CertFile: "cert.pem", KeyFile: "key.pem"}).validate(); err != nil {
+		t.Errorf("Expected certificate and key to be enough: %v", err)
+	}
+}
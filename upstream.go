@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// routeDirect is the route name of connections dialed without an upstream.
+const routeDirect = "direct"
+
+// errConnectRefused is returned when the last upstream of a route is reachable
+// but refuses or fails to connect to the destination.
+var errConnectRefused = errors.New("upstream could not connect")
+
+// UpstreamConfig is a parent proxy that destination rules can route connections through.
+type UpstreamConfig struct {
+	Name string `yaml:"name"`
+	// URL is http://[user:password@]host:port for an HTTP CONNECT proxy or
+	// socks5://[user:password@]host:port for a SOCKS5 proxy.
+	URL string `yaml:"url"`
+	// Via names another upstream this one is reached through, forming a multi-hop chain.
+	Via string `yaml:"via,omitempty"`
+}
+
+// upstreamProxy is the parsed form of UpstreamConfig.
+type upstreamProxy struct {
+	name     string
+	scheme   string
+	address  string
+	username string
+	password string
+}
+
+// upstreamRoute is the chain of upstreams a connection is relayed through,
+// first hop first. An empty route dials the destination directly.
+type upstreamRoute []*upstreamProxy
+
+// String returns the hop names joined by " > ", or "direct".
+func (r upstreamRoute) String() string {
+	if len(r) == 0 {
+		return routeDirect
+	}
+	names := make([]string, len(r))
+	for i, hop := range r {
+		names[i] = hop.name
+	}
+	return strings.Join(names, " > ")
+}
+
+// parseUpstream checks an upstream's URL and returns its parsed form.
+func parseUpstream(config UpstreamConfig) (*upstreamProxy, error) {
+	if config.Name == "" || config.Name == routeDirect {
+		return nil, fmt.Errorf("upstream name must be set and not '%s'", routeDirect)
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("upstream '%s': invalid url: %v", config.Name, err)
+	}
+	proxy := &upstreamProxy{name: config.Name, scheme: strings.ToLower(u.Scheme), address: u.Host}
+	switch proxy.scheme {
+	case "http", "socks5":
+	default:
+		return nil, fmt.Errorf("upstream '%s': unsupported scheme '%s', expected http or socks5", config.Name, u.Scheme)
+	}
+	if _, port, err := net.SplitHostPort(u.Host); err != nil || port == "" {
+		return nil, fmt.Errorf("upstream '%s': url must include host and port", config.Name)
+	}
+	if u.User != nil {
+		proxy.username = u.User.Username()
+		proxy.password, _ = u.User.Password()
+	}
+	if proxy.scheme == "socks5" && (len(proxy.username) > 255 || len(proxy.password) > 255) {
+		return nil, fmt.Errorf("upstream '%s': SOCKS5 username and password are limited to 255 bytes", config.Name)
+	}
+	return proxy, nil
+}
+
+// newUpstreamRoutes parses the upstreams and returns the route to reach
+// each one, following via links. Unknown names and loops are errors.
+func newUpstreamRoutes(configs []UpstreamConfig) (map[string]upstreamRoute, error) {
+	proxies := make(map[string]*upstreamProxy)
+	via := make(map[string]string)
+	for _, config := range configs {
+		proxy, err := parseUpstream(config)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := proxies[proxy.name]; exists {
+			return nil, fmt.Errorf("duplicate upstream name '%s'", proxy.name)
+		}
+		proxies[proxy.name] = proxy
+		via[proxy.name] = config.Via
+	}
+
+	routes := make(map[string]upstreamRoute)
+	for name := range proxies {
+		var route upstreamRoute
+		for hop := name; hop != ""; hop = via[hop] {
+			proxy, exists := proxies[hop]
+			if !exists {
+				return nil, fmt.Errorf("upstream '%s': unknown upstream '%s' in via", name, hop)
+			}
+			if len(route) == len(proxies) {
+				return nil, fmt.Errorf("upstream '%s': via chain loops", name)
+			}
+			route = append(upstreamRoute{proxy}, route...)
+		}
+		routes[name] = route
+	}
+	return routes, nil
+}
+
+// dial connects to address through every hop of the route, reaching the
+// first hop from egress. Each hop is asked to connect to the next one, and the
+// last hop to address, which it resolves itself. The whole chain is bounded
+// by ctx.
+func (r upstreamRoute) dial(ctx context.Context, egress *egressPolicy, address string) (net.Conn, error) {
+	conn, err := egress.dial(ctx, r[0].address)
+	if err != nil {
+		return nil, fmt.Errorf("upstream '%s': %w", r[0].name, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	for i, hop := range r {
+		next := address
+		if i+1 < len(r) {
+			next = r[i+1].address
+		}
+		var tunnel net.Conn
+		if hop.scheme == "socks5" {
+			tunnel, err = hop.socks5Connect(conn, next)
+		} else {
+			tunnel, err = hop.httpConnect(conn, next)
+		}
+		if err != nil {
+			conn.Close()
+			if i+1 < len(r) {
+				// A hop that cannot reach the next one is a failure of the route itself.
+				return nil, fmt.Errorf("upstream '%s': %v", hop.name, err)
+			}
+			return nil, fmt.Errorf("upstream '%s': %w", hop.name, err)
+		}
+		conn = tunnel
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// httpConnect asks an HTTP proxy on conn to open a tunnel to address.
+func (p *upstreamProxy) httpConnect(conn net.Conn, address string) (net.Conn, error) {
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if p.username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.username + ":" + p.password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CONNECT response: %v", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: CONNECT to %s: %s", errConnectRefused, address, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// socks5Connect asks a SOCKS5 proxy on conn to connect to address,
+// authenticating with a username and password if the upstream has them.
+func (p *upstreamProxy) socks5Connect(conn net.Conn, address string) (net.Conn, error) {
+	greeting := []byte{socks5Version, 1, noAuth}
+	if p.username != "" {
+		greeting = []byte{socks5Version, 2, noAuth, userPassAuth}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return nil, err
+	}
+	choice := make([]byte, 2)
+	if _, err := io.ReadFull(conn, choice); err != nil {
+		return nil, fmt.Errorf("failed to read SOCKS5 method: %v", err)
+	}
+	if choice[0] != socks5Version {
+		return nil, fmt.Errorf("unexpected SOCKS version %d", choice[0])
+	}
+	switch {
+	case choice[1] == noAuth:
+	case choice[1] == userPassAuth && p.username != "":
+		auth := []byte{userPassVersion, byte(len(p.username))}
+		auth = append(auth, p.username...)
+		auth = append(auth, byte(len(p.password)))
+		auth = append(auth, p.password...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, err
+		}
+		status := make([]byte, 2)
+		if _, err := io.ReadFull(conn, status); err != nil {
+			return nil, fmt.Errorf("failed to read SOCKS5 authentication status: %v", err)
+		}
+		if status[1] != userPassSuccess {
+			return nil, fmt.Errorf("SOCKS5 authentication failed")
+		}
+	default:
+		return nil, fmt.Errorf("no acceptable SOCKS5 authentication method")
+	}
+
+	request, err := appendSocks5Destination([]byte{socks5Version, connectCmd, 0x00}, address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, fmt.Errorf("failed to read SOCKS5 reply: %v", err)
+	}
+	if reply[1] != socks5Succeeded {
+		return nil, socks5ReplyError(reply[1], address)
+	}
+	if _, err := readSocks5Address(conn, reply[3]); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// appendSocks5Destination appends ATYP, address and port for a "host:port"
+// address to buf, sending names unresolved.
+func appendSocks5Destination(buf []byte, address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in '%s'", address)
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		buf = append(append(buf, ipv4Addr), ip.To4()...)
+	case ip != nil:
+		buf = append(append(buf, ipv6Addr), ip.To16()...)
+	case len(host) > 255:
+		return nil, fmt.Errorf("host name too long for SOCKS5: %s", host)
+	default:
+		buf = append(append(buf, domainAddr, byte(len(host))), host...)
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(port)), nil
+}
+
+// socks5ReplyError converts an upstream's failure reply to an error that
+// socks5ReplyCode maps back to the same reply for our own clients.
+func socks5ReplyError(rep byte, address string) error {
+	var cause error
+	switch rep {
+	case socks5NetworkUnreachable:
+		cause = syscall.ENETUNREACH
+	case socks5HostUnreachable:
+		cause = syscall.EHOSTUNREACH
+	case socks5ConnectionRefused:
+		cause = syscall.ECONNREFUSED
+	case socks5TTLExpired:
+		cause = syscall.ETIMEDOUT
+	default:
+		return fmt.Errorf("%w: SOCKS5 connect to %s: reply %d", errConnectRefused, address, rep)
+	}
+	return fmt.Errorf("%w: SOCKS5 connect to %s: %w", errConnectRefused, address, cause)
+}